@@ -0,0 +1,37 @@
+package backends
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+// A Constructor creates a backend for a repo URL. The options are the parsed
+// query parameters of the URL.
+type Constructor func(u *url.URL, options url.Values) (repo.Backend, error)
+
+var constructors = map[string]Constructor{}
+
+// Register makes a backend available for a URL scheme. It is intended to be
+// called from the init function of backend packages.
+func Register(scheme string, constructor Constructor) {
+	if _, ok := constructors[scheme]; ok {
+		panic("backend registered twice for scheme " + scheme)
+	}
+	constructors[scheme] = constructor
+}
+
+// NewBackend creates a backend for the given URL using the constructor
+// registered for its scheme. URLs without a scheme are treated as file:// URLs.
+func NewBackend(u *url.URL) (repo.Backend, error) {
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "file"
+	}
+	constructor, ok := constructors[scheme]
+	if !ok {
+		return nil, errors.New("no backend for URL scheme " + scheme)
+	}
+	return constructor(u, u.Query())
+}
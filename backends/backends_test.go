@@ -0,0 +1,79 @@
+package backends_test
+
+import (
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/lucas-clemente/git-cr/backends"
+	"github.com/lucas-clemente/git-cr/git/repo"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestBackends(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Backends Suite")
+}
+
+type nullBackend struct {
+	url     *url.URL
+	options url.Values
+}
+
+func (b *nullBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	return nil, repo.ErrNotFound
+}
+
+func (b *nullBackend) WriteBlob(name string, r io.Reader) error {
+	return nil
+}
+
+func (b *nullBackend) CreateBlob(name string, r io.Reader) error {
+	return nil
+}
+
+func init() {
+	backends.Register("null", func(u *url.URL, options url.Values) (repo.Backend, error) {
+		return &nullBackend{url: u, options: options}, nil
+	})
+	backends.Register("file", func(u *url.URL, options url.Values) (repo.Backend, error) {
+		return &nullBackend{url: u, options: options}, nil
+	})
+}
+
+var _ = Describe("Backend registry", func() {
+	It("passes the full URL and options to the constructor", func() {
+		u, err := url.Parse("null://user@host:1234/some/path?foo=bar")
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := backends.NewBackend(u)
+		Ω(err).ShouldNot(HaveOccurred())
+		null := b.(*nullBackend)
+		Ω(null.url.User.Username()).Should(Equal("user"))
+		Ω(null.url.Host).Should(Equal("host:1234"))
+		Ω(null.url.Path).Should(Equal("/some/path"))
+		Ω(null.options.Get("foo")).Should(Equal("bar"))
+	})
+
+	It("treats URLs without scheme as files", func() {
+		u, err := url.Parse("/some/path")
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := backends.NewBackend(u)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(b.(*nullBackend).url.Path).Should(Equal("/some/path"))
+	})
+
+	It("errors on unknown schemes", func() {
+		u, err := url.Parse("foo://bar")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = backends.NewBackend(u)
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("panics when registering a scheme twice", func() {
+		Ω(func() {
+			backends.Register("null", nil)
+		}).Should(Panic())
+	})
+})
@@ -0,0 +1,293 @@
+package gitstore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/lucas-clemente/git-cr/backends"
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+func init() {
+	for _, scheme := range []string{"git+file", "git+ssh", "git+http", "git+https"} {
+		backends.Register(scheme, newGitBackendFromURL)
+	}
+}
+
+// gitEnv makes commits independent of the user's git configuration
+var gitEnv = []string{
+	"GIT_AUTHOR_NAME=git-cr",
+	"GIT_AUTHOR_EMAIL=git-cr@localhost",
+	"GIT_COMMITTER_NAME=git-cr",
+	"GIT_COMMITTER_EMAIL=git-cr@localhost",
+}
+
+type gitBackend struct {
+	remote string
+	ref    string
+	dir    string
+}
+
+// NewGitBackend returns a backend that stores data as files in a branch of a
+// plain git repository. The blobs are committed to a local bare repository in
+// cacheDir and pushed to the remote on each write.
+func NewGitBackend(remote, branch, cacheDir string) (repo.Backend, error) {
+	b := &gitBackend{
+		remote: remote,
+		ref:    "refs/heads/" + branch,
+		dir:    cacheDir,
+	}
+
+	if _, err := os.Stat(cacheDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(cacheDir), 0755); err != nil {
+			return nil, err
+		}
+		if _, err := b.git(nil, "init", "--quiet", "--bare", cacheDir); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.sync(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// sync sets the local branch to the state of the remote
+func (b *gitBackend) sync() error {
+	remoteRefs, err := b.git(nil, "ls-remote", b.remote, b.ref)
+	if err != nil {
+		return err
+	}
+	if len(remoteRefs) == 0 {
+		_, err = b.git(nil, "update-ref", "-d", b.ref)
+		return err
+	}
+	_, err = b.git(nil, "fetch", "--quiet", b.remote, "+"+b.ref+":"+b.ref)
+	return err
+}
+
+// newGitBackendFromURL handles git+<scheme>:// URLs, e.g. git+ssh://git@github.com/user/repo.git.
+// The branch can be set using the branch option and defaults to master.
+func newGitBackendFromURL(u *url.URL, options url.Values) (repo.Backend, error) {
+	remoteURL := *u
+	remoteURL.Scheme = strings.TrimPrefix(u.Scheme, "git+")
+	remoteURL.RawQuery = ""
+	remote := remoteURL.String()
+
+	branch := options.Get("branch")
+	if branch == "" {
+		branch = "master"
+	}
+
+	cacheRoot, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum([]byte(remote + " " + branch))
+	cacheDir := filepath.Join(cacheRoot, "git-cr", hex.EncodeToString(hash[:]))
+
+	return NewGitBackend(remote, branch, cacheDir)
+}
+
+func (b *gitBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	sha, err := b.revParse(b.ref + ":" + name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := b.git(nil, "cat-file", "blob", sha)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
+}
+
+func (b *gitBackend) WriteBlob(name string, r io.Reader) error {
+	return b.commitBlob(name, r, false)
+}
+
+// CreateBlob fails if the blob exists in the branch. Since pushes are never
+// forced, a concurrent commit on the remote makes the push fail and the check
+// is repeated on the updated branch.
+func (b *gitBackend) CreateBlob(name string, r io.Reader) error {
+	return b.commitBlob(name, r, true)
+}
+
+// maxPushAttempts limits retries if other clients push concurrently
+const maxPushAttempts = 5
+
+func (b *gitBackend) commitBlob(name string, r io.Reader, exclusive bool) error {
+	blob, err := b.git(r, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return err
+	}
+	blobSHA := strings.TrimSpace(string(blob))
+
+	var check func() error
+	if exclusive {
+		check = func() error {
+			exists, err := b.exists(name)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return repo.ErrExists
+			}
+			return nil
+		}
+	}
+	return b.commit(name, blobSHA, check)
+}
+
+// DeleteBlob commits the removal of the blob
+func (b *gitBackend) DeleteBlob(name string) error {
+	return b.commit(name, "", func() error {
+		exists, err := b.exists(name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return repo.ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (b *gitBackend) exists(name string) (bool, error) {
+	_, err := b.revParse(b.ref + ":" + name)
+	if err == repo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// revParse resolves a revision, e.g. a file on the branch. ErrNotFound is only
+// returned if the branch or the file doesn't exist: with --quiet, rev-parse
+// exits with 1 for unknown revisions and with 128 for real failures.
+func (b *gitBackend) revParse(rev string) (string, error) {
+	out, err := b.git(nil, "rev-parse", "--quiet", "--verify", rev)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return "", repo.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// commit sets name to blobSHA, or removes it if blobSHA is empty, and pushes
+// the change. check is repeated on every attempt and may be nil.
+func (b *gitBackend) commit(name, blobSHA string, check func() error) error {
+	for attempt := 1; ; attempt++ {
+		if check != nil {
+			if err := check(); err != nil {
+				return err
+			}
+		}
+
+		commit, err := b.commitOnBranch(name, blobSHA)
+		if err != nil {
+			return err
+		}
+
+		err = b.push(commit)
+		if err == nil {
+			_, err = b.git(nil, "update-ref", b.ref, commit)
+			return err
+		}
+		if attempt == maxPushAttempts {
+			return err
+		}
+		// The remote probably moved on, retry on top of it
+		if err := b.sync(); err != nil {
+			return err
+		}
+	}
+}
+
+// commitOnBranch creates a commit that adds (or removes) the blob on top of the branch, without updating the branch
+func (b *gitBackend) commitOnBranch(name, blobSHA string) (string, error) {
+	parentSHA, err := b.revParse(b.ref)
+	if err != nil && err != repo.ErrNotFound {
+		return "", err
+	}
+
+	// Build the new tree in a temporary index
+	index, err := ioutil.TempFile(b.dir, "index")
+	if err != nil {
+		return "", err
+	}
+	index.Close()
+	os.Remove(index.Name())
+	defer os.Remove(index.Name())
+	indexEnv := "GIT_INDEX_FILE=" + index.Name()
+
+	if parentSHA != "" {
+		if _, err := b.gitWithEnv(indexEnv, nil, "read-tree", parentSHA); err != nil {
+			return "", err
+		}
+	}
+	// A zero mode removes the entry, which works without a work tree
+	indexInfo := "100644 " + blobSHA + "\t" + name + "\n"
+	message := "Update " + name
+	if blobSHA == "" {
+		indexInfo = "0 " + strings.Repeat("0", 40) + "\t" + name + "\n"
+		message = "Remove " + name
+	}
+	if _, err := b.gitWithEnv(indexEnv, strings.NewReader(indexInfo), "update-index", "--add", "--index-info"); err != nil {
+		return "", err
+	}
+	tree, err := b.gitWithEnv(indexEnv, nil, "write-tree")
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"commit-tree", strings.TrimSpace(string(tree)), "-m", message}
+	if parentSHA != "" {
+		args = append(args, "-p", parentSHA)
+	}
+	commit, err := b.git(nil, args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(commit)), nil
+}
+
+// push updates the remote branch, failing if it is not a fast-forward
+func (b *gitBackend) push(commit string) error {
+	_, err := b.git(nil, "push", "--quiet", b.remote, commit+":"+b.ref)
+	return err
+}
+
+func (b *gitBackend) git(stdin io.Reader, args ...string) ([]byte, error) {
+	return b.gitWithEnv("", stdin, args...)
+}
+
+// gitWithEnv runs git on the cache repo and returns its stdout
+func (b *gitBackend) gitWithEnv(env string, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir", b.dir}, args...)...)
+	cmd.Env = append(os.Environ(), gitEnv...)
+	if env != "" {
+		cmd.Env = append(cmd.Env, env)
+	}
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if stderr.Len() == 0 {
+			return out, err
+		}
+		return out, fmt.Errorf("git %s failed: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
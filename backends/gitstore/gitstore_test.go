@@ -0,0 +1,159 @@
+package gitstore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/lucas-clemente/git-cr/backends"
+	"github.com/lucas-clemente/git-cr/backends/gitstore"
+	"github.com/lucas-clemente/git-cr/git/repo"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestGitStore(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Git Store Backend Suite")
+}
+
+func readAll(backend repo.Backend, name string) []byte {
+	r, err := backend.ReadBlob(name)
+	Ω(err).ShouldNot(HaveOccurred())
+	data, err := ioutil.ReadAll(r)
+	Ω(err).ShouldNot(HaveOccurred())
+	return data
+}
+
+var _ = Describe("Git Store Backend", func() {
+	var (
+		tmpDir    string
+		remoteDir string
+		backend   repo.Backend
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		tmpDir, err = ioutil.TempDir("", "io.clemente.git-cr.test")
+		Ω(err).ShouldNot(HaveOccurred())
+		remoteDir = tmpDir + "/remote.git"
+		err = exec.Command("git", "init", "--quiet", "--bare", remoteDir).Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		backend, err = gitstore.NewGitBackend(remoteDir, "master", tmpDir+"/cache1")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("returns ErrNotFound in empty repos", func() {
+		_, err := backend.ReadBlob("foo")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+	})
+
+	It("returns other failures of git as errors", func() {
+		Ω(os.RemoveAll(tmpDir + "/cache1")).Should(Succeed())
+		_, err := backend.ReadBlob("foo")
+		Ω(err).Should(HaveOccurred())
+		Ω(err).ShouldNot(Equal(repo.ErrNotFound))
+	})
+
+	It("writes and reads", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(backend, "foo")).Should(Equal([]byte("bar")))
+		_, err = backend.ReadBlob("baz")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+	})
+
+	It("pushes to the remote", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.WriteBlob("foo", bytes.NewBufferString("baz"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		out, err := exec.Command("git", "--git-dir", remoteDir, "cat-file", "blob", "master:foo").Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal([]byte("baz")))
+
+		backend2, err := gitstore.NewGitBackend(remoteDir, "master", tmpDir+"/cache2")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(backend2, "foo")).Should(Equal([]byte("baz")))
+	})
+
+	It("keeps other files when writing", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.WriteBlob("baz", bytes.NewBufferString("qux"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(backend, "foo")).Should(Equal([]byte("bar")))
+		Ω(readAll(backend, "baz")).Should(Equal([]byte("qux")))
+	})
+
+	It("creates blobs only once", func() {
+		err := backend.CreateBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.CreateBlob("foo", bytes.NewBufferString("baz"))
+		Ω(err).Should(Equal(repo.ErrExists))
+		Ω(readAll(backend, "foo")).Should(Equal([]byte("bar")))
+	})
+
+	It("deletes", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.WriteBlob("baz", bytes.NewBufferString("qux"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = repo.DeleteBlob(backend, "foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = backend.ReadBlob("foo")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+		Ω(readAll(backend, "baz")).Should(Equal([]byte("qux")))
+		err = repo.DeleteBlob(backend, "foo")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+	})
+
+	It("notices blobs created by other clients", func() {
+		backend2, err := gitstore.NewGitBackend(remoteDir, "master", tmpDir+"/cache2")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend2.CreateBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.CreateBlob("foo", bytes.NewBufferString("baz"))
+		Ω(err).Should(Equal(repo.ErrExists))
+	})
+
+	It("keeps blobs written concurrently by other clients", func() {
+		backend2, err := gitstore.NewGitBackend(remoteDir, "master", tmpDir+"/cache2")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend2.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.WriteBlob("baz", bytes.NewBufferString("qux"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		backend3, err := gitstore.NewGitBackend(remoteDir, "master", tmpDir+"/cache3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(backend3, "foo")).Should(Equal([]byte("bar")))
+		Ω(readAll(backend3, "baz")).Should(Equal([]byte("qux")))
+	})
+
+	It("is available as git+file URL", func() {
+		oldCache := os.Getenv("XDG_CACHE_HOME")
+		defer os.Setenv("XDG_CACHE_HOME", oldCache)
+		os.Setenv("XDG_CACHE_HOME", tmpDir+"/xdg")
+
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		u, err := url.Parse("git+file://" + remoteDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		backend2, err := backends.NewBackend(u)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(backend2, "foo")).Should(Equal([]byte("bar")))
+	})
+})
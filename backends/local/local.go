@@ -2,11 +2,20 @@ package local
 
 import (
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 
+	"github.com/lucas-clemente/git-cr/backends"
 	"github.com/lucas-clemente/git-cr/git/repo"
 )
 
+func init() {
+	backends.Register("file", func(u *url.URL, options url.Values) (repo.Backend, error) {
+		return NewLocalBackend(u.Path)
+	})
+}
+
 type localBackend struct {
 	path string
 }
@@ -27,12 +36,88 @@ func (b *localBackend) ReadBlob(name string) (io.ReadCloser, error) {
 	return f, err
 }
 
+// WriteBlob writes to a temporary file that is renamed into place once it is
+// synced to disk, so that a crash never leaves a truncated blob behind
 func (b *localBackend) WriteBlob(name string, r io.Reader) error {
-	f, err := os.Create(b.path + "/" + name)
+	tmpName, err := b.writeTempFile(name, r)
+	if err != nil {
+		return err
+	}
+	// No-op after a successful rename
+	defer os.Remove(tmpName)
+
+	if err := os.Rename(tmpName, b.path+"/"+name); err != nil {
+		return err
+	}
+	b.syncDir()
+	return nil
+}
+
+// CreateBlob hard-links a temporary file into place, which fails atomically if
+// the blob already exists
+func (b *localBackend) CreateBlob(name string, r io.Reader) error {
+	tmpName, err := b.writeTempFile(name, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	if err := os.Link(tmpName, b.path+"/"+name); err != nil {
+		if os.IsExist(err) {
+			return repo.ErrExists
+		}
+		return err
+	}
+	b.syncDir()
+	return nil
+}
+
+// DeleteBlob removes the blob's file
+func (b *localBackend) DeleteBlob(name string) error {
+	err := os.Remove(b.path + "/" + name)
+	if os.IsNotExist(err) {
+		return repo.ErrNotFound
+	}
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = io.Copy(f, r)
-	return err
+	b.syncDir()
+	return nil
+}
+
+// writeTempFile writes the data to a temporary file next to the blob and syncs it to disk
+func (b *localBackend) writeTempFile(name string, r io.Reader) (string, error) {
+	f, err := ioutil.TempFile(b.path, "."+name+".tmp")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	// TempFile uses 0600, use the same mode as os.Create
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// syncDir makes renames durable, which is not supported on all platforms
+func (b *localBackend) syncDir() {
+	if dir, err := os.Open(b.path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
 }
@@ -2,6 +2,8 @@ package local_test
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -18,6 +20,12 @@ func TestLocalRepo(t *testing.T) {
 	RunSpecs(t, "Local Backend Suite")
 }
 
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
 var _ = Describe("Local Backend", func() {
 	var (
 		tmpDir  string
@@ -55,4 +63,38 @@ var _ = Describe("Local Backend", func() {
 		Ω(err).ShouldNot(HaveOccurred())
 		Ω(data).Should(Equal([]byte("bar")))
 	})
+	It("keeps the old blob if a write fails", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.WriteBlob("foo", io.MultiReader(bytes.NewBufferString("baz"), failingReader{}))
+		Ω(err).Should(MatchError("disk full"))
+		data, err := ioutil.ReadFile(tmpDir + "/foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("bar")))
+		files, err := ioutil.ReadDir(tmpDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(1))
+	})
+	It("creates blobs only once", func() {
+		err := backend.CreateBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.CreateBlob("foo", bytes.NewBufferString("baz"))
+		Ω(err).Should(Equal(repo.ErrExists))
+		data, err := ioutil.ReadFile(tmpDir + "/foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("bar")))
+		files, err := ioutil.ReadDir(tmpDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(1))
+	})
+	It("deletes", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = repo.DeleteBlob(backend, "foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = backend.ReadBlob("foo")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+		err = repo.DeleteBlob(backend, "foo")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+	})
 })
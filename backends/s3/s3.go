@@ -0,0 +1,400 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lucas-clemente/git-cr/backends"
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+func init() {
+	backends.Register("s3", newS3BackendFromURL)
+}
+
+// Config holds the settings needed to talk to an S3-compatible service
+type Config struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.amazonaws.com
+	Endpoint string
+	// Region is used for request signing, e.g. us-east-1
+	Region string
+	Bucket string
+	// Prefix is prepended to all blob names
+	Prefix string
+
+	// AccessKeyID and SecretAccessKey are used to sign requests. If empty,
+	// requests are sent unsigned.
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is needed along with temporary credentials, e.g. of an
+	// assumed role
+	SessionToken string
+
+	// PartSize is the size of the parts of multipart uploads, which are used
+	// for blobs larger than that. Only a single part is kept in memory. S3
+	// requires at least 5 MiB, the default is 8 MiB.
+	PartSize int
+}
+
+const defaultPartSize = 8 << 20
+
+type s3Backend struct {
+	config   Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Backend returns a backend that stores data in an S3 bucket
+func NewS3Backend(config Config) (repo.Backend, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("no S3 bucket given")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, errors.New("invalid S3 endpoint " + config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = defaultPartSize
+	}
+	return &s3Backend{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{},
+	}, nil
+}
+
+// newS3BackendFromURL creates a backend for s3://bucket/prefix URLs. The
+// endpoint and region can be given as options, otherwise they are taken from
+// the usual AWS environment variables, as are the credentials.
+func newS3BackendFromURL(u *url.URL, options url.Values) (repo.Backend, error) {
+	region := firstNonEmpty(options.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	endpoint := firstNonEmpty(options.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"), "https://s3."+region+".amazonaws.com")
+	return NewS3Backend(Config{
+		Endpoint:        endpoint,
+		Region:          region,
+		Bucket:          u.Host,
+		Prefix:          u.Path,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	})
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (b *s3Backend) ReadBlob(name string) (io.ReadCloser, error) {
+	resp, err := b.do("GET", name, "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, repo.ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 returned %s while reading %s", resp.Status, name)
+	}
+	return resp.Body, nil
+}
+
+func (b *s3Backend) WriteBlob(name string, r io.Reader) error {
+	return b.put(name, r, false)
+}
+
+// CreateBlob uses a conditional write, which fails if the object already exists
+func (b *s3Backend) CreateBlob(name string, r io.Reader) error {
+	return b.put(name, r, true)
+}
+
+// put writes blobs that fit into a single part with a single request, and
+// larger ones as multipart uploads
+func (b *s3Backend) put(name string, r io.Reader, exclusive bool) error {
+	part, last, err := b.readPart(r)
+	if err != nil {
+		return err
+	}
+	if !last {
+		return b.putMultipart(name, part, r, exclusive)
+	}
+
+	header := http.Header{}
+	if exclusive {
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := b.do("PUT", name, "", part, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if exclusive && (resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict) {
+		return repo.ErrExists
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 returned %s while writing %s", resp.Status, name)
+	}
+	return nil
+}
+
+// readPart reads up to PartSize bytes and reports whether r ended
+func (b *s3Backend) readPart(r io.Reader) ([]byte, bool, error) {
+	part := make([]byte, b.config.PartSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return part[:n], true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return part, false, nil
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// s3Error is returned in the body of some responses, even with status 200
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+}
+
+// putMultipart uploads r in parts, starting with first. Failed uploads are
+// aborted, so they don't keep their parts around.
+func (b *s3Backend) putMultipart(name string, first []byte, r io.Reader, exclusive bool) error {
+	resp, err := b.do("POST", name, "uploads=", nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiated initiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 returned %s while starting to write %s", resp.Status, name)
+	}
+	if err != nil {
+		return err
+	}
+	uploadQuery := "uploadId=" + queryEscape(initiated.UploadID)
+
+	if err := b.uploadParts(name, uploadQuery, first, r, exclusive); err != nil {
+		if resp, abortErr := b.do("DELETE", name, uploadQuery, nil, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *s3Backend) uploadParts(name, uploadQuery string, part []byte, r io.Reader, exclusive bool) error {
+	complete := completeMultipartUpload{}
+	for last := false; ; {
+		number := len(complete.Parts) + 1
+		resp, err := b.do("PUT", name, fmt.Sprintf("partNumber=%d&%s", number, uploadQuery), part, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("s3 returned %s while writing part %d of %s", resp.Status, number, name)
+		}
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		if last {
+			break
+		}
+		if part, last, err = b.readPart(r); err != nil {
+			return err
+		}
+		// A blob might end exactly at a part boundary
+		if last && len(part) == 0 {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if exclusive {
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := b.do("POST", name, uploadQuery, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if exclusive && (resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict) {
+		return repo.ErrExists
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 returned %s while writing %s", resp.Status, name)
+	}
+	var result s3Error
+	if xml.NewDecoder(resp.Body).Decode(&result) == nil {
+		return fmt.Errorf("s3 returned %s while writing %s", result.Code, name)
+	}
+	return nil
+}
+
+// DeleteBlob deletes the object. Amazon S3 doesn't report missing objects, so
+// ErrNotFound is only returned by some compatible services.
+func (b *s3Backend) DeleteBlob(name string) error {
+	resp, err := b.do("DELETE", name, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return repo.ErrNotFound
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 returned %s while deleting %s", resp.Status, name)
+	}
+	return nil
+}
+
+// do sends a path-style request for the given blob. The query has to be in
+// canonical form, i.e. sorted and escaped with queryEscape.
+func (b *s3Backend) do(method, name, query string, body []byte, header http.Header) (*http.Response, error) {
+	key := strings.Trim(b.config.Prefix, "/")
+	if key != "" {
+		key += "/"
+	}
+	key += name
+
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.config.Bucket + "/" + key
+	u.RawPath = uriEncode(u.Path)
+	u.RawQuery = query
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if b.config.AccessKeyID != "" {
+		b.sign(req, body, time.Now())
+	}
+	return b.client.Do(req)
+}
+
+// sign adds an AWS signature version 4 to the request
+func (b *s3Backend) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if b.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.config.SessionToken)
+		headers["x-amz-security-token"] = b.config.SessionToken
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + b.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+b.config.SecretAccessKey), day)
+	key = hmacSHA256(key, b.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.config.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// queryEscape escapes a query parameter as required by AWS
+func queryEscape(value string) string {
+	return strings.Replace(uriEncode(value), "/", "%2F", -1)
+}
+
+// uriEncode escapes a path as required by AWS, leaving slashes intact
+func uriEncode(path string) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(path) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,249 @@
+package s3_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/lucas-clemente/git-cr/backends/s3"
+	"github.com/lucas-clemente/git-cr/git/repo"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestS3(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "S3 Backend Suite")
+}
+
+// fakeS3 is a minimal in-process stand-in for an S3 server using path-style requests
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	// uploads holds the parts of unfinished multipart uploads by ID
+	uploads map[string]map[int][]byte
+	// requests counts the requests by method
+	requests map[string]int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer GinkgoRecover()
+	f.Lock()
+	defer f.Unlock()
+
+	Ω(r.Header.Get("Authorization")).Should(HavePrefix("AWS4-HMAC-SHA256 Credential=AKID/"))
+	Ω(r.Header.Get("Authorization")).Should(ContainSubstring("/eu-west-1/s3/aws4_request"))
+	f.requests[r.Method]++
+
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	switch {
+	case r.Method == "POST" && query["uploads"] != nil:
+		uploadID = strconv.Itoa(len(f.uploads)) + "/upload"
+		f.uploads[uploadID] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case r.Method == "POST" && uploadID != "":
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		Ω(xml.NewDecoder(r.Body).Decode(&complete)).Should(Succeed())
+		if _, ok := f.objects[r.URL.Path]; ok && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		var data []byte
+		for i, part := range complete.Parts {
+			Ω(part.PartNumber).Should(Equal(i + 1))
+			Ω(part.ETag).Should(Equal(fmt.Sprintf(`"%d"`, i+1)))
+			data = append(data, f.uploads[uploadID][part.PartNumber]...)
+		}
+		delete(f.uploads, uploadID)
+		f.objects[r.URL.Path] = data
+		w.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+	case r.Method == "GET":
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == "PUT":
+		if _, ok := f.objects[r.URL.Path]; ok && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		Ω(err).ShouldNot(HaveOccurred())
+		hash := sha256.Sum256(data)
+		Ω(r.Header.Get("X-Amz-Content-Sha256")).Should(Equal(hex.EncodeToString(hash[:])))
+		if uploadID != "" {
+			number, err := strconv.Atoi(query.Get("partNumber"))
+			Ω(err).ShouldNot(HaveOccurred())
+			f.uploads[uploadID][number] = data
+			w.Header().Set("ETag", fmt.Sprintf(`"%d"`, number))
+			return
+		}
+		f.objects[r.URL.Path] = data
+	case r.Method == "DELETE" && uploadID != "":
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE":
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+var _ = Describe("S3 Backend", func() {
+	var (
+		server  *httptest.Server
+		fake    *fakeS3
+		backend repo.Backend
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		fake = &fakeS3{objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}, requests: map[string]int{}}
+		server = httptest.NewServer(fake)
+
+		backend, err = s3.NewS3Backend(s3.Config{
+			Endpoint:        server.URL,
+			Region:          "eu-west-1",
+			Bucket:          "bucket",
+			Prefix:          "/some/repo/",
+			AccessKeyID:     "AKID",
+			SecretAccessKey: "secret",
+			PartSize:        4,
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("reads", func() {
+		fake.objects["/bucket/some/repo/foo"] = []byte("bar")
+		r, err := backend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		data, err := ioutil.ReadAll(r)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("bar")))
+	})
+
+	It("writes", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fake.objects["/bucket/some/repo/foo"]).Should(Equal([]byte("bar")))
+	})
+
+	It("creates blobs only once", func() {
+		err := backend.CreateBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.CreateBlob("foo", bytes.NewBufferString("baz"))
+		Ω(err).Should(Equal(repo.ErrExists))
+		Ω(fake.objects["/bucket/some/repo/foo"]).Should(Equal([]byte("bar")))
+	})
+
+	It("writes large blobs in parts", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("foobarbaz"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fake.objects["/bucket/some/repo/foo"]).Should(Equal([]byte("foobarbaz")))
+		// foob, arba, z
+		Ω(fake.requests["PUT"]).Should(Equal(3))
+		Ω(fake.uploads).Should(BeEmpty())
+	})
+
+	It("writes blobs ending at a part boundary", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("foobar42"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fake.objects["/bucket/some/repo/foo"]).Should(Equal([]byte("foobar42")))
+		Ω(fake.requests["PUT"]).Should(Equal(2))
+	})
+
+	It("creates large blobs only once", func() {
+		err := backend.CreateBlob("foo", bytes.NewBufferString("foobarbaz"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.CreateBlob("foo", bytes.NewBufferString("foobazbar"))
+		Ω(err).Should(Equal(repo.ErrExists))
+		Ω(fake.objects["/bucket/some/repo/foo"]).Should(Equal([]byte("foobarbaz")))
+		Ω(fake.uploads).Should(BeEmpty())
+	})
+
+	It("aborts uploads if reading fails", func() {
+		r := io.MultiReader(bytes.NewBufferString("foobarbaz"), iotest.TimeoutReader(bytes.NewBufferString("x")))
+		err := backend.WriteBlob("foo", r)
+		Ω(err).Should(Equal(iotest.ErrTimeout))
+		Ω(fake.objects).ShouldNot(HaveKey("/bucket/some/repo/foo"))
+		Ω(fake.uploads).Should(BeEmpty())
+	})
+
+	It("deletes", func() {
+		fake.objects["/bucket/some/repo/foo"] = []byte("bar")
+		err := repo.DeleteBlob(backend, "foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fake.objects).ShouldNot(HaveKey("/bucket/some/repo/foo"))
+	})
+
+	It("returns ErrNotFound for missing blobs", func() {
+		_, err := backend.ReadBlob("foo")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+	})
+
+	It("signs session tokens", func() {
+		var header http.Header
+		server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header
+			w.Write([]byte("bar"))
+		})
+		backend, err := s3.NewS3Backend(s3.Config{
+			Endpoint:        server.URL,
+			Region:          "eu-west-1",
+			Bucket:          "bucket",
+			AccessKeyID:     "AKID",
+			SecretAccessKey: "secret",
+			SessionToken:    "token",
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = backend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(header.Get("X-Amz-Security-Token")).Should(Equal("token"))
+		Ω(header.Get("Authorization")).Should(ContainSubstring("SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token,"))
+	})
+
+	It("doesn't send session tokens without one", func() {
+		fake.objects["/bucket/some/repo/foo"] = []byte("bar")
+		var header http.Header
+		server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header
+			fake.ServeHTTP(w, r)
+		})
+		_, err := backend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(header).ShouldNot(HaveKey("X-Amz-Security-Token"))
+		Ω(header.Get("Authorization")).Should(ContainSubstring("SignedHeaders=host;x-amz-content-sha256;x-amz-date,"))
+	})
+
+	It("rejects configs without bucket", func() {
+		_, err := s3.NewS3Backend(s3.Config{Endpoint: server.URL})
+		Ω(err).Should(HaveOccurred())
+		Ω(strings.ToLower(err.Error())).Should(ContainSubstring("bucket"))
+	})
+})
@@ -0,0 +1,184 @@
+package sftp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/lucas-clemente/git-cr/backends"
+	"github.com/lucas-clemente/git-cr/git/repo"
+	sftpclient "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func init() {
+	backends.Register("sftp", newSFTPBackendFromURL)
+}
+
+type sftpBackend struct {
+	client *sftpclient.Client
+	path   string
+}
+
+// NewSFTPBackend returns a backend that stores data in the given path on an SFTP server
+func NewSFTPBackend(client *sftpclient.Client, path string) (repo.Backend, error) {
+	if err := client.MkdirAll(path); err != nil {
+		return nil, err
+	}
+	return &sftpBackend{client: client, path: path}, nil
+}
+
+// newSFTPBackendFromURL connects to sftp://user@host:port/path URLs using the
+// keys from the user's SSH agent, verifying the host against known_hosts.
+// Paths starting with /~/ are relative to the user's home directory.
+func newSFTPBackendFromURL(u *url.URL, options url.Values) (repo.Backend, error) {
+	config, err := sshClientConfig(u)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftpclient.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p := u.Path
+	if strings.HasPrefix(p, "/~/") {
+		p = strings.TrimPrefix(p, "/~/")
+	}
+	return NewSFTPBackend(client, p)
+}
+
+func sshClientConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	username := u.User.Username()
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = current.Username
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("no SSH agent found, SSH_AUTH_SOCK is not set")
+	}
+	agentConn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+func (b *sftpBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	f, err := b.client.Open(path.Join(b.path, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, repo.ErrNotFound
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteBlob writes to a temporary file that is renamed into place afterwards
+func (b *sftpBackend) WriteBlob(name string, r io.Reader) error {
+	tmpName, err := b.writeTempFile(name, r)
+	if err != nil {
+		return err
+	}
+	// No-op after a successful rename
+	defer b.client.Remove(tmpName)
+
+	return b.client.PosixRename(tmpName, path.Join(b.path, name))
+}
+
+// CreateBlob hard-links a temporary file into place, which fails if the blob
+// already exists
+func (b *sftpBackend) CreateBlob(name string, r io.Reader) error {
+	tmpName, err := b.writeTempFile(name, r)
+	if err != nil {
+		return err
+	}
+	defer b.client.Remove(tmpName)
+
+	if err := b.client.Link(tmpName, path.Join(b.path, name)); err != nil {
+		// SFTP doesn't report why the link failed
+		if _, statErr := b.client.Stat(path.Join(b.path, name)); statErr == nil {
+			return repo.ErrExists
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteBlob removes the blob's file
+func (b *sftpBackend) DeleteBlob(name string) error {
+	err := b.client.Remove(path.Join(b.path, name))
+	if os.IsNotExist(err) {
+		return repo.ErrNotFound
+	}
+	return err
+}
+
+func (b *sftpBackend) writeTempFile(name string, r io.Reader) (string, error) {
+	tmpName := path.Join(b.path, "."+name+".tmp"+randomSuffix())
+	f, err := b.client.Create(tmpName)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		b.client.Remove(tmpName)
+		return "", err
+	}
+	// Not all servers support fsync, the rename still protects against client crashes
+	f.Sync()
+	if err := f.Close(); err != nil {
+		b.client.Remove(tmpName)
+		return "", err
+	}
+	return tmpName, nil
+}
+
+func randomSuffix() string {
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(suffix[:])
+}
@@ -0,0 +1,207 @@
+package sftp_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lucas-clemente/git-cr/backends"
+	_ "github.com/lucas-clemente/git-cr/backends/sftp"
+	"github.com/lucas-clemente/git-cr/git/repo"
+	sftpclient "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestSFTP(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SFTP Backend Suite")
+}
+
+// serveSFTP runs an in-process SSH server that only accepts the given client key
+// and serves the sftp subsystem from the local filesystem
+func serveSFTP(listener net.Listener, hostKey ssh.Signer, clientKey ssh.PublicKey) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "git" && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					return
+				}
+				go func(in <-chan *ssh.Request) {
+					for req := range in {
+						isSFTP := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+						req.Reply(isSFTP, nil)
+						if isSFTP {
+							server, err := sftpclient.NewServer(channel)
+							if err != nil {
+								return
+							}
+							server.Serve()
+							channel.Close()
+						}
+					}
+				}(requests)
+			}
+		}()
+	}
+}
+
+func newSigner() (ssh.Signer, ed25519.PrivateKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	Ω(err).ShouldNot(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(key)
+	Ω(err).ShouldNot(HaveOccurred())
+	return signer, key
+}
+
+var _ = Describe("SFTP Backend", func() {
+	var (
+		tmpDir   string
+		homeDir  string
+		listener net.Listener
+		backend  repo.Backend
+		oldHome  string
+		oldSock  string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		tmpDir, err = ioutil.TempDir("", "io.clemente.git-cr.test")
+		Ω(err).ShouldNot(HaveOccurred())
+		homeDir, err = ioutil.TempDir("", "io.clemente.git-cr.test")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		hostKey, _ := newSigner()
+		clientKey, clientPrivateKey := newSigner()
+
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		go serveSFTP(listener, hostKey, clientKey.PublicKey())
+
+		// known_hosts in a fake home dir
+		err = os.Mkdir(filepath.Join(homeDir, ".ssh"), 0700)
+		Ω(err).ShouldNot(HaveOccurred())
+		line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostKey.PublicKey())
+		err = ioutil.WriteFile(filepath.Join(homeDir, ".ssh", "known_hosts"), []byte(line+"\n"), 0600)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// SSH agent holding the client key
+		keyring := agent.NewKeyring()
+		err = keyring.Add(agent.AddedKey{PrivateKey: clientPrivateKey})
+		Ω(err).ShouldNot(HaveOccurred())
+		socket := filepath.Join(homeDir, "agent.sock")
+		agentListener, err := net.Listen("unix", socket)
+		Ω(err).ShouldNot(HaveOccurred())
+		go func() {
+			for {
+				conn, err := agentListener.Accept()
+				if err != nil {
+					return
+				}
+				go agent.ServeAgent(keyring, conn)
+			}
+		}()
+
+		oldHome = os.Getenv("HOME")
+		oldSock = os.Getenv("SSH_AUTH_SOCK")
+		os.Setenv("HOME", homeDir)
+		os.Setenv("SSH_AUTH_SOCK", socket)
+
+		u, err := url.Parse("sftp://git@" + listener.Addr().String() + tmpDir + "/repo")
+		Ω(err).ShouldNot(HaveOccurred())
+		backend, err = backends.NewBackend(u)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.Setenv("HOME", oldHome)
+		os.Setenv("SSH_AUTH_SOCK", oldSock)
+		listener.Close()
+		os.RemoveAll(tmpDir)
+		os.RemoveAll(homeDir)
+	})
+
+	It("reads", func() {
+		err := ioutil.WriteFile(tmpDir+"/repo/foo", []byte("bar"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+		r, err := backend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		data, err := ioutil.ReadAll(r)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("bar")))
+	})
+
+	It("writes", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		data, err := ioutil.ReadFile(tmpDir + "/repo/foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("bar")))
+	})
+
+	It("creates blobs only once", func() {
+		err := backend.CreateBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.CreateBlob("foo", bytes.NewBufferString("baz"))
+		Ω(err).Should(Equal(repo.ErrExists))
+		data, err := ioutil.ReadFile(tmpDir + "/repo/foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("bar")))
+	})
+
+	It("deletes", func() {
+		err := ioutil.WriteFile(tmpDir+"/repo/foo", []byte("bar"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = repo.DeleteBlob(backend, "foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(tmpDir + "/repo/foo").ShouldNot(BeAnExistingFile())
+		err = repo.DeleteBlob(backend, "foo")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+	})
+
+	It("returns ErrNotFound for missing blobs", func() {
+		_, err := backend.ReadBlob("foo")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+	})
+
+	It("refuses unknown hosts", func() {
+		err := ioutil.WriteFile(filepath.Join(homeDir, ".ssh", "known_hosts"), nil, 0600)
+		Ω(err).ShouldNot(HaveOccurred())
+		u, err := url.Parse("sftp://git@" + listener.Addr().String() + tmpDir + "/repo")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = backends.NewBackend(u)
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,271 @@
+package webdav
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/lucas-clemente/git-cr/backends"
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+func init() {
+	backends.Register("webdav", newWebDAVBackendFromURL)
+	backends.Register("webdavs", newWebDAVBackendFromURL)
+}
+
+var (
+	// ErrPasswordInURL occurs if a webdav:// or webdavs:// URL contains a
+	// password, which would end up in the git config
+	ErrPasswordInURL = errors.New("webdav password must be set in GIT_CR_WEBDAV_PASSWORD, not in the URL")
+	// ErrInsecureAuth occurs if credentials would be sent over plain http
+	// without ?insecure=1
+	ErrInsecureAuth = errors.New("refusing to send webdav credentials over plain http, use webdavs:// or add ?insecure=1")
+)
+
+type webdavBackend struct {
+	base   *url.URL
+	user   *url.Userinfo
+	client *http.Client
+}
+
+// NewWebDAVBackend returns a backend that stores data in a WebDAV collection.
+// The collection is created if necessary. Credentials in the URL are used for
+// basic auth.
+func NewWebDAVBackend(collection *url.URL) (repo.Backend, error) {
+	base := *collection
+	base.User = nil
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	b := &webdavBackend{
+		base:   &base,
+		user:   collection.User,
+		client: &http.Client{},
+	}
+	if err := b.mkcolAll(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// newWebDAVBackendFromURL maps webdav:// URLs to http and webdavs:// URLs to
+// https. The password for the user in the URL is taken from
+// GIT_CR_WEBDAV_PASSWORD.
+func newWebDAVBackendFromURL(u *url.URL, options url.Values) (repo.Backend, error) {
+	collection := *u
+	if u.Scheme == "webdavs" {
+		collection.Scheme = "https"
+	} else {
+		collection.Scheme = "http"
+	}
+	collection.RawQuery = ""
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return nil, ErrPasswordInURL
+		}
+		if collection.Scheme == "http" && options.Get("insecure") != "1" {
+			return nil, ErrInsecureAuth
+		}
+		collection.User = url.UserPassword(u.User.Username(), os.Getenv("GIT_CR_WEBDAV_PASSWORD"))
+	}
+	return NewWebDAVBackend(&collection)
+}
+
+func (b *webdavBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	resp, err := b.do("GET", b.blobURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, repo.ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("webdav server returned %s while reading %s", resp.Status, name)
+	}
+	return resp.Body, nil
+}
+
+// WriteBlob uploads to a temporary file that is moved into place afterwards
+func (b *webdavBackend) WriteBlob(name string, r io.Reader) error {
+	return b.put(name, r, true)
+}
+
+// CreateBlob moves the temporary file without overwriting, which fails if the
+// blob already exists
+func (b *webdavBackend) CreateBlob(name string, r io.Reader) error {
+	return b.put(name, r, false)
+}
+
+// put streams the blob with chunked transfer encoding, since its size isn't
+// known in advance
+func (b *webdavBackend) put(name string, r io.Reader, overwrite bool) error {
+	tmpURL := b.blobURL("." + name + ".tmp" + randomSuffix())
+	// Hide the type of r, so its length is never taken from a buffer
+	resp, err := b.do("PUT", tmpURL, ioutil.NopCloser(r))
+	if err != nil {
+		// The temporary file might have been written partially
+		if resp, err := b.do("DELETE", tmpURL, nil); err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	resp.Body.Close()
+	if !isSuccess(resp.StatusCode) {
+		return fmt.Errorf("webdav server returned %s while writing %s", resp.Status, name)
+	}
+
+	req, err := b.newRequest("MOVE", tmpURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", b.blobURL(name))
+	if overwrite {
+		req.Header.Set("Overwrite", "T")
+	} else {
+		req.Header.Set("Overwrite", "F")
+	}
+	resp, err = b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if !overwrite && resp.StatusCode == http.StatusPreconditionFailed {
+		if resp, err := b.do("DELETE", tmpURL, nil); err == nil {
+			resp.Body.Close()
+		}
+		return repo.ErrExists
+	}
+	if !isSuccess(resp.StatusCode) {
+		return fmt.Errorf("webdav server returned %s while moving %s into place", resp.Status, name)
+	}
+	return nil
+}
+
+func (b *webdavBackend) DeleteBlob(name string) error {
+	resp, err := b.do("DELETE", b.blobURL(name), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return repo.ErrNotFound
+	}
+	if !isSuccess(resp.StatusCode) {
+		return fmt.Errorf("webdav server returned %s while deleting %s", resp.Status, name)
+	}
+	return nil
+}
+
+func randomSuffix() string {
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(suffix[:])
+}
+
+func isSuccess(status int) bool {
+	return status == http.StatusOK || status == http.StatusCreated || status == http.StatusNoContent
+}
+
+func (b *webdavBackend) blobURL(name string) string {
+	u := *b.base
+	u.Path += name
+	return u.String()
+}
+
+// mkcolAll creates the collection and its missing parents, like os.MkdirAll.
+// Servers like Nextcloud refuse MKCOL for the ancestors of a user's files, so
+// it walks up from the collection to the first existing one and only creates
+// the collections below it.
+func (b *webdavBackend) mkcolAll() error {
+	missing := []string{}
+	for p := b.base.Path; p != "/"; p = parentPath(p) {
+		exists, err := b.exists(p)
+		if err != nil {
+			return err
+		}
+		if exists {
+			break
+		}
+		missing = append(missing, p)
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		u := *b.base
+		u.Path = missing[i]
+		resp, err := b.do("MKCOL", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		// 405 is returned if another client created the collection meanwhile
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("webdav server returned %s while creating %s", resp.Status, u.Path)
+		}
+	}
+	return nil
+}
+
+// exists checks whether a collection exists using PROPFIND
+func (b *webdavBackend) exists(p string) (bool, error) {
+	u := *b.base
+	u.Path = p
+	req, err := b.newRequest("PROPFIND", u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Depth", "0")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusMultiStatus:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("webdav server returned %s while checking %s", resp.Status, p)
+}
+
+// parentPath returns the parent of a collection path ending in a slash
+func parentPath(p string) string {
+	parent := path.Dir(strings.TrimSuffix(p, "/"))
+	if parent == "/" {
+		return parent
+	}
+	return parent + "/"
+}
+
+func (b *webdavBackend) do(method, u string, body io.Reader) (*http.Response, error) {
+	req, err := b.newRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	return b.client.Do(req)
+}
+
+func (b *webdavBackend) newRequest(method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if b.user != nil {
+		password, _ := b.user.Password()
+		req.SetBasicAuth(b.user.Username(), password)
+	}
+	return req, nil
+}
@@ -0,0 +1,178 @@
+package webdav_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/lucas-clemente/git-cr/backends"
+	webdavbackend "github.com/lucas-clemente/git-cr/backends/webdav"
+	"github.com/lucas-clemente/git-cr/git/repo"
+	"golang.org/x/net/webdav"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestWebDAV(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "WebDAV Backend Suite")
+}
+
+var _ = Describe("WebDAV Backend", func() {
+	var (
+		server  *httptest.Server
+		backend repo.Backend
+		mkcols  []string
+		puts    [][]string
+	)
+
+	collectionURL := func(path string) *url.URL {
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		u.Scheme = "webdav"
+		u.User = url.User("user")
+		u.Path = path
+		u.RawQuery = "insecure=1"
+		return u
+	}
+
+	BeforeEach(func() {
+		fs := webdav.NewMemFS()
+		Ω(fs.Mkdir(context.Background(), "/remote.php", 0755)).Should(Succeed())
+		Ω(fs.Mkdir(context.Background(), "/remote.php/webdav", 0755)).Should(Succeed())
+		dav := &webdav.Handler{
+			FileSystem: fs,
+			LockSystem: webdav.NewMemLS(),
+		}
+		mkcols = nil
+		puts = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, password, ok := r.BasicAuth()
+			if !ok || user != "user" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			// Like Nextcloud, only the user's files can be changed
+			if r.Method == "MKCOL" {
+				if !strings.HasPrefix(r.URL.Path, "/remote.php/webdav/") {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				mkcols = append(mkcols, r.URL.Path)
+			}
+			if r.Method == "PUT" {
+				puts = append(puts, r.TransferEncoding)
+			}
+			dav.ServeHTTP(w, r)
+		}))
+
+		os.Setenv("GIT_CR_WEBDAV_PASSWORD", "secret")
+		var err error
+		backend, err = backends.NewBackend(collectionURL("/remote.php/webdav/repo"))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.Unsetenv("GIT_CR_WEBDAV_PASSWORD")
+	})
+
+	It("writes and reads", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		r, err := backend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		data, err := ioutil.ReadAll(r)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("bar")))
+	})
+
+	It("streams blobs", func() {
+		data := bytes.Repeat([]byte("foobar"), 100000)
+		err := backend.WriteBlob("foo", bytes.NewBuffer(data))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(puts).Should(Equal([][]string{{"chunked"}}))
+		r, err := backend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadAll(r)).Should(Equal(data))
+	})
+
+	It("overwrites", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.WriteBlob("foo", bytes.NewBufferString("baz"))
+		Ω(err).ShouldNot(HaveOccurred())
+		r, err := backend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		data, err := ioutil.ReadAll(r)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("baz")))
+	})
+
+	It("creates blobs only once", func() {
+		err := backend.CreateBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = backend.CreateBlob("foo", bytes.NewBufferString("baz"))
+		Ω(err).Should(Equal(repo.ErrExists))
+		r, err := backend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		data, err := ioutil.ReadAll(r)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(Equal([]byte("bar")))
+	})
+
+	It("deletes", func() {
+		err := backend.WriteBlob("foo", bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = repo.DeleteBlob(backend, "foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = backend.ReadBlob("foo")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+		err = repo.DeleteBlob(backend, "foo")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+	})
+
+	It("returns ErrNotFound for missing blobs", func() {
+		_, err := backend.ReadBlob("foo")
+		Ω(err).Should(Equal(repo.ErrNotFound))
+	})
+
+	It("opens existing collections", func() {
+		Ω(mkcols).Should(Equal([]string{"/remote.php/webdav/repo/"}))
+		_, err := backends.NewBackend(collectionURL("/remote.php/webdav/repo"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(mkcols).Should(HaveLen(1))
+	})
+
+	It("only creates the missing collections", func() {
+		mkcols = nil
+		puts = nil
+		b, err := backends.NewBackend(collectionURL("/remote.php/webdav/repo/a/b"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(mkcols).Should(Equal([]string{"/remote.php/webdav/repo/a/", "/remote.php/webdav/repo/a/b/"}))
+		Ω(b.WriteBlob("foo", bytes.NewBufferString("bar"))).Should(Succeed())
+	})
+
+	It("rejects passwords in the URL", func() {
+		u := collectionURL("/remote.php/webdav/repo")
+		u.User = url.UserPassword("user", "secret")
+		_, err := backends.NewBackend(u)
+		Ω(err).Should(Equal(webdavbackend.ErrPasswordInURL))
+	})
+
+	It("refuses to send credentials over plain http by default", func() {
+		mkcols = nil
+		u := collectionURL("/remote.php/webdav/repo")
+		u.RawQuery = ""
+		_, err := backends.NewBackend(u)
+		Ω(err).Should(Equal(webdavbackend.ErrInsecureAuth))
+		Ω(mkcols).Should(BeEmpty())
+	})
+})
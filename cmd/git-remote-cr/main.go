@@ -0,0 +1,50 @@
+// git-remote-cr is started by git for remotes like cr::s3://bucket/repo. The
+// encryption settings are taken from the remote's crEncryption config key, the
+// padding scheme from crPadding. The newest revision seen is remembered in the
+// git dir, so that rollbacks of the remote are detected.
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/lucas-clemente/git-cr/remote"
+)
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: git-remote-cr <remote> <url> (should only be called by git)")
+		os.Exit(1)
+	}
+	remoteName := os.Args[1]
+	repoURL := os.Args[2]
+
+	encryptionSettings, err := exec.Command("git", "config", "--get", "remote."+remoteName+".crEncryption").Output()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "no encryption settings found, set them using\n  git config remote.%s.crEncryption <encryption settings>\n", remoteName)
+		os.Exit(1)
+	}
+
+	// Padding is optional
+	paddingScheme, _ := exec.Command("git", "config", "--get", "remote."+remoteName+".crPadding").Output()
+
+	options := remote.Options{Padding: strings.TrimSpace(string(paddingScheme))}
+	// git sets GIT_DIR for remote helpers
+	if gitDir := os.Getenv("GIT_DIR"); gitDir != "" {
+		options.Heads = remote.NewFileHeadStore(remote.HeadStorePath(gitDir, repoURL))
+	}
+
+	repo, err := remote.OpenWithOptions(repoURL, strings.TrimSpace(string(encryptionSettings)), options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "an error occured while initing the repo:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	helper := remote.NewHelper(os.Stdin, os.Stdout, repo)
+	if err := helper.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "an error occured while serving git:\n%v\n", err)
+		os.Exit(1)
+	}
+}
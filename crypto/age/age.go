@@ -0,0 +1,175 @@
+// Package age encrypts blobs as standard age files (https://age-encryption.org),
+// so they can be decrypted with the age command line tool if needed.
+package age
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+
+	libage "filippo.io/age"
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+// ErrInvalidSettings occurs if the age settings can't be parsed
+var ErrInvalidSettings = errors.New("invalid age settings, expected an age identity optionally followed by recipients")
+
+// ErrWrongName occurs if a blob was encrypted under another name
+var ErrWrongName = repo.NewAuthError("blob was encrypted under another name")
+
+// ErrNoIdentityMatch occurs if a blob was encrypted for none of the identities
+var ErrNoIdentityMatch = repo.NewAuthError("blob was encrypted for none of the identities")
+
+// The plain text of each blob starts with a header binding it to its name,
+// since age has no associated data:
+//
+//	"git-cr\x00" | version | SHA-256 of the name
+//
+// The header has a fixed size, so that it is easy to strip after decrypting
+// a blob with the age command line tool.
+const (
+	nameMagic   = "git-cr\x00"
+	nameVersion = 1
+	nameSize    = len(nameMagic) + 1 + sha256.Size
+)
+
+// scryptWorkFactor is lower than age's default, since every blob needs its
+// own key derivation
+const scryptWorkFactor = 15
+
+type ageBackend struct {
+	backend    repo.Backend
+	identities []libage.Identity
+	recipients []libage.Recipient
+}
+
+// NewAgeBackend returns a repo.Backend implementation that encrypts data to
+// the recipients and decrypts it with the identities. age doesn't authenticate
+// senders, so with public key recipients, anybody who knows them can write
+// blobs that are accepted.
+func NewAgeBackend(backend repo.Backend, identities []libage.Identity, recipients []libage.Recipient) repo.Backend {
+	return &ageBackend{
+		backend:    backend,
+		identities: identities,
+		recipients: recipients,
+	}
+}
+
+// NewX25519Backend parses a comma separated list of an X25519 identity
+// (AGE-SECRET-KEY-1...) and additional recipients (age1...). Blobs are
+// encrypted to the identity and all additional recipients.
+func NewX25519Backend(backend repo.Backend, settings string) (repo.Backend, error) {
+	parts := strings.Split(settings, ",")
+	identity, err := libage.ParseX25519Identity(parts[0])
+	if err != nil {
+		return nil, ErrInvalidSettings
+	}
+	recipients := []libage.Recipient{identity.Recipient()}
+	for _, r := range parts[1:] {
+		recipient, err := libage.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, ErrInvalidSettings
+		}
+		recipients = append(recipients, recipient)
+	}
+	return NewAgeBackend(backend, []libage.Identity{identity}, recipients), nil
+}
+
+// NewPassphraseBackend encrypts data with an age scrypt recipient
+func NewPassphraseBackend(backend repo.Backend, passphrase string) (repo.Backend, error) {
+	recipient, err := libage.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	recipient.SetWorkFactor(scryptWorkFactor)
+	identity, err := libage.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return NewAgeBackend(backend, []libage.Identity{identity}, []libage.Recipient{recipient}), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (b *ageBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	encryptedRdr, err := b.backend.ReadBlob(name + ".age")
+	if err != nil {
+		return nil, err
+	}
+
+	rdr, err := libage.Decrypt(encryptedRdr, b.identities...)
+	if _, ok := err.(*libage.NoIdentityMatchError); ok {
+		err = ErrNoIdentityMatch
+	}
+	if err == nil {
+		err = checkName(rdr, name)
+	}
+	if err != nil {
+		encryptedRdr.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: rdr, Closer: encryptedRdr}, nil
+}
+
+// checkName consumes the header of a decrypted blob and makes sure it was
+// written under name
+func checkName(rdr io.Reader, name string) error {
+	header := make([]byte, nameSize)
+	if _, err := io.ReadFull(rdr, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrWrongName
+	} else if err != nil {
+		return err
+	}
+	if !bytes.Equal(header, nameHeader(name)) {
+		return ErrWrongName
+	}
+	return nil
+}
+
+func nameHeader(name string) []byte {
+	hash := sha256.Sum256([]byte(name))
+	header := make([]byte, 0, nameSize)
+	header = append(header, nameMagic...)
+	header = append(header, nameVersion)
+	return append(header, hash[:]...)
+}
+
+func (b *ageBackend) WriteBlob(name string, rdr io.Reader) error {
+	out := b.seal(name, rdr)
+	defer out.Close()
+	return b.backend.WriteBlob(name+".age", out)
+}
+
+func (b *ageBackend) CreateBlob(name string, rdr io.Reader) error {
+	out := b.seal(name, rdr)
+	defer out.Close()
+	return b.backend.CreateBlob(name+".age", out)
+}
+
+func (b *ageBackend) DeleteBlob(name string) error {
+	return repo.DeleteBlob(b.backend, name+".age")
+}
+
+// seal encrypts while the backend reads, so that blobs are never kept in
+// memory completely. Closing the returned reader stops the encryption.
+func (b *ageBackend) seal(name string, rdr io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := libage.Encrypt(pw, b.recipients...)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(w, io.MultiReader(bytes.NewReader(nameHeader(name)), rdr)); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	return pr
+}
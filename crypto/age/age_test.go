@@ -0,0 +1,202 @@
+package age_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	libage "filippo.io/age"
+	"github.com/lucas-clemente/git-cr/crypto/age"
+	"github.com/lucas-clemente/git-cr/git/repo"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestAge(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Age Suite")
+}
+
+type fixtureBackend map[string][]byte
+
+func (f fixtureBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	data, ok := f[name]
+	if !ok {
+		return nil, repo.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
+}
+
+func (f fixtureBackend) WriteBlob(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f[name] = data
+	return nil
+}
+
+func (f fixtureBackend) CreateBlob(name string, r io.Reader) error {
+	if _, ok := f[name]; ok {
+		return repo.ErrExists
+	}
+	return f.WriteBlob(name, r)
+}
+
+func readBlob(b repo.Backend, name string) ([]byte, error) {
+	rdr, err := b.ReadBlob(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	return ioutil.ReadAll(rdr)
+}
+
+var _ = Describe("Age", func() {
+	var (
+		backend  fixtureBackend
+		identity *libage.X25519Identity
+	)
+
+	BeforeEach(func() {
+		var err error
+		backend = fixtureBackend{}
+		identity, err = libage.GenerateX25519Identity()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	Context("with X25519 keys", func() {
+		It("reads and writes data", func() {
+			b, err := age.NewX25519Backend(backend, identity.String())
+			Ω(err).ShouldNot(HaveOccurred())
+			err = b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(backend).Should(HaveKey("foo.age"))
+			Ω(readBlob(b, "foo")).Should(Equal([]byte("foobar")))
+		})
+
+		It("writes standard age files", func() {
+			b, err := age.NewX25519Backend(backend, identity.String())
+			Ω(err).ShouldNot(HaveOccurred())
+			err = b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(backend["foo.age"]).Should(HavePrefix("age-encryption.org/v1\n"))
+
+			rdr, err := libage.Decrypt(bytes.NewReader(backend["foo.age"]), identity)
+			Ω(err).ShouldNot(HaveOccurred())
+			data, err := ioutil.ReadAll(rdr)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(data).Should(HaveLen(40 + 6))
+			Ω(data).Should(HavePrefix("git-cr\x00\x01"))
+			Ω(data).Should(HaveSuffix("foobar"))
+		})
+
+		It("binds blobs to their names", func() {
+			b, err := age.NewX25519Backend(backend, identity.String())
+			Ω(err).ShouldNot(HaveOccurred())
+			err = b.WriteBlob("3.pack", bytes.NewBufferString("foobar"))
+			Ω(err).ShouldNot(HaveOccurred())
+			backend["4.pack.age"] = backend["3.pack.age"]
+			_, err = readBlob(b, "4.pack")
+			Ω(err).Should(Equal(age.ErrWrongName))
+		})
+
+		It("rejects blobs without name", func() {
+			b, err := age.NewX25519Backend(backend, identity.String())
+			Ω(err).ShouldNot(HaveOccurred())
+			var buf bytes.Buffer
+			w, err := libage.Encrypt(&buf, identity.Recipient())
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = w.Write([]byte("foobar"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(w.Close()).Should(Succeed())
+			backend["foo.age"] = buf.Bytes()
+			_, err = readBlob(b, "foo")
+			Ω(err).Should(Equal(age.ErrWrongName))
+		})
+
+		It("creates data only once", func() {
+			b, err := age.NewX25519Backend(backend, identity.String())
+			Ω(err).ShouldNot(HaveOccurred())
+			err = b.CreateBlob("foo", bytes.NewBufferString("foobar"))
+			Ω(err).ShouldNot(HaveOccurred())
+			err = b.CreateBlob("foo", bytes.NewBufferString("foobaz"))
+			Ω(err).Should(Equal(repo.ErrExists))
+			Ω(readBlob(b, "foo")).Should(Equal([]byte("foobar")))
+		})
+
+		It("encrypts to additional recipients", func() {
+			other, err := libage.GenerateX25519Identity()
+			Ω(err).ShouldNot(HaveOccurred())
+			b, err := age.NewX25519Backend(backend, identity.String()+","+other.Recipient().String())
+			Ω(err).ShouldNot(HaveOccurred())
+			err = b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			b, err = age.NewX25519Backend(backend, other.String())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(readBlob(b, "foo")).Should(Equal([]byte("foobar")))
+		})
+
+		It("fails with other identities", func() {
+			b, err := age.NewX25519Backend(backend, identity.String())
+			Ω(err).ShouldNot(HaveOccurred())
+			err = b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			other, err := libage.GenerateX25519Identity()
+			Ω(err).ShouldNot(HaveOccurred())
+			b, err = age.NewX25519Backend(backend, other.String())
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = readBlob(b, "foo")
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("detects truncated blobs", func() {
+			b, err := age.NewX25519Backend(backend, identity.String())
+			Ω(err).ShouldNot(HaveOccurred())
+			err = b.WriteBlob("foo", bytes.NewReader(make([]byte, 200000)))
+			Ω(err).ShouldNot(HaveOccurred())
+			backend["foo.age"] = backend["foo.age"][:len(backend["foo.age"])-100000]
+			_, err = readBlob(b, "foo")
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("rejects invalid settings", func() {
+			_, err := age.NewX25519Backend(backend, "foo")
+			Ω(err).Should(Equal(age.ErrInvalidSettings))
+			_, err = age.NewX25519Backend(backend, identity.String()+",foo")
+			Ω(err).Should(Equal(age.ErrInvalidSettings))
+		})
+	})
+
+	Context("with a passphrase", func() {
+		It("reads and writes data", func() {
+			b, err := age.NewPassphraseBackend(backend, "correct horse battery staple")
+			Ω(err).ShouldNot(HaveOccurred())
+			err = b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(readBlob(b, "foo")).Should(Equal([]byte("foobar")))
+
+			identity, err := libage.NewScryptIdentity("correct horse battery staple")
+			Ω(err).ShouldNot(HaveOccurred())
+			rdr, err := libage.Decrypt(bytes.NewReader(backend["foo.age"]), identity)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(rdr)).Should(HaveSuffix("foobar"))
+		})
+
+		It("fails with other passphrases", func() {
+			b, err := age.NewPassphraseBackend(backend, "correct horse battery staple")
+			Ω(err).ShouldNot(HaveOccurred())
+			err = b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			b, err = age.NewPassphraseBackend(backend, "wrong")
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = readBlob(b, "foo")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,559 @@
+// Package box encrypts repos for multiple recipients.
+//
+// Blobs are encrypted with a random data key using NaCl's secretbox. The data
+// key is wrapped for each recipient and stored in an unencrypted key manifest,
+// so recipients can be added and removed by rewriting the manifest instead of
+// every blob. Removing a recipient starts a new generation of data keys that is
+// used for all blobs written afterwards.
+//
+// Whoever changes the manifest wraps the data keys using their own identity as
+// the sender of an authenticated NaCl box. Recipients only accept data keys
+// wrapped by a recipient of the previous generation, so removed recipients
+// can't add generations of their own.
+//
+// Recipients are either NaCl box (X25519) public keys in base64 or age X25519
+// recipients (age1...), identities are the matching private keys.
+package box
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/lucas-clemente/git-cr/crypto/nacl"
+	"github.com/lucas-clemente/git-cr/git/repo"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// ManifestName is the name of the unencrypted blob holding the wrapped data keys
+const ManifestName = "keys.json"
+
+var (
+	// ErrInvalidIdentity occurs if an identity can't be parsed
+	ErrInvalidIdentity = errors.New("invalid identity, expected a base64 X25519 private key or an age identity")
+	// ErrInvalidRecipient occurs if a recipient can't be parsed
+	ErrInvalidRecipient = errors.New("invalid recipient, expected a base64 X25519 public key or an age recipient")
+	// ErrInvalidManifest occurs if the key manifest is malformed or was tampered with
+	ErrInvalidManifest = errors.New("invalid key manifest")
+	// ErrNotRecipient occurs if the identity is not a recipient of the repo
+	ErrNotRecipient = repo.NewAuthError("the identity is not a recipient of this repo")
+	// ErrUnknownGeneration occurs if a blob was encrypted with an unknown data key
+	ErrUnknownGeneration = repo.NewAuthError("blob was encrypted with an unknown key generation")
+	// ErrLastRecipient occurs when trying to remove the last recipient
+	ErrLastRecipient = errors.New("can't remove the last recipient")
+	// ErrManifestChanged occurs if the key manifest was changed concurrently
+	ErrManifestChanged = errors.New("the key manifest was changed concurrently, please try again")
+)
+
+// A generation of the data key
+type generation struct {
+	// Recipients maps recipients to the data key wrapped for them, followed by
+	// the generation's digest
+	Recipients map[string][]byte `json:"recipients"`
+	// Author is the recipient who wrapped the data keys
+	Author string `json:"author"`
+}
+
+type manifest struct {
+	// Revision counts the changes to the manifest, see writeManifest
+	Revision    int           `json:"revision,omitempty"`
+	Generations []*generation `json:"generations"`
+}
+
+type boxBackend struct {
+	backend repo.Backend
+	// keys are the data keys of all generations
+	keys [][32]byte
+}
+
+// NewBoxBackend returns a repo.Backend implementation that encrypts data for
+// the recipients in the key manifest. If the repo doesn't have a manifest yet,
+// one is created with the identity as the only recipient.
+func NewBoxBackend(backend repo.Backend, identity string) (repo.Backend, error) {
+	id, err := parseIdentity(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := readManifest(backend)
+	if err == repo.ErrNotFound {
+		m, err = createManifest(backend, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := m.unwrapKeys(id)
+	if err != nil {
+		return nil, err
+	}
+	return &boxBackend{backend: backend, keys: keys}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (b *boxBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	encryptedRdr, err := b.backend.ReadBlob(name + ".box")
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(encryptedRdr, header); err != nil {
+		encryptedRdr.Close()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nacl.ErrTooShort
+		}
+		return nil, err
+	}
+	gen := binary.BigEndian.Uint32(header)
+	if gen >= uint32(len(b.keys)) {
+		encryptedRdr.Close()
+		return nil, ErrUnknownGeneration
+	}
+
+	return &readCloser{Reader: nacl.OpenBlob(encryptedRdr, &b.keys[gen], name), Closer: encryptedRdr}, nil
+}
+
+func (b *boxBackend) WriteBlob(name string, rdr io.Reader) error {
+	return b.backend.WriteBlob(name+".box", b.seal(name, rdr))
+}
+
+func (b *boxBackend) CreateBlob(name string, rdr io.Reader) error {
+	return b.backend.CreateBlob(name+".box", b.seal(name, rdr))
+}
+
+func (b *boxBackend) DeleteBlob(name string) error {
+	return repo.DeleteBlob(b.backend, name+".box")
+}
+
+// seal encrypts with the newest data key, prefixed by its generation
+func (b *boxBackend) seal(name string, rdr io.Reader) io.Reader {
+	gen := len(b.keys) - 1
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(gen))
+	return io.MultiReader(bytes.NewReader(header), nacl.SealBlob(rdr, &b.keys[gen], name))
+}
+
+// GenerateKey returns a new NaCl box identity and its recipient
+func GenerateKey() (identity, recipient string, err error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(private[:]), base64.StdEncoding.EncodeToString(public[:]), nil
+}
+
+// Recipients returns the recipients of the current generation
+func Recipients(backend repo.Backend) ([]string, error) {
+	m, err := readManifest(backend)
+	if err != nil {
+		return nil, err
+	}
+	return m.current().recipients(), nil
+}
+
+// AddRecipient gives a recipient access to all generations of data keys.
+// The identity has to be a recipient already.
+func AddRecipient(backend repo.Backend, identity, recipient string) error {
+	id, err := parseIdentity(identity)
+	if err != nil {
+		return err
+	}
+	m, err := readManifest(backend)
+	if err != nil {
+		return err
+	}
+	keys, err := m.unwrapKeys(id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := recipientKey(recipient); err != nil {
+		return err
+	}
+	for _, g := range m.Generations {
+		g.Recipients[recipient] = nil
+	}
+	return writeManifest(backend, m, id, keys)
+}
+
+// RemoveRecipient removes a recipient from the manifest and starts a new
+// generation of data keys for the remaining recipients. Blobs written before
+// stay readable for anyone who kept a copy of the old data keys.
+func RemoveRecipient(backend repo.Backend, identity, recipient string) error {
+	id, err := parseIdentity(identity)
+	if err != nil {
+		return err
+	}
+	m, err := readManifest(backend)
+	if err != nil {
+		return err
+	}
+	keys, err := m.unwrapKeys(id)
+	if err != nil {
+		return err
+	}
+
+	current := m.current()
+	if _, ok := current.Recipients[recipient]; !ok {
+		return ErrInvalidRecipient
+	}
+	if len(current.Recipients) == 1 {
+		return ErrLastRecipient
+	}
+	for _, g := range m.Generations {
+		delete(g.Recipients, recipient)
+	}
+
+	next, key, err := newGeneration(current.recipients())
+	if err != nil {
+		return err
+	}
+	m.Generations = append(m.Generations, next)
+	return writeManifest(backend, m, id, append(keys, *key))
+}
+
+func (g *generation) recipients() []string {
+	recipients := make([]string, 0, len(g.Recipients))
+	for r := range g.Recipients {
+		recipients = append(recipients, r)
+	}
+	sort.Strings(recipients)
+	return recipients
+}
+
+func (m *manifest) current() *generation {
+	return m.Generations[len(m.Generations)-1]
+}
+
+// unwrapKeys returns the data keys of all generations, verifying that each
+// was wrapped by a recipient of the previous generation
+func (m *manifest) unwrapKeys(id identity) ([][32]byte, error) {
+	keys := make([][32]byte, len(m.Generations))
+	var digest []byte
+	for i, g := range m.Generations {
+		wrapped, ok := g.Recipients[id.recipient()]
+		if !ok {
+			return nil, ErrNotRecipient
+		}
+		if _, ok := m.Generations[previous(i)].Recipients[g.Author]; !ok {
+			return nil, ErrInvalidManifest
+		}
+		digest = g.digest(i, digest)
+		key, err := unwrap(id, g.Author, wrapped, digest)
+		if err != nil {
+			return nil, err
+		}
+		copy(keys[i][:], key)
+	}
+	return keys, nil
+}
+
+// sign wraps the data keys of all generations for their recipients, with id
+// as the author
+func (m *manifest) sign(id identity, keys [][32]byte) error {
+	var digest []byte
+	for i, g := range m.Generations {
+		g.Author = id.recipient()
+		digest = g.digest(i, digest)
+		for _, r := range g.recipients() {
+			wrapped, err := wrap(id, r, keys[i][:], digest)
+			if err != nil {
+				return err
+			}
+			g.Recipients[r] = wrapped
+		}
+	}
+	return nil
+}
+
+// digest commits to the generation's author and recipients, and to the
+// previous generations
+func (g *generation) digest(index int, previous []byte) []byte {
+	h := sha256.New()
+	h.Write(previous)
+	binary.Write(h, binary.BigEndian, uint32(index))
+	io.WriteString(h, g.Author+"\x00")
+	for _, r := range g.recipients() {
+		io.WriteString(h, r+"\x00")
+	}
+	return h.Sum(nil)
+}
+
+// previous returns the index of the generation whose recipients may author
+// generation i. The first generation is authored by one of its recipients.
+func previous(i int) int {
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+// newGeneration creates a random data key for the recipients, it still has
+// to be wrapped using sign
+func newGeneration(recipients []string) (*generation, *[32]byte, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, nil, err
+	}
+	g := &generation{Recipients: map[string][]byte{}}
+	for _, r := range recipients {
+		g.Recipients[r] = nil
+	}
+	return g, &key, nil
+}
+
+// readManifest reads the newest revision of the manifest. A revision that was
+// created, but not yet copied to ManifestName, is used as well.
+func readManifest(backend repo.Backend) (*manifest, error) {
+	m, err := readManifestBlob(backend, ManifestName)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		next, err := readManifestBlob(backend, revisionName(m.Revision+1))
+		if err == repo.ErrNotFound {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if next.Revision != m.Revision+1 {
+			return nil, ErrInvalidManifest
+		}
+		m = next
+	}
+}
+
+func readManifestBlob(backend repo.Backend, name string) (*manifest, error) {
+	rdr, err := backend.ReadBlob(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil || len(m.Generations) == 0 {
+		return nil, ErrInvalidManifest
+	}
+	for _, g := range m.Generations {
+		if g == nil || len(g.Recipients) == 0 {
+			return nil, ErrInvalidManifest
+		}
+	}
+	return m, nil
+}
+
+func createManifest(backend repo.Backend, id identity) (*manifest, error) {
+	g, key, err := newGeneration([]string{id.recipient()})
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{Generations: []*generation{g}}
+	if err := m.sign(id, [][32]byte{*key}); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	err = backend.CreateBlob(ManifestName, bytes.NewBuffer(data))
+	if err == repo.ErrExists {
+		// Another client was faster, use its manifest
+		return readManifest(backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeManifest signs and stores the next revision of the manifest. The
+// revision is claimed by creating a blob named after it, so that concurrent
+// changes can't overwrite each other. It is then copied to ManifestName, where
+// clients look first.
+func writeManifest(backend repo.Backend, m *manifest, id identity, keys [][32]byte) error {
+	m.Revision++
+	if err := m.sign(id, keys); err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	err = backend.CreateBlob(revisionName(m.Revision), bytes.NewBuffer(data))
+	if err == repo.ErrExists {
+		return ErrManifestChanged
+	}
+	if err != nil {
+		return err
+	}
+	return backend.WriteBlob(ManifestName, bytes.NewBuffer(data))
+}
+
+func revisionName(revision int) string {
+	return "keys." + strconv.Itoa(revision) + ".json"
+}
+
+// wrap seals a data key and the digest of its generation for a recipient,
+// authenticated by the author
+func wrap(author identity, recipient string, key, digest []byte) ([]byte, error) {
+	public, err := recipientKey(recipient)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	payload := append(append([]byte{}, key...), digest...)
+	return box.Seal(nonce[:], payload, &nonce, public, author.privateKey()), nil
+}
+
+// unwrap opens a data key wrapped by author and checks its digest
+func unwrap(id identity, author string, wrapped, digest []byte) ([]byte, error) {
+	public, err := recipientKey(author)
+	if err != nil || len(wrapped) < 24 {
+		return nil, ErrInvalidManifest
+	}
+	var nonce [24]byte
+	copy(nonce[:], wrapped)
+	payload, ok := box.Open(nil, wrapped[24:], &nonce, public, id.privateKey())
+	if !ok || len(payload) != 32+len(digest) || !bytes.Equal(payload[32:], digest) {
+		return nil, ErrInvalidManifest
+	}
+	return payload[:32], nil
+}
+
+// recipientKey returns the X25519 public key of a recipient
+func recipientKey(recipient string) (*[32]byte, error) {
+	if strings.HasPrefix(recipient, "age1") {
+		if _, err := age.ParseX25519Recipient(recipient); err != nil {
+			return nil, ErrInvalidRecipient
+		}
+		key, ok := bech32Key(recipient)
+		if !ok {
+			return nil, ErrInvalidRecipient
+		}
+		return key, nil
+	}
+
+	public, err := base64.StdEncoding.DecodeString(recipient)
+	if err != nil || len(public) != 32 {
+		return nil, ErrInvalidRecipient
+	}
+	var publicArray [32]byte
+	copy(publicArray[:], public)
+	return &publicArray, nil
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32Key decodes the key of an age recipient or identity. Their checksums
+// were verified by age already.
+func bech32Key(s string) (*[32]byte, bool) {
+	s = strings.ToLower(s)
+	data := s[strings.LastIndexByte(s, '1')+1:]
+	if len(data) < 6 {
+		return nil, false
+	}
+	var out []byte
+	acc, bits := 0, 0
+	for _, c := range data[:len(data)-6] {
+		v := strings.IndexRune(bech32Charset, c)
+		if v < 0 {
+			return nil, false
+		}
+		acc = acc<<5 | v
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			out = append(out, byte(acc>>uint(bits)))
+			acc &= 1<<uint(bits) - 1
+		}
+	}
+	if len(out) != 32 {
+		return nil, false
+	}
+	var key [32]byte
+	copy(key[:], out)
+	return &key, true
+}
+
+type identity interface {
+	recipient() string
+	privateKey() *[32]byte
+}
+
+func parseIdentity(s string) (identity, error) {
+	if strings.HasPrefix(s, "AGE-SECRET-KEY-") {
+		id, err := age.ParseX25519Identity(s)
+		if err != nil {
+			return nil, ErrInvalidIdentity
+		}
+		private, ok := bech32Key(s)
+		if !ok {
+			return nil, ErrInvalidIdentity
+		}
+		return &ageIdentity{X25519Identity: id, private: *private}, nil
+	}
+
+	private, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(private) != 32 {
+		return nil, ErrInvalidIdentity
+	}
+	id := &boxIdentity{}
+	copy(id.private[:], private)
+	public, err := curve25519.X25519(id.private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, ErrInvalidIdentity
+	}
+	copy(id.public[:], public)
+	return id, nil
+}
+
+type boxIdentity struct {
+	public, private [32]byte
+}
+
+func (id *boxIdentity) recipient() string {
+	return base64.StdEncoding.EncodeToString(id.public[:])
+}
+
+func (id *boxIdentity) privateKey() *[32]byte {
+	return &id.private
+}
+
+type ageIdentity struct {
+	*age.X25519Identity
+	private [32]byte
+}
+
+func (id *ageIdentity) recipient() string {
+	return id.Recipient().String()
+}
+
+func (id *ageIdentity) privateKey() *[32]byte {
+	return &id.private
+}
@@ -0,0 +1,368 @@
+package box_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/lucas-clemente/git-cr/crypto/box"
+	"github.com/lucas-clemente/git-cr/crypto/nacl"
+	"github.com/lucas-clemente/git-cr/git/repo"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	naclbox "golang.org/x/crypto/nacl/box"
+)
+
+func TestBox(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Box Suite")
+}
+
+type fixtureBackend map[string][]byte
+
+func (f fixtureBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	data, ok := f[name]
+	if !ok {
+		return nil, repo.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
+}
+
+func (f fixtureBackend) WriteBlob(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f[name] = data
+	return nil
+}
+
+func (f fixtureBackend) CreateBlob(name string, r io.Reader) error {
+	if _, ok := f[name]; ok {
+		return repo.ErrExists
+	}
+	return f.WriteBlob(name, r)
+}
+
+// racingBackend runs race before creating the first blob, like a concurrent
+// client would
+type racingBackend struct {
+	fixtureBackend
+	race func()
+}
+
+func (r *racingBackend) CreateBlob(name string, rdr io.Reader) error {
+	if race := r.race; race != nil {
+		r.race = nil
+		race()
+	}
+	return r.fixtureBackend.CreateBlob(name, rdr)
+}
+
+type manifest struct {
+	Revision    int               `json:"revision"`
+	Generations []json.RawMessage `json:"generations"`
+}
+
+// appendGeneration appends the first generation of the manifest in from to
+// the one in to
+func appendGeneration(from, to fixtureBackend) {
+	var m, forged manifest
+	Ω(json.Unmarshal(to[box.ManifestName], &m)).Should(Succeed())
+	Ω(json.Unmarshal(from[box.ManifestName], &forged)).Should(Succeed())
+	m.Generations = append(m.Generations, forged.Generations[0])
+	data, err := json.Marshal(m)
+	Ω(err).ShouldNot(HaveOccurred())
+	to[box.ManifestName] = data
+}
+
+func readBlob(b repo.Backend, name string) []byte {
+	rdr, err := b.ReadBlob(name)
+	Ω(err).ShouldNot(HaveOccurred())
+	data, err := ioutil.ReadAll(rdr)
+	Ω(err).ShouldNot(HaveOccurred())
+	return data
+}
+
+var _ = Describe("Box", func() {
+	var (
+		backend               fixtureBackend
+		alice, aliceRecipient string
+		bob, bobRecipient     string
+	)
+
+	BeforeEach(func() {
+		var err error
+		backend = fixtureBackend{}
+		alice, aliceRecipient, err = box.GenerateKey()
+		Ω(err).ShouldNot(HaveOccurred())
+		bob, bobRecipient, err = box.GenerateKey()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("creates a manifest for the first recipient", func() {
+		_, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backend).Should(HaveKey(box.ManifestName))
+		Ω(box.Recipients(backend)).Should(Equal([]string{aliceRecipient}))
+	})
+
+	It("reads and writes data", func() {
+		b, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backend).Should(HaveKey("foo.box"))
+		Ω(backend["foo.box"]).ShouldNot(ContainSubstring("foobar"))
+
+		b, err = box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readBlob(b, "foo")).Should(Equal([]byte("foobar")))
+	})
+
+	It("binds blobs to their names", func() {
+		b, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.WriteBlob("3.pack", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		backend["4.pack.box"] = backend["3.pack.box"]
+		rdr, err := b.ReadBlob("4.pack")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = ioutil.ReadAll(rdr)
+		Ω(err).Should(Equal(nacl.ErrVerificationFailed))
+	})
+
+	It("creates data only once", func() {
+		b, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.CreateBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.CreateBlob("foo", bytes.NewBufferString("foobaz"))
+		Ω(err).Should(Equal(repo.ErrExists))
+	})
+
+	It("refuses identities that are not recipients", func() {
+		_, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = box.NewBoxBackend(backend, bob)
+		Ω(err).Should(Equal(box.ErrNotRecipient))
+	})
+
+	It("refuses invalid identities", func() {
+		_, err := box.NewBoxBackend(backend, "foo")
+		Ω(err).Should(Equal(box.ErrInvalidIdentity))
+	})
+
+	It("adds recipients", func() {
+		a, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = a.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = box.AddRecipient(backend, alice, bobRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(box.Recipients(backend)).Should(ConsistOf(aliceRecipient, bobRecipient))
+
+		b, err := box.NewBoxBackend(backend, bob)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readBlob(b, "foo")).Should(Equal([]byte("foobar")))
+	})
+
+	It("refuses invalid recipients", func() {
+		_, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.AddRecipient(backend, alice, "foo")
+		Ω(err).Should(Equal(box.ErrInvalidRecipient))
+	})
+
+	It("only lets recipients add recipients", func() {
+		_, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.AddRecipient(backend, bob, bobRecipient)
+		Ω(err).Should(Equal(box.ErrNotRecipient))
+	})
+
+	It("removes recipients and rotates the data key", func() {
+		a, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = a.WriteBlob("old", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.AddRecipient(backend, alice, bobRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = box.RemoveRecipient(backend, alice, bobRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(box.Recipients(backend)).Should(Equal([]string{aliceRecipient}))
+
+		_, err = box.NewBoxBackend(backend, bob)
+		Ω(err).Should(Equal(box.ErrNotRecipient))
+
+		a, err = box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = a.WriteBlob("new", bytes.NewBufferString("foobaz"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readBlob(a, "old")).Should(Equal([]byte("foobar")))
+		Ω(readBlob(a, "new")).Should(Equal([]byte("foobaz")))
+		Ω(backend["new.box"][:4]).Should(Equal([]byte{0, 0, 0, 1}))
+	})
+
+	It("doesn't remove the last recipient", func() {
+		_, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.RemoveRecipient(backend, alice, aliceRecipient)
+		Ω(err).Should(Equal(box.ErrLastRecipient))
+	})
+
+	It("detects forged generations", func() {
+		_, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.AddRecipient(backend, alice, bobRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// An attacker creates a manifest of their own and appends its generation
+		mallory := fixtureBackend{}
+		_, err = box.NewBoxBackend(mallory, bob)
+		Ω(err).ShouldNot(HaveOccurred())
+		appendGeneration(mallory, backend)
+
+		_, err = box.NewBoxBackend(backend, bob)
+		Ω(err).Should(Equal(box.ErrInvalidManifest))
+	})
+
+	It("keeps removed recipients from reading new blobs", func() {
+		_, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.AddRecipient(backend, alice, bobRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+		// Bob keeps the data keys he had access to
+		b, err := box.NewBoxBackend(backend, bob)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = box.RemoveRecipient(backend, alice, bobRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+		a, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = a.WriteBlob("new", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = b.ReadBlob("new")
+		Ω(err).Should(Equal(box.ErrUnknownGeneration))
+		_, err = box.NewBoxBackend(backend, bob)
+		Ω(err).Should(Equal(box.ErrNotRecipient))
+	})
+
+	It("doesn't let removed recipients add generations", func() {
+		_, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.AddRecipient(backend, alice, bobRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.RemoveRecipient(backend, alice, bobRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// Bob wraps a data key he knows for alice and appends it
+		mallory := fixtureBackend{}
+		_, err = box.NewBoxBackend(mallory, bob)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.AddRecipient(mallory, bob, aliceRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+		appendGeneration(mallory, backend)
+
+		_, err = box.NewBoxBackend(backend, alice)
+		Ω(err).Should(Equal(box.ErrInvalidManifest))
+	})
+
+	It("refuses concurrent changes", func() {
+		_, carolRecipient, err := box.GenerateKey()
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		racing := &racingBackend{fixtureBackend: backend, race: func() {
+			Ω(box.AddRecipient(backend, alice, carolRecipient)).Should(Succeed())
+		}}
+		err = box.AddRecipient(racing, alice, bobRecipient)
+		Ω(err).Should(Equal(box.ErrManifestChanged))
+		Ω(box.Recipients(backend)).Should(ConsistOf(aliceRecipient, carolRecipient))
+	})
+
+	It("finishes interrupted changes", func() {
+		_, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		old := backend[box.ManifestName]
+		err = box.AddRecipient(backend, alice, bobRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// The new revision was created, but not copied
+		backend[box.ManifestName] = old
+		_, err = box.NewBoxBackend(backend, bob)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("refuses manifests without authors", func() {
+		_, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.AddRecipient(backend, alice, bobRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.RemoveRecipient(backend, alice, bobRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// Bob seals a data key he knows for alice, chained to the first
+		// generation's key like manifests of an earlier format
+		var public, oldKey, key [32]byte
+		recipient, err := base64.StdEncoding.DecodeString(aliceRecipient)
+		Ω(err).ShouldNot(HaveOccurred())
+		copy(public[:], recipient)
+		copy(key[:], "The Answer to the Great Question")
+		wrappedOld, err := naclbox.SealAnonymous(nil, oldKey[:], &public, rand.Reader)
+		Ω(err).ShouldNot(HaveOccurred())
+		wrapped, err := naclbox.SealAnonymous(nil, key[:], &public, rand.Reader)
+		Ω(err).ShouldNot(HaveOccurred())
+		backend[box.ManifestName], err = json.Marshal(map[string]interface{}{
+			"revision": 10,
+			"generations": []interface{}{
+				map[string]interface{}{"recipients": map[string][]byte{aliceRecipient: wrappedOld}},
+				map[string]interface{}{"recipients": map[string][]byte{aliceRecipient: wrapped}, "link": nacl.Seal(key[:], &oldKey)},
+			},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = box.NewBoxBackend(backend, alice)
+		Ω(err).Should(Equal(box.ErrInvalidManifest))
+	})
+
+	It("refuses blobs with unknown generations", func() {
+		b, err := box.NewBoxBackend(backend, alice)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		backend["foo.box"][3] = 1
+		_, err = b.ReadBlob("foo")
+		Ω(err).Should(Equal(box.ErrUnknownGeneration))
+	})
+
+	Context("with age keys", func() {
+		It("supports age identities and recipients", func() {
+			id, err := age.GenerateX25519Identity()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			a, err := box.NewBoxBackend(backend, alice)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = a.WriteBlob("foo", bytes.NewBufferString("foobar"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = box.AddRecipient(backend, alice, id.Recipient().String())
+			Ω(err).ShouldNot(HaveOccurred())
+
+			b, err := box.NewBoxBackend(backend, id.String())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(readBlob(b, "foo")).Should(Equal([]byte("foobar")))
+		})
+	})
+})
@@ -0,0 +1,163 @@
+package nacl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+// Blobs start with a header that describes how they were encrypted:
+//
+//	"git-cr\x00" | version | algorithm | key ID (8 bytes)
+//
+// The stream after the header is sealed with a key derived from the key, the
+// header and the blob's name, so a blob can't be read under another name or
+// with a modified header. The key ID tells which of several keys a blob was
+// written with. Blobs written before headers were introduced are sealed by
+// Seal and read by trying all keys. They aren't bound to their names, so they
+// are only read until a repo is in strict mode.
+const (
+	headerMagic   = "git-cr\x00"
+	keyIDSize     = 8
+	headerSize    = len(headerMagic) + 2 + keyIDSize
+	formatVersion = 2
+	// algorithmStream is the chunked secretbox stream written by SealStream
+	algorithmStream = 1
+)
+
+var (
+	// ErrUnknownVersion occurs if a blob was written in a newer format
+	ErrUnknownVersion = errors.New("blob was encrypted in an unknown format")
+	// ErrUnknownAlgorithm occurs if a blob was encrypted with an unsupported algorithm
+	ErrUnknownAlgorithm = errors.New("blob was encrypted with an unknown algorithm")
+	// ErrUnknownKey occurs if a blob was encrypted with none of the given keys
+	ErrUnknownKey = repo.NewAuthError("blob was encrypted with an unknown key")
+	// ErrMissingHeader occurs if a blob without header is read in strict mode
+	ErrMissingHeader = repo.NewAuthError("blob was encrypted without header, but the repo only holds blobs in the current format")
+)
+
+// SealBlob returns a reader that encrypts rdr as a stream that can only be
+// opened under name
+func SealBlob(rdr io.Reader, key *[32]byte, name string) io.Reader {
+	id := KeyID(key)
+	header := make([]byte, 0, headerSize)
+	header = append(header, headerMagic...)
+	header = append(header, formatVersion, algorithmStream)
+	header = append(header, id[:]...)
+	return io.MultiReader(bytes.NewReader(header), SealStream(rdr, blobKey(key, header, name)))
+}
+
+// OpenBlob returns a reader that decrypts a blob written by SealBlob under
+// name. Blobs without header, written by Seal, are rejected with
+// ErrMissingHeader.
+func OpenBlob(rdr io.Reader, key *[32]byte, name string) io.Reader {
+	return openBlob(rdr, []*[32]byte{key}, name, false)
+}
+
+// KeyID identifies a key in blob headers without revealing it
+func KeyID(key *[32]byte) [keyIDSize]byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("git-cr key id"))
+	var id [keyIDSize]byte
+	copy(id[:], mac.Sum(nil))
+	return id
+}
+
+// openBlob is OpenBlob with several keys, which reads blobs without header if
+// legacy is set
+func openBlob(rdr io.Reader, keys []*[32]byte, name string, legacy bool) io.Reader {
+	return &blobReader{in: bufio.NewReader(rdr), keys: keys, name: name, legacy: legacy}
+}
+
+type blobReader struct {
+	in     *bufio.Reader
+	keys   []*[32]byte
+	name   string
+	legacy bool
+	out    io.Reader
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	if b.out == nil {
+		out, err := b.open()
+		if err != nil {
+			return 0, err
+		}
+		b.out = out
+	}
+	return b.out.Read(p)
+}
+
+func (b *blobReader) open() (io.Reader, error) {
+	header, err := b.in.Peek(headerSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(headerMagic)) {
+		if !b.legacy {
+			return nil, ErrMissingHeader
+		}
+		return b.openSealed()
+	}
+	if len(header) > len(headerMagic) && header[len(headerMagic)] != formatVersion {
+		return nil, ErrUnknownVersion
+	}
+	if len(header) < headerSize {
+		return nil, ErrTooShort
+	}
+	if header[len(headerMagic)+1] != algorithmStream {
+		return nil, ErrUnknownAlgorithm
+	}
+	for _, key := range b.keys {
+		if id := KeyID(key); bytes.Equal(id[:], header[len(headerMagic)+2:]) {
+			return b.openStream(key)
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// openStream consumes the header and opens the stream following it with the
+// key derived from it
+func (b *blobReader) openStream(key *[32]byte) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(b.in, header); err != nil {
+		return nil, err
+	}
+	return OpenStream(b.in, blobKey(key, header, b.name)), nil
+}
+
+// openSealed reads a blob without header, which has to be kept in memory
+// completely
+func (b *blobReader) openSealed() (io.Reader, error) {
+	data, err := ioutil.ReadAll(b.in)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range b.keys {
+		out, err := Open(data, key)
+		if err == ErrVerificationFailed {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(out), nil
+	}
+	return nil, ErrVerificationFailed
+}
+
+// blobKey derives the key a blob's stream is sealed with
+func blobKey(key *[32]byte, header []byte, name string) *[32]byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(header)
+	mac.Write([]byte(name))
+	var out [32]byte
+	copy(out[:], mac.Sum(nil))
+	return &out
+}
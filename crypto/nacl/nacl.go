@@ -1,64 +1,94 @@
 package nacl
 
 import (
-	"bytes"
 	"crypto/rand"
 	"errors"
 	"io"
-	"io/ioutil"
 
 	"github.com/lucas-clemente/git-cr/git/repo"
 
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
+var (
+	// ErrTooShort occurs if an encrypted message is shorter than its nonce
+	ErrTooShort = errors.New("encrypted message is too short")
+	// ErrVerificationFailed occurs if an encrypted message was modified or the key is wrong
+	ErrVerificationFailed = repo.NewAuthError("error verifying encrypted data")
+)
+
 type naclBackend struct {
 	backend repo.Backend
-	key     [32]byte
+	// keys[0] encrypts, all keys decrypt
+	keys []*[32]byte
+	// strict rejects blobs without header
+	strict bool
 }
 
-// NewNaClBackend returns a repo.Backend implementation that encrypts data using nacl
-func NewNaClBackend(backend repo.Backend, key [32]byte) repo.Backend {
+// NewNaClBackend returns a repo.Backend implementation that encrypts data using
+// nacl. Blobs are written as streams bound to their names, see SealBlob. Blobs
+// written with one of the old keys can still be read. Blobs of earlier versions
+// without header are read until the repo is in strict mode, see
+// repo.StrictBackend.
+func NewNaClBackend(backend repo.Backend, key [32]byte, oldKeys ...[32]byte) repo.Backend {
+	keys := []*[32]byte{&key}
+	for i := range oldKeys {
+		keys = append(keys, &oldKeys[i])
+	}
 	return &naclBackend{
 		backend: backend,
-		key:     key,
+		keys:    keys,
 	}
 }
 
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 func (r *naclBackend) ReadBlob(name string) (io.ReadCloser, error) {
 	encryptedRdr, err := r.backend.ReadBlob(name + ".nacl")
 	if err != nil {
 		return nil, err
 	}
-	defer encryptedRdr.Close()
+	return &readCloser{Reader: openBlob(encryptedRdr, r.keys, name, !r.strict), Closer: encryptedRdr}, nil
+}
 
-	data, err := ioutil.ReadAll(encryptedRdr)
-	if err != nil {
-		return nil, err
-	}
+func (r *naclBackend) WriteBlob(name string, rdr io.Reader) error {
+	return r.backend.WriteBlob(name+".nacl", SealBlob(rdr, r.keys[0], name))
+}
+
+func (r *naclBackend) CreateBlob(name string, rdr io.Reader) error {
+	return r.backend.CreateBlob(name+".nacl", SealBlob(rdr, r.keys[0], name))
+}
 
+func (r *naclBackend) DeleteBlob(name string) error {
+	return repo.DeleteBlob(r.backend, name+".nacl")
+}
+
+func (r *naclBackend) SetStrict() {
+	r.strict = true
+}
+
+// Seal encrypts data with a random nonce, the result is nonce || secretbox
+func Seal(data []byte, key *[32]byte) []byte {
+	nonce := makeNonce()
+	return secretbox.Seal(nonce[:], data, nonce, key)
+}
+
+// Open decrypts and verifies data sealed by Seal
+func Open(data []byte, key *[32]byte) ([]byte, error) {
 	if len(data) < 24 {
-		return nil, errors.New("encrypted message is too short")
+		return nil, ErrTooShort
 	}
 	var nonce [24]byte
 	copy(nonce[:], data)
-	data = data[24:]
 
-	out, ok := secretbox.Open([]byte{}, data, &nonce, &r.key)
+	out, ok := secretbox.Open([]byte{}, data[24:], &nonce, key)
 	if !ok {
-		return nil, errors.New("error verifying encrypted data")
+		return nil, ErrVerificationFailed
 	}
-	return ioutil.NopCloser(bytes.NewBuffer(out)), nil
-}
-
-func (r *naclBackend) WriteBlob(name string, rdr io.Reader) error {
-	data, err := ioutil.ReadAll(rdr)
-	if err != nil {
-		return err
-	}
-	nonce := makeNonce()
-	out := secretbox.Seal(nonce[:], data, nonce, &r.key)
-	return r.backend.WriteBlob(name+".nacl", bytes.NewBuffer(out))
+	return out, nil
 }
 
 func makeNonce() *[24]byte {
@@ -2,6 +2,7 @@ package nacl_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"testing"
@@ -21,7 +22,11 @@ func TestNaCl(t *testing.T) {
 type fixtureBackend map[string][]byte
 
 func (f fixtureBackend) ReadBlob(name string) (io.ReadCloser, error) {
-	return ioutil.NopCloser(bytes.NewBuffer(f[name])), nil
+	data, ok := f[name]
+	if !ok {
+		return nil, repo.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
 }
 
 func (f fixtureBackend) WriteBlob(name string, r io.Reader) error {
@@ -33,6 +38,22 @@ func (f fixtureBackend) WriteBlob(name string, r io.Reader) error {
 	return nil
 }
 
+func (f fixtureBackend) CreateBlob(name string, r io.Reader) error {
+	if _, ok := f[name]; ok {
+		return repo.ErrExists
+	}
+	return f.WriteBlob(name, r)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
 var _ = Describe("NaCl", func() {
 	var (
 		naclBackend repo.Backend
@@ -54,6 +75,14 @@ var _ = Describe("NaCl", func() {
 		Ω(backend["foo.nacl"]).ShouldNot(HaveLen(0))
 	})
 
+	It("creates data only once", func() {
+		err := naclBackend.CreateBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backend["foo.nacl"]).ShouldNot(HaveLen(0))
+		err = naclBackend.CreateBlob("foo", bytes.NewBufferString("foobaz"))
+		Ω(err).Should(Equal(repo.ErrExists))
+	})
+
 	It("reads data", func() {
 		backend["foo.nacl"] = []byte{0x5d, 0x10, 0x39, 0x1c, 0x77, 0x2, 0xb, 0x26, 0x7e, 0xa6, 0x58, 0x52, 0xb9, 0x18, 0x55, 0x40, 0xb, 0x1, 0xd2, 0xc0, 0x40, 0xc9, 0xb3, 0xec, 0x27, 0x95, 0x9d, 0xf8, 0x17, 0x4b, 0xc7, 0xbb, 0xbb, 0x7, 0x31, 0x64, 0x66, 0xc9, 0xb9, 0xf8, 0x81, 0xdc, 0xef, 0xd, 0x6d, 0x56}
 		rdr, err := naclBackend.ReadBlob("foo")
@@ -62,4 +91,240 @@ var _ = Describe("NaCl", func() {
 		Ω(err).ShouldNot(HaveOccurred())
 		Ω(data).Should(Equal([]byte("foobar")))
 	})
+
+	It("reads and writes large data", func() {
+		data := make([]byte, 200000)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		err := naclBackend.WriteBlob("foo", bytes.NewBuffer(data))
+		Ω(err).ShouldNot(HaveOccurred())
+		rdr, err := naclBackend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadAll(rdr)).Should(Equal(data))
+	})
+
+	It("binds blobs to their names", func() {
+		err := naclBackend.WriteBlob("3.pack", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backend["3.pack.nacl"]).Should(HavePrefix("git-cr\x00\x02\x01"))
+
+		backend["4.pack.nacl"] = backend["3.pack.nacl"]
+		rdr, err := naclBackend.ReadBlob("4.pack")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = ioutil.ReadAll(rdr)
+		Ω(err).Should(Equal(nacl.ErrVerificationFailed))
+	})
+
+	It("reads blobs without header", func() {
+		backend["foo.nacl"] = nacl.Seal([]byte("foobar"), &key)
+		rdr, err := naclBackend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadAll(rdr)).Should(Equal([]byte("foobar")))
+	})
+
+	It("rejects blobs without header in strict mode", func() {
+		backend["foo.nacl"] = nacl.Seal([]byte("foobar"), &key)
+		Ω(naclBackend.WriteBlob("bar", bytes.NewBufferString("foobaz"))).Should(Succeed())
+		repo.SetStrict(naclBackend)
+
+		rdr, err := naclBackend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = ioutil.ReadAll(rdr)
+		Ω(err).Should(Equal(nacl.ErrMissingHeader))
+		rdr, err = naclBackend.ReadBlob("bar")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadAll(rdr)).Should(Equal([]byte("foobaz")))
+	})
+
+	It("reads blobs written with old keys", func() {
+		var newKey [32]byte
+		copy(newKey[:], "The Answer to the Great Question")
+		id := nacl.KeyID(&key)
+		err := naclBackend.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backend["foo.nacl"][9:17]).Should(Equal(id[:]))
+		backend["bar.nacl"] = nacl.Seal([]byte("foobaz"), &key)
+
+		rotated := nacl.NewNaClBackend(backend, newKey, key)
+		rdr, err := rotated.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadAll(rdr)).Should(Equal([]byte("foobar")))
+		rdr, err = rotated.ReadBlob("bar")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadAll(rdr)).Should(Equal([]byte("foobaz")))
+
+		rdr, err = nacl.NewNaClBackend(backend, newKey).ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = ioutil.ReadAll(rdr)
+		Ω(err).Should(Equal(nacl.ErrUnknownKey))
+	})
+
+	It("rejects unknown algorithms", func() {
+		err := naclBackend.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		backend["foo.nacl"][8] = 0x63
+		rdr, err := naclBackend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = ioutil.ReadAll(rdr)
+		Ω(err).Should(Equal(nacl.ErrUnknownAlgorithm))
+	})
+
+	It("rejects unknown versions", func() {
+		backend["foo.nacl"] = []byte("git-cr\x00\x63foobar")
+		rdr, err := naclBackend.ReadBlob("foo")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = ioutil.ReadAll(rdr)
+		Ω(err).Should(Equal(nacl.ErrUnknownVersion))
+	})
+
+	Context("streams", func() {
+		seal := func(data []byte) []byte {
+			out, err := ioutil.ReadAll(nacl.SealStream(bytes.NewBuffer(data), &key))
+			Ω(err).ShouldNot(HaveOccurred())
+			return out
+		}
+
+		open := func(data []byte) ([]byte, error) {
+			return ioutil.ReadAll(nacl.OpenStream(bytes.NewBuffer(data), &key))
+		}
+
+		It("round-trips data of all sizes", func() {
+			for _, size := range []int{0, 1, 64*1024 - 1, 64 * 1024, 64*1024 + 1, 3 * 64 * 1024} {
+				data := bytes.Repeat([]byte{'a'}, size)
+				Ω(open(seal(data))).Should(Equal(data))
+			}
+		})
+
+		It("encrypts without reading everything first", func() {
+			huge := io.LimitReader(zeroReader{}, 1<<40)
+			rdr := nacl.SealStream(huge, &key)
+			_, err := io.ReadFull(rdr, make([]byte, 1<<20))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("detects modified chunks", func() {
+			sealed := seal(make([]byte, 200000))
+			sealed[100000] ^= 1
+			_, err := open(sealed)
+			Ω(err).Should(Equal(nacl.ErrVerificationFailed))
+		})
+
+		It("detects truncation at chunk boundaries", func() {
+			sealed := seal(make([]byte, 3*64*1024))
+			_, err := open(sealed[:16+2*(64*1024+16)])
+			Ω(err).Should(Equal(nacl.ErrVerificationFailed))
+		})
+
+		It("detects reordered chunks", func() {
+			sealed := seal(bytes.Repeat([]byte{'a'}, 3*64*1024))
+			chunk := 64*1024 + 16
+			first := append([]byte{}, sealed[16:16+chunk]...)
+			copy(sealed[16:], sealed[16+chunk:16+2*chunk])
+			copy(sealed[16+chunk:], first)
+			_, err := open(sealed)
+			Ω(err).Should(Equal(nacl.ErrVerificationFailed))
+		})
+
+		It("doesn't read data written by Seal", func() {
+			_, err := open(nacl.Seal([]byte("foobar"), &key))
+			Ω(err).Should(Equal(nacl.ErrVerificationFailed))
+		})
+
+		It("fails with other keys", func() {
+			sealed := seal([]byte("foobar"))
+			var other [32]byte
+			_, err := ioutil.ReadAll(nacl.OpenStream(bytes.NewBuffer(sealed), &other))
+			Ω(err).Should(Equal(nacl.ErrVerificationFailed))
+		})
+	})
+
+	Context("with a passphrase", func() {
+		const passphrase = "correct horse battery staple"
+
+		It("creates a kdf header with a random salt", func() {
+			key1, err := nacl.DeriveKey(backend, passphrase)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(backend).Should(HaveKey(nacl.KDFHeaderName))
+
+			var header map[string]interface{}
+			err = json.Unmarshal(backend[nacl.KDFHeaderName], &header)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(header["kdf"]).Should(Equal("scrypt"))
+			Ω(header["salt"]).ShouldNot(BeEmpty())
+
+			otherBackend := fixtureBackend{}
+			key2, err := nacl.DeriveKey(otherBackend, passphrase)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(key2).ShouldNot(Equal(key1))
+		})
+
+		It("derives the same key again", func() {
+			key1, err := nacl.DeriveKey(backend, passphrase)
+			Ω(err).ShouldNot(HaveOccurred())
+			key2, err := nacl.DeriveKey(backend, passphrase)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(key2).Should(Equal(key1))
+		})
+
+		It("derives different keys for different passphrases", func() {
+			key1, err := nacl.DeriveKey(backend, passphrase)
+			Ω(err).ShouldNot(HaveOccurred())
+			key2, err := nacl.DeriveKey(backend, "wrong")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(key2).ShouldNot(Equal(key1))
+		})
+
+		It("reads and writes data", func() {
+			b, err := nacl.NewPassphraseBackend(backend, passphrase)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			b, err = nacl.NewPassphraseBackend(backend, passphrase)
+			Ω(err).ShouldNot(HaveOccurred())
+			rdr, err := b.ReadBlob("foo")
+			Ω(err).ShouldNot(HaveOccurred())
+			data, err := ioutil.ReadAll(rdr)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(data).Should(Equal([]byte("foobar")))
+		})
+
+		It("doesn't re-create the kdf header of repos with data", func() {
+			for _, name := range []string{"revisions.json", "names.key"} {
+				backend = fixtureBackend{}
+				b, err := nacl.NewPassphraseBackend(backend, passphrase)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(b.WriteBlob(name, bytes.NewBufferString("foobar"))).Should(Succeed())
+				delete(backend, nacl.KDFHeaderName)
+
+				_, err = nacl.DeriveKey(backend, passphrase)
+				Ω(err).Should(Equal(nacl.ErrMissingKDFHeader))
+				Ω(backend).ShouldNot(HaveKey(nacl.KDFHeaderName))
+			}
+		})
+
+		It("creates kdf headers for existing data explicitly", func() {
+			backend["revisions.json.nacl"] = []byte("foobar")
+			Ω(nacl.CreateKDFHeader(backend)).Should(Succeed())
+			header := backend[nacl.KDFHeaderName]
+			Ω(header).ShouldNot(BeEmpty())
+			Ω(nacl.CreateKDFHeader(backend)).Should(Succeed())
+			Ω(backend[nacl.KDFHeaderName]).Should(Equal(header))
+			_, err := nacl.DeriveKey(backend, passphrase)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("rejects unsafe parameters", func() {
+			backend[nacl.KDFHeaderName] = []byte(`{"kdf":"scrypt","salt":"MTIzNDU2Nzg5MDEyMzQ1Ng==","N":2,"r":1,"p":1}`)
+			_, err := nacl.DeriveKey(backend, passphrase)
+			Ω(err).Should(Equal(nacl.ErrInvalidKDFHeader))
+		})
+
+		It("rejects huge parameters", func() {
+			backend[nacl.KDFHeaderName] = []byte(`{"kdf":"scrypt","salt":"MTIzNDU2Nzg5MDEyMzQ1Ng==","N":1073741824,"r":8,"p":1}`)
+			_, err := nacl.DeriveKey(backend, passphrase)
+			Ω(err).Should(Equal(nacl.ErrInvalidKDFHeader))
+		})
+	})
 })
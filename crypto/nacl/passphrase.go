@@ -0,0 +1,162 @@
+package nacl
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+
+	"github.com/lucas-clemente/git-cr/git/repo"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDFHeaderName is the name of the unencrypted blob holding the KDF parameters
+const KDFHeaderName = "kdf.json"
+
+// ErrInvalidKDFHeader occurs if the KDF header can't be parsed or has unsafe parameters
+var ErrInvalidKDFHeader = errors.New("invalid or unsafe kdf header")
+
+// ErrMissingKDFHeader occurs if the KDF header is missing from a repo that
+// already holds encrypted data
+var ErrMissingKDFHeader = errors.New("the kdf header is missing, but the repo already holds encrypted data")
+
+// encryptedMarkers are blobs that every repo encrypted with nacl holds: the
+// revisions, or the naming key if blob names are hidden
+var encryptedMarkers = []string{"revisions.json.nacl", "names.key.nacl"}
+
+// Parameters for new repos, as recommended by the scrypt paper for interactive use
+const (
+	defaultScryptN = 1 << 15
+	defaultScryptR = 8
+	defaultScryptP = 1
+	saltSize       = 32
+)
+
+// kdfHeader is stored in plain text. It is not authenticated, but a modified
+// header only leads to a wrong key and thus to failing decryption.
+type kdfHeader struct {
+	KDF  string `json:"kdf"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"N"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+func (h *kdfHeader) valid() bool {
+	// Limits keep a malicious header from making us use huge amounts of memory
+	return h.KDF == "scrypt" &&
+		len(h.Salt) >= 16 &&
+		h.N >= 1<<14 && h.N <= 1<<20 && h.N&(h.N-1) == 0 &&
+		h.R >= 1 && h.R <= 32 &&
+		h.P >= 1 && h.P <= 16
+}
+
+// DeriveKey derives a key from the passphrase using scrypt. The salt and
+// parameters are read from the KDF header in the backend. New repos get a
+// header with a random salt, but if the header of a repo with data went
+// missing, a new salt would silently lead to another key, so
+// ErrMissingKDFHeader is returned instead.
+func DeriveKey(backend repo.Backend, passphrase string) ([32]byte, error) {
+	var key [32]byte
+
+	header, err := readKDFHeader(backend)
+	if err == repo.ErrNotFound {
+		var encrypted bool
+		if encrypted, err = hasEncryptedData(backend); err == nil {
+			if encrypted {
+				return key, ErrMissingKDFHeader
+			}
+			header, err = createKDFHeader(backend)
+		}
+	}
+	if err != nil {
+		return key, err
+	}
+
+	derived, err := scrypt.Key([]byte(passphrase), header.Salt, header.N, header.R, header.P, len(key))
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], derived)
+	return key, nil
+}
+
+// NewPassphraseBackend returns a nacl backend with a key derived from the passphrase
+func NewPassphraseBackend(backend repo.Backend, passphrase string) (repo.Backend, error) {
+	key, err := DeriveKey(backend, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return NewNaClBackend(backend, key), nil
+}
+
+// CreateKDFHeader creates a KDF header with a random salt unless the repo
+// already has one, e.g. before the data of a repo is rekeyed to a passphrase
+func CreateKDFHeader(backend repo.Backend) error {
+	if _, err := readKDFHeader(backend); err != repo.ErrNotFound {
+		return err
+	}
+	_, err := createKDFHeader(backend)
+	return err
+}
+
+func hasEncryptedData(backend repo.Backend) (bool, error) {
+	for _, name := range encryptedMarkers {
+		rdr, err := backend.ReadBlob(name)
+		if err == nil {
+			rdr.Close()
+			return true, nil
+		}
+		if err != repo.ErrNotFound {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func readKDFHeader(backend repo.Backend) (*kdfHeader, error) {
+	rdr, err := backend.ReadBlob(KDFHeaderName)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	header := &kdfHeader{}
+	if err := json.Unmarshal(data, header); err != nil || !header.valid() {
+		return nil, ErrInvalidKDFHeader
+	}
+	return header, nil
+}
+
+func createKDFHeader(backend repo.Backend) (*kdfHeader, error) {
+	header := &kdfHeader{
+		KDF:  "scrypt",
+		Salt: make([]byte, saltSize),
+		N:    defaultScryptN,
+		R:    defaultScryptR,
+		P:    defaultScryptP,
+	}
+	if _, err := rand.Read(header.Salt); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	err = backend.CreateBlob(KDFHeaderName, bytes.NewBuffer(data))
+	if err == repo.ErrExists {
+		// Another client was faster, use its salt
+		return readKDFHeader(backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
@@ -0,0 +1,182 @@
+package nacl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Streams split the data into chunks of chunkSize bytes, each sealed as its
+// own secretbox. The nonce of a chunk is a random prefix shared by the whole
+// stream, followed by the chunk's 7 byte big endian index and a flag that is 1
+// for the last chunk only. Reordered, dropped or appended chunks thus fail
+// verification, as does a stream truncated at a chunk boundary. A stream is
+// the nonce prefix followed by the sealed chunks. The last chunk may be
+// shorter than chunkSize or empty. Streams are only stored after a blob
+// header of formatVersion, see SealBlob.
+const (
+	chunkSize   = 64 * 1024
+	prefixSize  = 16
+	maxChunks   = 1 << 56
+	lastChunk   = 1
+	sealedChunk = chunkSize + secretbox.Overhead
+)
+
+// ErrStreamTooLong occurs if a stream has more chunks than nonces are available
+var ErrStreamTooLong = errors.New("encrypted stream is too long")
+
+type sealReader struct {
+	in      *bufio.Reader
+	key     *[32]byte
+	nonce   [24]byte
+	counter uint64
+	chunk   []byte
+	out     []byte
+	pending []byte
+	done    bool
+	err     error
+}
+
+// SealStream returns a reader that encrypts rdr in chunks, so that only a
+// single chunk is kept in memory at a time
+func SealStream(rdr io.Reader, key *[32]byte) io.Reader {
+	s := &sealReader{
+		in:    bufio.NewReader(rdr),
+		key:   key,
+		chunk: make([]byte, chunkSize),
+		out:   make([]byte, 0, sealedChunk),
+	}
+	copy(s.nonce[:prefixSize], makeNonce()[:])
+	s.pending = append([]byte{}, s.nonce[:prefixSize]...)
+	return s
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.err = s.sealChunk()
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *sealReader) sealChunk() error {
+	if s.done {
+		return io.EOF
+	}
+	n, last, err := readChunk(s.in, s.chunk)
+	if err != nil {
+		return err
+	}
+	if err := setChunkNonce(&s.nonce, s.counter, last); err != nil {
+		return err
+	}
+	s.pending = secretbox.Seal(s.out[:0], s.chunk[:n], &s.nonce, s.key)
+	s.counter++
+	s.done = last
+	return nil
+}
+
+type openReader struct {
+	in      *bufio.Reader
+	key     *[32]byte
+	nonce   [24]byte
+	counter uint64
+	chunk   []byte
+	out     []byte
+	pending []byte
+	done    bool
+	err     error
+}
+
+// OpenStream returns a reader that decrypts and verifies a stream written by
+// SealStream. Data is returned before the whole stream was verified, but
+// Read fails before io.EOF if the stream was modified or truncated.
+func OpenStream(rdr io.Reader, key *[32]byte) io.Reader {
+	return &openReader{
+		in:    bufio.NewReader(rdr),
+		key:   key,
+		chunk: make([]byte, sealedChunk),
+		out:   make([]byte, 0, chunkSize),
+	}
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.pending) == 0 {
+		if o.err != nil {
+			return 0, o.err
+		}
+		o.err = o.openChunk()
+	}
+	n := copy(p, o.pending)
+	o.pending = o.pending[n:]
+	return n, nil
+}
+
+func (o *openReader) openChunk() error {
+	if o.done {
+		return io.EOF
+	}
+	if o.counter == 0 {
+		if _, err := io.ReadFull(o.in, o.nonce[:prefixSize]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return ErrTooShort
+			}
+			return err
+		}
+	}
+
+	n, last, err := readChunk(o.in, o.chunk)
+	if err != nil {
+		return err
+	}
+	if err := setChunkNonce(&o.nonce, o.counter, last); err != nil {
+		return err
+	}
+	out, ok := secretbox.Open(o.out[:0], o.chunk[:n], &o.nonce, o.key)
+	if !ok {
+		return ErrVerificationFailed
+	}
+	o.pending = out
+	o.counter++
+	o.done = last
+	return nil
+}
+
+// readChunk fills buf as far as possible and reports whether the input ended
+func readChunk(in *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(in, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err := in.Peek(1); err != nil {
+		if err == io.EOF {
+			return n, true, nil
+		}
+		return 0, false, err
+	}
+	return n, false, nil
+}
+
+func setChunkNonce(nonce *[24]byte, counter uint64, last bool) error {
+	if counter >= maxChunks {
+		return ErrStreamTooLong
+	}
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], counter)
+	copy(nonce[prefixSize:23], index[1:])
+	nonce[23] = 0
+	if last {
+		nonce[23] = lastChunk
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Package naming hides blob names from the storage by replacing them with
+// pseudonyms, keyed HMACs of the names.
+package naming
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+// KeyName is the name of the blob holding the naming key. It has to be
+// stored in an encrypted backend.
+const KeyName = "names.key"
+
+// ErrInvalidKey occurs if the naming key blob doesn't hold a 32 byte key
+var ErrInvalidKey = errors.New("invalid naming key")
+
+// probeName is looked up to tell whether a repo without naming key is empty
+const probeName = "revisions.json"
+
+type namingBackend struct {
+	backend repo.Backend
+	key     []byte
+}
+
+// NewNamingBackend returns a repo.Backend that stores blobs in backend under
+// their pseudonyms
+func NewNamingBackend(backend repo.Backend, key []byte) repo.Backend {
+	return &namingBackend{backend: backend, key: key}
+}
+
+// Open reads the naming key from the encrypted backend and returns a backend
+// using pseudonyms. New repos get a random key. Repos created before names
+// were hidden don't have a key, for these backend is returned unchanged.
+func Open(backend repo.Backend) (repo.Backend, error) {
+	key, err := ReadKey(backend)
+	if err == repo.ErrNotFound {
+		rdr, probeErr := backend.ReadBlob(probeName)
+		if probeErr == nil {
+			rdr.Close()
+			return backend, nil
+		}
+		if probeErr != repo.ErrNotFound {
+			return nil, probeErr
+		}
+		key, err = CreateKey(backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewNamingBackend(backend, key), nil
+}
+
+// ReadKey reads the naming key
+func ReadKey(backend repo.Backend) ([]byte, error) {
+	rdr, err := backend.ReadBlob(KeyName)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	key, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// CreateKey creates a random naming key. If another client created one
+// concurrently, that key is returned instead.
+func CreateKey(backend repo.Backend) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	err := backend.CreateBlob(KeyName, bytes.NewBuffer(key))
+	if err == repo.ErrExists {
+		return ReadKey(backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WriteKey stores an existing naming key, e.g. when re-encrypting a repo
+func WriteKey(backend repo.Backend, key []byte) error {
+	return backend.WriteBlob(KeyName, bytes.NewBuffer(key))
+}
+
+// Pseudonym returns the name a blob is stored under
+func Pseudonym(key []byte, name string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (b *namingBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	return b.backend.ReadBlob(Pseudonym(b.key, name))
+}
+
+func (b *namingBackend) WriteBlob(name string, rdr io.Reader) error {
+	return b.backend.WriteBlob(Pseudonym(b.key, name), rdr)
+}
+
+func (b *namingBackend) CreateBlob(name string, rdr io.Reader) error {
+	return b.backend.CreateBlob(Pseudonym(b.key, name), rdr)
+}
+
+func (b *namingBackend) DeleteBlob(name string) error {
+	return repo.DeleteBlob(b.backend, Pseudonym(b.key, name))
+}
+
+func (b *namingBackend) SetStrict() {
+	repo.SetStrict(b.backend)
+}
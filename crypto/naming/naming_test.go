@@ -0,0 +1,114 @@
+package naming_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/lucas-clemente/git-cr/crypto/naming"
+	"github.com/lucas-clemente/git-cr/git/repo"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestNaming(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Naming Suite")
+}
+
+type fixtureBackend map[string][]byte
+
+func (f fixtureBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	data, ok := f[name]
+	if !ok {
+		return nil, repo.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
+}
+
+func (f fixtureBackend) WriteBlob(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f[name] = data
+	return nil
+}
+
+func (f fixtureBackend) CreateBlob(name string, r io.Reader) error {
+	if _, ok := f[name]; ok {
+		return repo.ErrExists
+	}
+	return f.WriteBlob(name, r)
+}
+
+func readBlob(b repo.Backend, name string) []byte {
+	rdr, err := b.ReadBlob(name)
+	Ω(err).ShouldNot(HaveOccurred())
+	data, err := ioutil.ReadAll(rdr)
+	Ω(err).ShouldNot(HaveOccurred())
+	return data
+}
+
+var _ = Describe("Naming", func() {
+	var backend fixtureBackend
+
+	BeforeEach(func() {
+		backend = fixtureBackend{}
+	})
+
+	It("stores blobs under pseudonyms", func() {
+		b, err := naming.Open(backend)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.WriteBlob("revisions.json", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backend).Should(HaveKey(naming.KeyName))
+		Ω(backend).Should(HaveLen(2))
+		Ω(backend).ShouldNot(HaveKey("revisions.json"))
+		Ω(readBlob(b, "revisions.json")).Should(Equal([]byte("foobar")))
+
+		for name := range backend {
+			if name != naming.KeyName {
+				Ω(name).Should(MatchRegexp("^[0-9a-f]{64}$"))
+			}
+		}
+	})
+
+	It("uses the same key again", func() {
+		b, err := naming.Open(backend)
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.WriteBlob("0.pack", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		b, err = naming.Open(backend)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readBlob(b, "0.pack")).Should(Equal([]byte("foobar")))
+	})
+
+	It("uses different pseudonyms in different repos", func() {
+		other := fixtureBackend{}
+		a, err := naming.ReadKey(backend)
+		Ω(err).Should(Equal(repo.ErrNotFound))
+		a, err = naming.CreateKey(backend)
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := naming.CreateKey(other)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(naming.Pseudonym(a, "0.pack")).ShouldNot(Equal(naming.Pseudonym(b, "0.pack")))
+	})
+
+	It("keeps plain names in existing repos", func() {
+		backend["revisions.json"] = []byte("foobar")
+		b, err := naming.Open(backend)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backend).ShouldNot(HaveKey(naming.KeyName))
+		Ω(readBlob(b, "revisions.json")).Should(Equal([]byte("foobar")))
+	})
+
+	It("rejects invalid keys", func() {
+		backend[naming.KeyName] = []byte("foo")
+		_, err := naming.Open(backend)
+		Ω(err).Should(Equal(naming.ErrInvalidKey))
+	})
+})
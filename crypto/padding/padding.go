@@ -0,0 +1,280 @@
+// Package padding pads blobs to a few distinct sizes before they are
+// encrypted, so that the storage doesn't reveal their exact length.
+package padding
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+var (
+	// ErrUnknownScheme occurs for padding schemes other than none, padme and pow2
+	ErrUnknownScheme = errors.New("unknown padding scheme, expected none, padme or pow2")
+	// ErrInvalidPadding occurs if a padded blob doesn't end with valid padding
+	ErrInvalidPadding = errors.New("invalid padding")
+)
+
+// A Scheme returns the padded size for a blob of the given size
+type Scheme func(size int64) int64
+
+// Padme pads to sizes with at most 12% overhead while leaking only
+// O(log log size) bits of the size, see "Reducing Metadata Leakage from
+// Encrypted Files and Communication with PURBs" by Nikitin et al.
+func Padme(size int64) int64 {
+	if size < 2 {
+		return size
+	}
+	e := log2(size)
+	s := log2(int64(e)) + 1
+	mask := int64(1)<<uint(e-s) - 1
+	return (size + mask) &^ mask
+}
+
+// PowerOfTwo pads to the next power of two, with up to 100% overhead
+func PowerOfTwo(size int64) int64 {
+	padded := int64(1)
+	for padded < size {
+		padded <<= 1
+	}
+	return padded
+}
+
+// ParseScheme returns the scheme for "padme" or "pow2", and nil for "none"
+func ParseScheme(name string) (Scheme, error) {
+	switch name {
+	case "none", "":
+		return nil, nil
+	case "padme":
+		return Padme, nil
+	case "pow2":
+		return PowerOfTwo, nil
+	}
+	return nil, ErrUnknownScheme
+}
+
+func log2(n int64) int {
+	l := 0
+	for n > 1 {
+		n >>= 1
+		l++
+	}
+	return l
+}
+
+// Padded blobs start with magic, which neither packs nor revision lists do.
+// The data is followed by a 0x80 byte and zeros up to the padded size.
+var magic = []byte("\x00git-cr-pad\x00")
+
+const marker = 0x80
+
+type paddingBackend struct {
+	backend repo.Backend
+	scheme  Scheme
+}
+
+// NewPaddingBackend returns a repo.Backend that pads blobs according to the
+// scheme before writing them to backend, which should encrypt them. Blobs
+// without padding are read as they are, so padding can be enabled for
+// existing repos. If scheme is nil, blobs are written without padding.
+func NewPaddingBackend(backend repo.Backend, scheme Scheme) repo.Backend {
+	return &paddingBackend{backend: backend, scheme: scheme}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (b *paddingBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	rdr, err := b.backend.ReadBlob(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{Reader: Unpad(rdr), Closer: rdr}, nil
+}
+
+func (b *paddingBackend) WriteBlob(name string, rdr io.Reader) error {
+	return b.backend.WriteBlob(name, b.pad(rdr))
+}
+
+func (b *paddingBackend) CreateBlob(name string, rdr io.Reader) error {
+	return b.backend.CreateBlob(name, b.pad(rdr))
+}
+
+func (b *paddingBackend) DeleteBlob(name string) error {
+	return repo.DeleteBlob(b.backend, name)
+}
+
+func (b *paddingBackend) SetStrict() {
+	repo.SetStrict(b.backend)
+}
+
+func (b *paddingBackend) pad(rdr io.Reader) io.Reader {
+	if b.scheme == nil {
+		return rdr
+	}
+	return Pad(rdr, b.scheme)
+}
+
+type padReader struct {
+	in     io.Reader
+	scheme Scheme
+	size   int64
+	ended  bool
+	// padding is the number of bytes left to write after the input ended,
+	// starting with the marker
+	padding       int64
+	markerWritten bool
+}
+
+// Pad returns a reader that pads rdr according to the scheme
+func Pad(rdr io.Reader, scheme Scheme) io.Reader {
+	return &padReader{
+		in:     io.MultiReader(bytes.NewReader(magic), rdr),
+		scheme: scheme,
+	}
+}
+
+func (p *padReader) Read(buf []byte) (int, error) {
+	if !p.ended {
+		n, err := p.in.Read(buf)
+		p.size += int64(n)
+		if err == io.EOF {
+			p.ended = true
+			p.padding = p.scheme(p.size+1) - p.size
+		} else if err != nil {
+			return n, err
+		}
+		if n > 0 || !p.ended {
+			return n, nil
+		}
+	}
+
+	if p.padding == 0 {
+		return 0, io.EOF
+	}
+	n := int64(len(buf))
+	if n > p.padding {
+		n = p.padding
+	}
+	for i := range buf[:n] {
+		buf[i] = 0
+	}
+	if n > 0 && !p.markerWritten {
+		buf[0] = marker
+		p.markerWritten = true
+	}
+	p.padding -= n
+	return int(n), nil
+}
+
+// unpadBufferSize is the size of the chunks in which padded blobs are scanned
+const unpadBufferSize = 32 * 1024
+
+type unpadReader struct {
+	in  *bufio.Reader
+	buf []byte
+	// out is the part of buf that is data for sure
+	out []byte
+	// held and zeros are a 0x80 byte and the zeros following it, which are
+	// only written once it is clear that they are not the padding
+	held  bool
+	zeros int64
+	// flushMarker and flushZeros are held bytes that turned out to be data,
+	// and have to be written before out
+	flushMarker bool
+	flushZeros  int64
+	err         error
+}
+
+// Unpad returns a reader that strips the padding written by Pad. Data
+// without padding is returned unchanged.
+func Unpad(rdr io.Reader) io.Reader {
+	in := bufio.NewReader(rdr)
+	start, err := in.Peek(len(magic))
+	if err != nil || !bytes.Equal(start, magic) {
+		return in
+	}
+	in.Discard(len(magic))
+	return &unpadReader{in: in, buf: make([]byte, unpadBufferSize)}
+}
+
+func (u *unpadReader) Read(buf []byte) (int, error) {
+	for {
+		if n := u.drain(buf); n > 0 {
+			return n, nil
+		}
+		if u.err != nil {
+			if u.err == io.EOF && !u.held {
+				return 0, ErrInvalidPadding
+			}
+			return 0, u.err
+		}
+		u.fill()
+	}
+}
+
+// drain writes the bytes that are known to be data into buf
+func (u *unpadReader) drain(buf []byte) int {
+	n := 0
+	if u.flushMarker && n < len(buf) {
+		buf[n] = marker
+		n++
+		u.flushMarker = false
+	}
+	for ; u.flushZeros > 0 && n < len(buf); u.flushZeros-- {
+		buf[n] = 0
+		n++
+	}
+	if !u.flushMarker && u.flushZeros == 0 {
+		copied := copy(buf[n:], u.out)
+		u.out = u.out[copied:]
+		n += copied
+	}
+	return n
+}
+
+// fill reads the next chunk. Only its last 0x80 byte can start the padding,
+// if nothing but zeros follow it, so everything before is data.
+func (u *unpadReader) fill() {
+	n, err := u.in.Read(u.buf)
+	if err != nil {
+		u.err = err
+	}
+	chunk := u.buf[:n]
+	if n == 0 {
+		return
+	}
+
+	if u.held {
+		if allZeros(chunk) {
+			u.zeros += int64(n)
+			return
+		}
+		// The held bytes were data
+		u.flushMarker = true
+		u.flushZeros = u.zeros
+		u.held = false
+		u.zeros = 0
+	}
+
+	u.out = chunk
+	if i := bytes.LastIndexByte(chunk, marker); i >= 0 && allZeros(chunk[i+1:]) {
+		u.out = chunk[:i]
+		u.held = true
+		u.zeros = int64(n - i - 1)
+	}
+}
+
+func allZeros(data []byte) bool {
+	for _, c := range data {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package padding_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/lucas-clemente/git-cr/crypto/padding"
+	"github.com/lucas-clemente/git-cr/git/repo"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestPadding(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Padding Suite")
+}
+
+type fixtureBackend map[string][]byte
+
+func (f fixtureBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	data, ok := f[name]
+	if !ok {
+		return nil, repo.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
+}
+
+func (f fixtureBackend) WriteBlob(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f[name] = data
+	return nil
+}
+
+func (f fixtureBackend) CreateBlob(name string, r io.Reader) error {
+	if _, ok := f[name]; ok {
+		return repo.ErrExists
+	}
+	return f.WriteBlob(name, r)
+}
+
+func readBlob(b repo.Backend, name string) ([]byte, error) {
+	rdr, err := b.ReadBlob(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	return ioutil.ReadAll(rdr)
+}
+
+var _ = Describe("Padding", func() {
+	var backend fixtureBackend
+
+	BeforeEach(func() {
+		backend = fixtureBackend{}
+	})
+
+	It("computes padme sizes", func() {
+		Ω(padding.Padme(1)).Should(Equal(int64(1)))
+		Ω(padding.Padme(9)).Should(Equal(int64(10)))
+		Ω(padding.Padme(1000)).Should(Equal(int64(1024)))
+		Ω(padding.Padme(1000000)).Should(Equal(int64(1015808)))
+		for _, size := range []int64{2, 17, 100, 12345, 1 << 30} {
+			Ω(padding.Padme(size)).Should(BeNumerically(">=", size))
+			Ω(padding.Padme(size)).Should(BeNumerically("<=", size+size*12/100))
+		}
+	})
+
+	It("computes power of two sizes", func() {
+		Ω(padding.PowerOfTwo(1)).Should(Equal(int64(1)))
+		Ω(padding.PowerOfTwo(5)).Should(Equal(int64(8)))
+		Ω(padding.PowerOfTwo(1024)).Should(Equal(int64(1024)))
+	})
+
+	It("pads and unpads data", func() {
+		b := padding.NewPaddingBackend(backend, padding.Padme)
+		for _, data := range [][]byte{{}, []byte("foobar"), bytes.Repeat([]byte{0x80, 0}, 5000), {0, 0x80, 0x80, 0}} {
+			err := b.WriteBlob("foo", bytes.NewBuffer(data))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(readBlob(b, "foo")).Should(Equal(data))
+		}
+	})
+
+	It("unpads data split at any point", func() {
+		data := bytes.Repeat([]byte("foo"), 20000)
+		// Zeros after 0x80 bytes look like padding until other data follows
+		data = append(data, 0x80)
+		data = append(data, make([]byte, 70000)...)
+		data = append(data, 1, 0x80, 0, 0)
+		var padded bytes.Buffer
+		_, err := padded.ReadFrom(padding.Pad(bytes.NewReader(data), padding.Padme))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(ioutil.ReadAll(padding.Unpad(bytes.NewReader(padded.Bytes())))).Should(Equal(data))
+		Ω(ioutil.ReadAll(padding.Unpad(iotest.OneByteReader(bytes.NewReader(padded.Bytes()))))).Should(Equal(data))
+		Ω(ioutil.ReadAll(iotest.OneByteReader(padding.Unpad(bytes.NewReader(padded.Bytes()))))).Should(Equal(data))
+	})
+
+	It("writes blobs of only a few sizes", func() {
+		b := padding.NewPaddingBackend(backend, padding.PowerOfTwo)
+		sizes := map[int]bool{}
+		for i := 100; i < 200; i++ {
+			err := b.WriteBlob("foo", bytes.NewReader(make([]byte, i)))
+			Ω(err).ShouldNot(HaveOccurred())
+			sizes[len(backend["foo"])] = true
+		}
+		Ω(sizes).Should(HaveLen(2))
+	})
+
+	It("reads blobs without padding", func() {
+		backend["foo"] = []byte("foobar")
+		b := padding.NewPaddingBackend(backend, padding.Padme)
+		Ω(readBlob(b, "foo")).Should(Equal([]byte("foobar")))
+	})
+
+	It("writes without padding without a scheme", func() {
+		b := padding.NewPaddingBackend(backend, nil)
+		err := b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backend["foo"]).Should(Equal([]byte("foobar")))
+	})
+
+	It("detects invalid padding", func() {
+		b := padding.NewPaddingBackend(backend, padding.Padme)
+		err := b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		backend["foo"] = bytes.TrimRight(backend["foo"], "\x00\x80")
+		_, err = readBlob(b, "foo")
+		Ω(err).Should(Equal(padding.ErrInvalidPadding))
+	})
+
+	It("parses schemes", func() {
+		s, err := padding.ParseScheme("none")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(s).Should(BeNil())
+		s, err = padding.ParseScheme("padme")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(s(1000)).Should(Equal(int64(1024)))
+		_, err = padding.ParseScheme("foo")
+		Ω(err).Should(Equal(padding.ErrUnknownScheme))
+	})
+})
@@ -0,0 +1,210 @@
+// Package pgp encrypts blobs as OpenPGP messages to a list of public keys,
+// so teams can reuse the keys they already manage with GnuPG.
+package pgp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/lucas-clemente/git-cr/git/repo"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+)
+
+var (
+	// ErrNoRecipients occurs if the public keyring is empty
+	ErrNoRecipients = errors.New("the public keyring doesn't contain any keys")
+	// ErrNoSecretKeys occurs if the secret keyring doesn't contain private keys
+	ErrNoSecretKeys = errors.New("the secret keyring doesn't contain any private keys")
+	// ErrEncryptedSecretKey occurs if a private key is encrypted and no passphrase was given
+	ErrEncryptedSecretKey = errors.New("the private key is protected by a passphrase")
+	// ErrWrongName occurs if a blob was encrypted under another name
+	ErrWrongName = repo.NewAuthError("blob was encrypted under another name")
+	// ErrUnsigned occurs if a blob isn't signed
+	ErrUnsigned = repo.NewAuthError("blob isn't signed")
+	// ErrUnknownSigner occurs if a blob was signed by a key that isn't in the public keyring
+	ErrUnknownSigner = repo.NewAuthError("blob was signed by a key that isn't in the public keyring")
+	// ErrNoSecretKeyMatch occurs if a blob was encrypted for none of the secret keys
+	ErrNoSecretKeyMatch = repo.NewAuthError("blob was encrypted for none of the secret keys")
+)
+
+type pgpBackend struct {
+	backend    repo.Backend
+	recipients openpgp.EntityList
+	secretKeys openpgp.EntityList
+	signer     *openpgp.Entity
+	keyRing    openpgp.EntityList
+}
+
+// NewPGPBackend returns a repo.Backend implementation that encrypts data to all
+// recipients and decrypts it using the (already decrypted) secret keys. Blobs
+// are signed with the first secret key, and only blobs signed by one of the
+// recipients are read.
+func NewPGPBackend(backend repo.Backend, recipients, secretKeys openpgp.EntityList) repo.Backend {
+	b := &pgpBackend{
+		backend:    backend,
+		recipients: recipients,
+		secretKeys: secretKeys,
+	}
+	for _, e := range secretKeys {
+		if e.PrivateKey != nil {
+			b.signer = e
+			break
+		}
+	}
+	// Signatures are checked against the keyring used for decryption as well
+	b.keyRing = append(append(openpgp.EntityList{}, secretKeys...), recipients...)
+	return b
+}
+
+// NewKeyRingBackend reads the recipients and secret keys from keyring files,
+// either armored or binary. The passphrase is used for encrypted private keys
+// and may be empty.
+func NewKeyRingBackend(backend repo.Backend, publicKeyRing, secretKeyRing, passphrase string) (repo.Backend, error) {
+	recipients, err := ReadKeyRing(publicKeyRing)
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, ErrNoRecipients
+	}
+
+	secretKeys, err := ReadKeyRing(secretKeyRing)
+	if err != nil {
+		return nil, err
+	}
+	hasPrivateKey := false
+	for _, e := range secretKeys {
+		if e.PrivateKey == nil {
+			continue
+		}
+		hasPrivateKey = true
+		if passphrase != "" {
+			if err := e.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+				return nil, err
+			}
+		}
+		if e.PrivateKey.Encrypted {
+			return nil, ErrEncryptedSecretKey
+		}
+	}
+	if !hasPrivateKey {
+		return nil, ErrNoSecretKeys
+	}
+
+	return NewPGPBackend(backend, recipients, secretKeys), nil
+}
+
+// ReadKeyRing reads an armored or binary keyring file
+func ReadKeyRing(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	start, err := r.Peek(5)
+	if err == nil && string(start) == "-----" {
+		return openpgp.ReadArmoredKeyRing(r)
+	}
+	return openpgp.ReadKeyRing(r)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// verifiedReader returns the result of the signature check at the end of the
+// message
+type verifiedReader struct {
+	md *openpgp.MessageDetails
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	n, err := v.md.UnverifiedBody.Read(p)
+	if err == io.EOF && v.md.SignatureError != nil {
+		return n, v.md.SignatureError
+	}
+	return n, err
+}
+
+func (b *pgpBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	encryptedRdr, err := b.backend.ReadBlob(name + ".pgp")
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := openpgp.ReadMessage(encryptedRdr, b.keyRing, nil, nil)
+	if err == pgperrors.ErrKeyIncorrect {
+		err = ErrNoSecretKeyMatch
+	}
+	if err == nil {
+		err = b.checkMessage(md, name)
+	}
+	if err != nil {
+		encryptedRdr.Close()
+		return nil, err
+	}
+	// The integrity of the message and the signature are checked once the body
+	// was read completely
+	return &readCloser{Reader: &verifiedReader{md: md}, Closer: encryptedRdr}, nil
+}
+
+// checkMessage makes sure a message was signed by one of the recipients and
+// encrypted under name, so that neither the storage nor anybody else knowing
+// the public keys can replace blobs
+func (b *pgpBackend) checkMessage(md *openpgp.MessageDetails, name string) error {
+	if !md.IsSigned {
+		return ErrUnsigned
+	}
+	if md.SignedBy == nil || len(b.recipients.KeysById(md.SignedByKeyId)) == 0 {
+		return ErrUnknownSigner
+	}
+	if md.SignatureError != nil {
+		return md.SignatureError
+	}
+	if md.LiteralData.FileName != name {
+		return ErrWrongName
+	}
+	return nil
+}
+
+func (b *pgpBackend) WriteBlob(name string, rdr io.Reader) error {
+	out := b.seal(name, rdr)
+	defer out.Close()
+	return b.backend.WriteBlob(name+".pgp", out)
+}
+
+func (b *pgpBackend) CreateBlob(name string, rdr io.Reader) error {
+	out := b.seal(name, rdr)
+	defer out.Close()
+	return b.backend.CreateBlob(name+".pgp", out)
+}
+
+func (b *pgpBackend) DeleteBlob(name string) error {
+	return repo.DeleteBlob(b.backend, name+".pgp")
+}
+
+// seal encrypts while the backend reads, so that blobs are never kept in
+// memory completely. Closing the returned reader stops the encryption.
+func (b *pgpBackend) seal(name string, rdr io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := openpgp.Encrypt(pw, b.recipients, b.signer, &openpgp.FileHints{IsBinary: true, FileName: name}, nil)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(w, rdr); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	return pr
+}
@@ -0,0 +1,249 @@
+package pgp_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lucas-clemente/git-cr/crypto/pgp"
+	"github.com/lucas-clemente/git-cr/git/repo"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestPGP(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "PGP Suite")
+}
+
+type fixtureBackend map[string][]byte
+
+func (f fixtureBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	data, ok := f[name]
+	if !ok {
+		return nil, repo.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
+}
+
+func (f fixtureBackend) WriteBlob(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f[name] = data
+	return nil
+}
+
+func (f fixtureBackend) CreateBlob(name string, r io.Reader) error {
+	if _, ok := f[name]; ok {
+		return repo.ErrExists
+	}
+	return f.WriteBlob(name, r)
+}
+
+func readBlob(b repo.Backend, name string) ([]byte, error) {
+	rdr, err := b.ReadBlob(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	return ioutil.ReadAll(rdr)
+}
+
+var config = &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+
+// encrypt writes a message like an attacker knowing the public keys could
+func encrypt(to openpgp.EntityList, signer *openpgp.Entity, name string, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, to, signer, &openpgp.FileHints{IsBinary: true, FileName: name}, nil)
+	Ω(err).ShouldNot(HaveOccurred())
+	_, err = w.Write(data)
+	Ω(err).ShouldNot(HaveOccurred())
+	Ω(w.Close()).Should(Succeed())
+	return buf.Bytes()
+}
+
+func newEntity(name string) *openpgp.Entity {
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", config)
+	Ω(err).ShouldNot(HaveOccurred())
+	return e
+}
+
+func writeKeyRing(path string, private bool, entities ...*openpgp.Entity) {
+	var buf bytes.Buffer
+	blockType := openpgp.PublicKeyType
+	if private {
+		blockType = openpgp.PrivateKeyType
+	}
+	w, err := armor.Encode(&buf, blockType, nil)
+	Ω(err).ShouldNot(HaveOccurred())
+	for _, e := range entities {
+		if private {
+			err = e.SerializePrivateWithoutSigning(w, nil)
+		} else {
+			err = e.Serialize(w)
+		}
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+	Ω(w.Close()).Should(Succeed())
+	Ω(ioutil.WriteFile(path, buf.Bytes(), 0600)).Should(Succeed())
+}
+
+var _ = Describe("PGP", func() {
+	var (
+		backend    fixtureBackend
+		tmpDir     string
+		alice, bob *openpgp.Entity
+	)
+
+	BeforeEach(func() {
+		var err error
+		backend = fixtureBackend{}
+		tmpDir, err = ioutil.TempDir("", "io.clemente.git-cr.test")
+		Ω(err).ShouldNot(HaveOccurred())
+		alice = newEntity("alice")
+		bob = newEntity("bob")
+		writeKeyRing(tmpDir+"/team.asc", false, alice, bob)
+		writeKeyRing(tmpDir+"/alice.asc", true, alice)
+		writeKeyRing(tmpDir+"/bob.asc", true, bob)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("reads and writes data", func() {
+		b, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/alice.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backend).Should(HaveKey("foo.pgp"))
+		Ω(readBlob(b, "foo")).Should(Equal([]byte("foobar")))
+	})
+
+	It("creates data only once", func() {
+		b, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/alice.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.CreateBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.CreateBlob("foo", bytes.NewBufferString("foobaz"))
+		Ω(err).Should(Equal(repo.ErrExists))
+	})
+
+	It("encrypts to all keys in the keyring", func() {
+		a, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/alice.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = a.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		b, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/bob.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readBlob(b, "foo")).Should(Equal([]byte("foobar")))
+	})
+
+	It("fails for keys not in the keyring", func() {
+		writeKeyRing(tmpDir+"/alice-only.asc", false, alice)
+		a, err := pgp.NewKeyRingBackend(backend, tmpDir+"/alice-only.asc", tmpDir+"/alice.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = a.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		b, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/bob.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = readBlob(b, "foo")
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("detects modified data", func() {
+		b, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/alice.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.WriteBlob("foo", bytes.NewReader(make([]byte, 1000)))
+		Ω(err).ShouldNot(HaveOccurred())
+		backend["foo.pgp"][len(backend["foo.pgp"])-30] ^= 1
+		_, err = readBlob(b, "foo")
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("binds blobs to their names", func() {
+		b, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/alice.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.WriteBlob("3.pack", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		backend["4.pack.pgp"] = backend["3.pack.pgp"]
+		_, err = readBlob(b, "4.pack")
+		Ω(err).Should(Equal(pgp.ErrWrongName))
+	})
+
+	It("rejects blobs without name", func() {
+		b, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/alice.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		backend["foo.pgp"] = encrypt(openpgp.EntityList{alice, bob}, alice, "", []byte("foobar"))
+		_, err = readBlob(b, "foo")
+		Ω(err).Should(Equal(pgp.ErrWrongName))
+	})
+
+	It("rejects unsigned blobs", func() {
+		b, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/alice.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		backend["foo.pgp"] = encrypt(openpgp.EntityList{alice, bob}, nil, "foo", []byte("forged"))
+		_, err = readBlob(b, "foo")
+		Ω(err).Should(Equal(pgp.ErrUnsigned))
+	})
+
+	It("rejects blobs signed by others", func() {
+		b, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/alice.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		backend["foo.pgp"] = encrypt(openpgp.EntityList{alice, bob}, newEntity("eve"), "foo", []byte("forged"))
+		_, err = readBlob(b, "foo")
+		Ω(err).Should(Equal(pgp.ErrUnknownSigner))
+	})
+
+	It("rejects blobs signed by former team members", func() {
+		a, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/alice.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = a.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		writeKeyRing(tmpDir+"/bob-only.asc", false, bob)
+		b, err := pgp.NewKeyRingBackend(backend, tmpDir+"/bob-only.asc", tmpDir+"/bob.asc", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = readBlob(b, "foo")
+		Ω(err).Should(Equal(pgp.ErrUnknownSigner))
+	})
+
+	It("decrypts private keys with the passphrase", func() {
+		Ω(alice.EncryptPrivateKeys([]byte("secret"), nil)).Should(Succeed())
+		writeKeyRing(tmpDir+"/alice.asc", true, alice)
+
+		_, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/alice.asc", "")
+		Ω(err).Should(Equal(pgp.ErrEncryptedSecretKey))
+
+		b, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/alice.asc", "secret")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = b.WriteBlob("foo", bytes.NewBufferString("foobar"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readBlob(b, "foo")).Should(Equal([]byte("foobar")))
+	})
+
+	It("requires private keys", func() {
+		_, err := pgp.NewKeyRingBackend(backend, tmpDir+"/team.asc", tmpDir+"/team.asc", "")
+		Ω(err).Should(Equal(pgp.ErrNoSecretKeys))
+	})
+
+	It("reads binary keyrings", func() {
+		var buf bytes.Buffer
+		Ω(alice.Serialize(&buf)).Should(Succeed())
+		Ω(ioutil.WriteFile(tmpDir+"/alice.gpg", buf.Bytes(), 0600)).Should(Succeed())
+		keys, err := pgp.ReadKeyRing(tmpDir + "/alice.gpg")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(keys).Should(HaveLen(1))
+	})
+})
@@ -4,6 +4,9 @@ package handler
 // Sending a `nil` does an ACK.
 type Encoder interface {
 	Encode([]byte) error
+
+	// EncodeResponseEnd ends a response of a stateless protocol v2 connection
+	EncodeResponseEnd() error
 }
 
 // Decoder is used to decode data using pkt-line
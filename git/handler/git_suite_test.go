@@ -22,43 +22,81 @@ func TestGitHandler(t *testing.T) {
 type FixtureRepo struct {
 	Revisions []repo.Revision
 	Packfiles [][]byte
+
+	// GetError is returned from GetRevisions if set
+	GetError error
+	// SaveError is returned from SaveNewRevision if set
+	SaveError error
+
+	TipPacks map[int][]byte
+	// PackReads counts the calls to ReadPackfile
+	PackReads int
 }
 
-var _ repo.Repo = &FixtureRepo{}
+var _ repo.TipRepo = &FixtureRepo{}
 
 // NewFixtureRepo makes a new fixture repo
 func NewFixtureRepo() *FixtureRepo {
-	return &FixtureRepo{}
+	return &FixtureRepo{TipPacks: map[int][]byte{}}
 }
 
 // GetRevisions implements repo.Repo
 func (r *FixtureRepo) GetRevisions() ([]repo.Revision, error) {
+	if r.GetError != nil {
+		return nil, r.GetError
+	}
 	return r.Revisions, nil
 }
 
 // SaveNewRevision implements repo.Repo
-func (r *FixtureRepo) SaveNewRevision(rev repo.Revision, packfile io.Reader) error {
-	r.Revisions = append(r.Revisions, rev)
+func (r *FixtureRepo) SaveNewRevision(index int, rev repo.Revision, packfile io.Reader) error {
+	if r.SaveError != nil {
+		return r.SaveError
+	}
+	if index != len(r.Revisions) {
+		return repo.ErrConflict
+	}
 	data, err := ioutil.ReadAll(packfile)
 	if err != nil {
 		return err
 	}
+	r.Revisions = append(r.Revisions, rev)
 	r.Packfiles = append(r.Packfiles, data)
 	return nil
 }
 
 // ReadPackfile implements repo.Repo
 func (r *FixtureRepo) ReadPackfile(toRev int) (io.ReadCloser, error) {
+	r.PackReads++
 	return ioutil.NopCloser(bytes.NewBuffer(r.Packfiles[toRev])), nil
 }
 
+// SaveTipPack implements repo.TipRepo
+func (r *FixtureRepo) SaveTipPack(index int, packfile io.Reader) error {
+	data, err := ioutil.ReadAll(packfile)
+	if err != nil {
+		return err
+	}
+	r.TipPacks[index] = data
+	return nil
+}
+
+// ReadTipPack implements repo.TipRepo
+func (r *FixtureRepo) ReadTipPack(index int) (io.ReadCloser, error) {
+	data, ok := r.TipPacks[index]
+	if !ok {
+		return nil, repo.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
+}
+
 // SaveNewRevisionB64 adds a base64-encoded packfile to the repo
 func (r *FixtureRepo) SaveNewRevisionB64(rev repo.Revision, b64 string) {
 	pack, err := base64.StdEncoding.DecodeString(b64)
 	if err != nil {
 		panic("invalid base64 in FixtureRepo.AddPackfile")
 	}
-	if err := r.SaveNewRevision(rev, bytes.NewBuffer(pack)); err != nil {
+	if err := r.SaveNewRevision(len(r.Revisions), rev, bytes.NewBuffer(pack)); err != nil {
 		panic(err)
 	}
 }
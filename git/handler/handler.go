@@ -3,16 +3,18 @@ package handler
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"strings"
 
 	"github.com/lucas-clemente/git-cr/git/repo"
 	"github.com/lucas-clemente/git-cr/git/merger"
+	"github.com/lucas-clemente/git-cr/git/shallow"
 )
 
-const pullCapabilities = "multi_ack_detailed side-band-64k thin-pack"
-const pushCapabilities = "delete-refs ofs-delta"
+const pullCapabilities = "multi_ack_detailed side-band-64k thin-pack shallow deepen-since deepen-not deepen-relative"
+const pushCapabilities = "report-status report-status-v2 delete-refs ofs-delta"
 
 var (
 	// ErrorInvalidHandshake occurs if the client presents an invalid handshake
@@ -27,6 +29,15 @@ var (
 	ErrorNoHead = errors.New("no HEAD in repo")
 )
 
+// A RejectedRefsError occurs if the client sent stale old IDs for some refs
+type RejectedRefsError struct {
+	Refs []string
+}
+
+func (e *RejectedRefsError) Error() string {
+	return "rejected " + strings.Join(e.Refs, ", ") + " (stale info), fetch and try again"
+}
+
 // A GitOperation can either be a pull or push
 type GitOperation int
 
@@ -43,6 +54,18 @@ type GitRequestHandler struct {
 	in  Decoder
 
 	repo repo.Repo
+
+	// clientCapabilities are the capabilities requested by the client
+	clientCapabilities map[string]bool
+	// protocolVersion is the version requested by the client, 0 if none
+	protocolVersion int
+	// stateless is set if each protocol v2 response has to be ended with a
+	// response end packet
+	stateless bool
+	// shallowRequest is set if the client is shallow or wants to be
+	shallowRequest *shallow.Request
+	// haves are the client's commits received during negotiation
+	haves []string
 }
 
 // A RefUpdate is a delta for a git reference
@@ -63,11 +86,19 @@ func NewGitRequestHandler(out Encoder, in Decoder, repo repo.Repo) *GitRequestHa
 func (h *GitRequestHandler) ServeRequest() error {
 	op, err := h.ReceiveHandshake()
 	if err != nil {
+		h.SendErrorLine(err)
 		return err
 	}
+	return h.ServeOperation(op)
+}
 
+// ServeOperation handles a single git request for transports that don't send
+// a handshake, e.g. the connect command of remote helpers
+func (h *GitRequestHandler) ServeOperation(op GitOperation) error {
 	revisions, err := h.repo.GetRevisions()
 	if err != nil {
+		// The client is waiting for the ref advertisement
+		h.SendErrorLine(err)
 		return err
 	}
 
@@ -79,7 +110,15 @@ func (h *GitRequestHandler) ServeRequest() error {
 		currentRev = revisions[currentRevIndex]
 	}
 
+	// Protocol v2 is only defined for fetches
+	if op == GitPull && h.protocolVersion == 2 {
+		return h.serveV2(revisions)
+	}
+
 	if err := h.SendRefs(currentRev, op); err != nil {
+		if err == ErrorNoHead {
+			h.SendErrorLine(err)
+		}
 		return err
 	}
 
@@ -94,26 +133,19 @@ func (h *GitRequestHandler) ServeRequest() error {
 			return nil
 		}
 
+		if h.shallowRequest != nil {
+			return h.serveShallowPull(revisions, wants)
+		}
+
 		fromRev, err := h.NegotiatePullPackfile(revisions)
 		if err != nil {
 			return err
 		}
 
-		packfiles := [][]byte{}
-		for i := fromRev; i <= currentRevIndex; i++ {
-			rdr, err := h.repo.ReadPackfile(i)
-			if err != nil {
-				return err
-			}
-			packfile, err := ioutil.ReadAll(rdr)
-			if err != nil {
-				return err
-			}
-			packfiles = append(packfiles, packfile)
-		}
-
-		packfile, err := merger.MergePackfiles(packfiles)
+		packfile, err := h.readPackfiles(fromRev, currentRevIndex, true)
 		if err != nil {
+			// The client only shows the side-band at this point
+			h.SendError(err)
 			return err
 		}
 
@@ -130,12 +162,109 @@ func (h *GitRequestHandler) ServeRequest() error {
 			return nil
 		}
 
+		return h.receivePush(refUpdates)
+	} else {
+		panic("unexpected git op")
+	}
+
+	return nil
+}
+
+// readPackfiles reads and merges the packfiles for the given range of
+// revisions, optionally telling the client about the progress
+func (h *GitRequestHandler) readPackfiles(from, to int, progress bool) ([]byte, error) {
+	sendProgress := func(msg string) {
+		if progress {
+			h.SendProgress(msg)
+		}
+	}
+
+	total := to - from + 1
+	packfiles := [][]byte{}
+	for i := from; i <= to; i++ {
+		done := i - from + 1
+		sendProgress(fmt.Sprintf("Downloading revisions: %3d%% (%d/%d)\r", done*100/total, done, total))
+		rdr, err := h.repo.ReadPackfile(i)
+		if err != nil {
+			return nil, err
+		}
+		packfile, err := ioutil.ReadAll(rdr)
+		rdr.Close()
+		if err != nil {
+			return nil, err
+		}
+		packfiles = append(packfiles, packfile)
+	}
+	sendProgress(fmt.Sprintf("Downloading revisions: 100%% (%d/%d), done.\n", total, total))
+
+	if len(packfiles) == 1 {
+		return packfiles[0], nil
+	}
+	sendProgress(fmt.Sprintf("Merging %d packs.\n", len(packfiles)))
+	return merger.MergePackfiles(packfiles)
+}
+
+// receivePush stores the packfile and applies the ref updates sent by the
+// client. If the client asked for report-status, rejected refs are only
+// reported to the client, while failures of the repo are also returned.
+func (h *GitRequestHandler) receivePush(refUpdates []RefUpdate) error {
+	// git doesn't send a packfile if all updates are deletes
+	var packfile io.Reader = bytes.NewReader(emptyPackfile)
+	for _, update := range refUpdates {
+		if update.NewID != "" {
+			packfile = readPackfile(h.in)
+			break
+		}
+	}
+
+	reportStatus := h.clientCapabilities["report-status"] || h.clientCapabilities["report-status-v2"]
+	reasons := map[string]string{}
+	fail := func(err error, unpacking bool) error {
+		// The client only reads our status once it sent the whole packfile
+		io.Copy(ioutil.Discard, packfile)
+		if reportStatus {
+			reason := err.Error()
+			var unpackErr error
+			if unpacking {
+				reason = "unpacker error"
+				unpackErr = err
+			}
+			for _, update := range refUpdates {
+				reasons[update.Name] = reason
+			}
+			h.SendReportStatus(unpackErr, refUpdates, reasons)
+		}
+		return err
+	}
+
+	// Someone else might have pushed while we were talking to the client
+	revisions, err := h.repo.GetRevisions()
+	if err != nil {
+		return fail(err, false)
+	}
+	currentRev := repo.Revision{}
+	if len(revisions) > 0 {
+		currentRev = revisions[len(revisions)-1]
+	}
+
+	accepted, rejected := h.CheckRefUpdates(currentRev, refUpdates)
+	var rejectedErr error
+	if len(rejected) != 0 {
+		names := make([]string, len(rejected))
+		for i, update := range rejected {
+			names[i] = update.Name
+			reasons[update.Name] = "stale info"
+		}
+		rejectedErr = &RejectedRefsError{Refs: names}
+	}
+
+	if len(accepted) != 0 {
 		newRevision := repo.Revision{}
 		for k, v := range currentRev {
 			newRevision[k] = v
 		}
 
-		for _, update := range refUpdates {
+		for _, update := range accepted {
 			if update.Name == "refs/heads/master" && update.NewID != "" {
 				newRevision["HEAD"] = update.NewID
 			}
@@ -146,34 +275,49 @@ func (h *GitRequestHandler) ServeRequest() error {
 			}
 		}
 
-		// Read packfile
-		packfile, err := ioutil.ReadAll(h.in)
-		if err != nil {
-			return err
-		}
-		if len(packfile) == 0 {
-			packfile = []byte{'P', 'A', 'C', 'K', 0, 0, 0, 2, 0, 0, 0, 0, 0x02, 0x9d, 0x08, 0x82, 0x3b, 0xd8, 0xa8, 0xea, 0xb5, 0x10, 0xad, 0x6a, 0xc7, 0x5c, 0x82, 0x3c, 0xfd, 0x3e, 0xd3, 0x1e}
+		err := h.repo.SaveNewRevision(len(revisions), newRevision, packfile)
+		if _, unpackErr := io.Copy(ioutil.Discard, packfile); unpackErr != nil {
+			return fail(unpackErr, true)
 		}
-
-		if err = h.repo.SaveNewRevision(newRevision, ioutil.NopCloser(bytes.NewBuffer(packfile))); err != nil {
-			return err
+		if err != nil {
+			if err == repo.ErrConflict {
+				for _, update := range accepted {
+					reasons[update.Name] = "fetch first"
+				}
+				rejectedErr = err
+			} else {
+				return fail(err, false)
+			}
+		} else if tips, ok := h.repo.(repo.TipRepo); ok {
+			// The revision is saved already. Without a tip pack, shallow
+			// fetches fall back to reading all packfiles.
+			h.saveTipPack(tips, len(revisions), newRevision)
 		}
-	} else {
-		panic("unexpected git op")
 	}
 
-	return nil
+	if _, err := io.Copy(ioutil.Discard, packfile); err != nil {
+		return fail(err, true)
+	}
+	if !reportStatus {
+		return rejectedErr
+	}
+	return h.SendReportStatus(nil, refUpdates, reasons)
 }
 
 // ReceiveHandshake reads repo and host info from the client
 func (h *GitRequestHandler) ReceiveHandshake() (GitOperation, error) {
-	// format: "git-[upload|receive]-pack repo-name\0host=host-name"
+	// format: "git-[upload|receive]-pack repo-name\0host=host-name\0\0extra-params\0"
 	var handshake []byte
 
 	if err := h.in.Decode(&handshake); err != nil {
 		return 0, err
 	}
 
+	params := bytes.Split(handshake, []byte{0})
+	for _, p := range params[1:] {
+		h.setExtraParameter(string(p))
+	}
+
 	if bytes.HasPrefix(handshake, []byte("git-upload-pack ")) {
 		return GitPull, nil
 	} else if bytes.HasPrefix(handshake, []byte("git-receive-pack ")) {
@@ -182,9 +326,32 @@ func (h *GitRequestHandler) ReceiveHandshake() (GitOperation, error) {
 	return 0, ErrorInvalidHandshake
 }
 
+// SetGitProtocol applies the extra parameters git passes in the GIT_PROTOCOL
+// environment variable when it doesn't send them in the handshake
+func (h *GitRequestHandler) SetGitProtocol(env string) {
+	for _, p := range strings.Split(env, ":") {
+		h.setExtraParameter(p)
+	}
+}
+
+func (h *GitRequestHandler) setExtraParameter(p string) {
+	switch p {
+	case "version=1":
+		h.protocolVersion = 1
+	case "version=2":
+		h.protocolVersion = 2
+	}
+}
+
 // SendRefs sends the given references to the client
 func (h *GitRequestHandler) SendRefs(refs map[string]string, op GitOperation) error {
 	if len(refs) == 0 {
+		if op == GitPush {
+			// Pushing into an empty repo still needs our capabilities
+			if err := h.out.Encode([]byte(nullID + " capabilities^{}\000" + pushCapabilities)); err != nil {
+				return err
+			}
+		}
 		return h.out.Encode(nil)
 	}
 
@@ -228,6 +395,12 @@ func (h *GitRequestHandler) ReceivePullWants() ([]string, error) {
 			break
 		}
 
+		if ok, err := h.receiveShallowLine(string(line)); err != nil {
+			return nil, err
+		} else if ok {
+			continue
+		}
+
 		if !bytes.HasPrefix(line, []byte("want ")) {
 			return nil, ErrorInvalidWantLine
 		}
@@ -235,6 +408,10 @@ func (h *GitRequestHandler) ReceivePullWants() ([]string, error) {
 		if len(line) < 45 {
 			return nil, ErrorInvalidWantLine
 		}
+		// The first want line carries the client's capabilities
+		if len(refs) == 0 {
+			h.setClientCapabilities(line[45:])
+		}
 		refs = append(refs, string(line[5:45]))
 	}
 	return refs, nil
@@ -289,6 +466,7 @@ func (h *GitRequestHandler) NegotiatePullPackfile(revisions []repo.Revision) (in
 			return 0, ErrorInvalidHaveLine
 		}
 		have := string(line[5:45])
+		h.haves = append(h.haves, have)
 
 		common := false
 
@@ -326,11 +504,13 @@ func (h *GitRequestHandler) NegotiatePullPackfile(revisions []repo.Revision) (in
 // SendPackfile sends a packfile using the side-band-64k encoding
 func (h *GitRequestHandler) SendPackfile(r io.Reader) error {
 	for {
-		line := make([]byte, 65519)
+		line := make([]byte, 65516)
 		line[0] = 1
 		n, err := r.Read(line[1:])
 		if n != 0 {
-			h.out.Encode(line[0 : n+1])
+			if err := h.out.Encode(line[0 : n+1]); err != nil {
+				return err
+			}
 		}
 		if err != nil {
 			if err == io.EOF {
@@ -342,6 +522,31 @@ func (h *GitRequestHandler) SendPackfile(r io.Reader) error {
 	return h.out.Encode(nil)
 }
 
+// SendProgress sends a progress message on side-band channel 2, unless the
+// client asked us to be quiet
+func (h *GitRequestHandler) SendProgress(msg string) error {
+	if !h.clientCapabilities["side-band-64k"] || h.clientCapabilities["no-progress"] {
+		return nil
+	}
+	return h.out.Encode(append([]byte{2}, msg...))
+}
+
+// SendError sends a fatal error on side-band channel 3, which makes the
+// client abort
+func (h *GitRequestHandler) SendError(err error) error {
+	if !h.clientCapabilities["side-band-64k"] {
+		return nil
+	}
+	return h.out.Encode(append([]byte{3}, err.Error()+"\n"...))
+}
+
+// SendErrorLine sends an ERR line, which makes the client abort with the
+// message while it waits for the ref advertisement. Errors at that point
+// would otherwise only show up as an unexpected hangup.
+func (h *GitRequestHandler) SendErrorLine(err error) error {
+	return h.out.Encode([]byte("ERR " + err.Error() + "\n"))
+}
+
 // ReceivePushRefs receives the references to be updates in a push from the client
 func (h *GitRequestHandler) ReceivePushRefs() ([]RefUpdate, error) {
 	var line []byte
@@ -355,16 +560,18 @@ func (h *GitRequestHandler) ReceivePushRefs() ([]RefUpdate, error) {
 			break
 		}
 
-		parts := bytes.Split(line, []byte(" "))
+		// The first line carries the client's capabilities after a NUL
+		if i := bytes.IndexByte(line, 0); i != -1 {
+			h.setClientCapabilities(line[i+1:])
+			line = line[:i]
+		}
+
+		parts := bytes.Split(bytes.TrimSpace(line), []byte(" "))
 		if len(parts) != 3 {
 			return nil, ErrorInvalidPushRefsLine
 		}
 
 		name := string(parts[2])
-		if name[len(name)-1] == 0 {
-			name = name[0 : len(name)-1]
-		}
-		name = strings.TrimSpace(name)
 		oldID := string(parts[0])
 		if isNullID(oldID) {
 			oldID = ""
@@ -379,6 +586,59 @@ func (h *GitRequestHandler) ReceivePushRefs() ([]RefUpdate, error) {
 	return refs, nil
 }
 
+// SendReportStatus tells the client about the result of a push. reasons maps
+// the names of rejected refs to a short explanation, all other refs are
+// reported as updated.
+func (h *GitRequestHandler) SendReportStatus(unpackErr error, updates []RefUpdate, reasons map[string]string) error {
+	unpackStatus := "ok"
+	if unpackErr != nil {
+		unpackStatus = oneLine(unpackErr.Error())
+	}
+	if err := h.out.Encode([]byte("unpack " + unpackStatus + "\n")); err != nil {
+		return err
+	}
+
+	for _, update := range updates {
+		status := "ok " + update.Name
+		if reason, ok := reasons[update.Name]; ok {
+			status = "ng " + update.Name + " " + oneLine(reason)
+		}
+		if err := h.out.Encode([]byte(status + "\n")); err != nil {
+			return err
+		}
+	}
+	return h.out.Encode(nil)
+}
+
+func (h *GitRequestHandler) setClientCapabilities(caps []byte) {
+	h.clientCapabilities = map[string]bool{}
+	for _, c := range strings.Fields(string(caps)) {
+		h.clientCapabilities[c] = true
+	}
+}
+
+func oneLine(s string) string {
+	return strings.Replace(strings.TrimSpace(s), "\n", " ", -1)
+}
+
+// CheckRefUpdates compares the old IDs sent by the client with the given
+// revision and splits the updates into accepted and rejected ones.
+// Fast-forward checks (and --force) are handled by git on the client side
+// against the refs we advertised, so this rejects updates based on refs that
+// were changed by someone else in the meantime.
+func (h *GitRequestHandler) CheckRefUpdates(rev repo.Revision, updates []RefUpdate) (accepted, rejected []RefUpdate) {
+	for _, update := range updates {
+		if rev[update.Name] == update.OldID {
+			accepted = append(accepted, update)
+		} else {
+			rejected = append(rejected, update)
+		}
+	}
+	return accepted, rejected
+}
+
+const nullID = "0000000000000000000000000000000000000000"
+
 func isNullID(id string) bool {
 	for _, c := range id {
 		if c != '0' {
@@ -2,6 +2,7 @@ package handler_test
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"math/rand"
 
@@ -14,6 +15,7 @@ import (
 
 type sampleDecoder struct {
 	data [][]byte
+	raw  bytes.Buffer
 }
 
 func (d *sampleDecoder) Decode(b *[]byte) error {
@@ -26,7 +28,7 @@ func (d *sampleDecoder) Decode(b *[]byte) error {
 }
 
 func (d *sampleDecoder) Read(p []byte) (int, error) {
-	panic("not implemented")
+	return d.raw.Read(p)
 }
 
 func (d *sampleDecoder) setData(data ...[]byte) {
@@ -42,6 +44,14 @@ func (d *sampleEncoder) Encode(b []byte) error {
 	return nil
 }
 
+// responseEnd is recorded for response end packets
+var responseEnd = []byte("response end")
+
+func (d *sampleEncoder) EncodeResponseEnd() error {
+	d.data = append(d.data, responseEnd)
+	return nil
+}
+
 var _ = Describe("git server", func() {
 	var (
 		decoder     *sampleDecoder
@@ -71,6 +81,25 @@ var _ = Describe("git server", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 			Ω(op).Should(Equal(handler.GitPush))
 		})
+
+		It("handles protocol v2 requests", func() {
+			fillRepo(fixtureRepo)
+			decoder.setData([]byte("git-upload-pack foo\000host=bar\000\000version=2\000"), nil)
+			Ω(gitHandler.ServeRequest()).ShouldNot(HaveOccurred())
+			Ω(encoder.data).Should(Equal([][]byte{
+				[]byte("version 2\n"),
+				[]byte("ls-refs\n"),
+				[]byte("fetch=shallow\n"),
+				nil,
+			}))
+		})
+
+		It("takes the protocol version from GIT_PROTOCOL", func() {
+			gitHandler.SetGitProtocol("version=2")
+			decoder.setData([]byte("git-upload-pack foo\000"), nil)
+			Ω(gitHandler.ServeRequest()).ShouldNot(HaveOccurred())
+			Ω(encoder.data[0]).Should(Equal([]byte("version 2\n")))
+		})
 	})
 
 	Context("sending refs", func() {
@@ -78,7 +107,7 @@ var _ = Describe("git server", func() {
 			refs := map[string]string{"HEAD": "bar", "foo": "bar"}
 			Ω(gitHandler.SendRefs(refs, handler.GitPull)).ShouldNot(HaveOccurred())
 			Ω(encoder.data).Should(HaveLen(3))
-			Ω(encoder.data[0]).Should(Equal([]byte("bar HEAD\000multi_ack_detailed side-band-64k thin-pack")))
+			Ω(encoder.data[0]).Should(Equal([]byte("bar HEAD\000multi_ack_detailed side-band-64k thin-pack shallow deepen-since deepen-not deepen-relative")))
 			Ω(encoder.data[1]).Should(Equal([]byte("bar foo")))
 			Ω(encoder.data[2]).Should(BeNil())
 		})
@@ -87,10 +116,39 @@ var _ = Describe("git server", func() {
 			refs := map[string]string{"HEAD": "bar", "foo": "bar"}
 			Ω(gitHandler.SendRefs(refs, handler.GitPush)).ShouldNot(HaveOccurred())
 			Ω(encoder.data).Should(HaveLen(3))
-			Ω(encoder.data[0]).Should(Equal([]byte("bar HEAD\000delete-refs ofs-delta")))
+			Ω(encoder.data[0]).Should(Equal([]byte("bar HEAD\000report-status report-status-v2 delete-refs ofs-delta")))
 			Ω(encoder.data[1]).Should(Equal([]byte("bar foo")))
 			Ω(encoder.data[2]).Should(BeNil())
 		})
+
+		It("sends capabilities for pushes into empty repos", func() {
+			Ω(gitHandler.SendRefs(map[string]string{}, handler.GitPush)).ShouldNot(HaveOccurred())
+			Ω(encoder.data).Should(HaveLen(2))
+			Ω(encoder.data[0]).Should(Equal([]byte("0000000000000000000000000000000000000000 capabilities^{}\000report-status report-status-v2 delete-refs ofs-delta")))
+			Ω(encoder.data[1]).Should(BeNil())
+		})
+	})
+
+	Context("failing before the ref advertisement", func() {
+		It("sends an ERR line if the repo can't be read", func() {
+			fixtureRepo.GetError = errors.New("rolled back")
+			decoder.setData([]byte("git-upload-pack /foo\000host=bar\000"))
+			Ω(gitHandler.ServeRequest()).Should(Equal(fixtureRepo.GetError))
+			Ω(encoder.data).Should(Equal([][]byte{[]byte("ERR rolled back\n")}))
+		})
+
+		It("sends an ERR line for repos without HEAD", func() {
+			fixtureRepo.Revisions = []repo.Revision{{"refs/heads/master": "bar"}}
+			Ω(gitHandler.ServeOperation(handler.GitPull)).Should(Equal(handler.ErrorNoHead))
+			Ω(encoder.data).Should(Equal([][]byte{[]byte("ERR no HEAD in repo\n")}))
+		})
+
+		It("sends an ERR line for invalid handshakes", func() {
+			decoder.setData([]byte("foo"))
+			Ω(gitHandler.ServeRequest()).Should(Equal(handler.ErrorInvalidHandshake))
+			Ω(encoder.data).Should(HaveLen(1))
+			Ω(encoder.data[0]).Should(HavePrefix("ERR "))
+		})
 	})
 
 	Context("reading pull wants", func() {
@@ -126,6 +184,41 @@ var _ = Describe("git server", func() {
 		})
 	})
 
+	Context("sending side-band messages", func() {
+		It("sends progress on channel 2", func() {
+			decoder.setData([]byte("want 30f79bec32243c31dd91a05c0ad7b80f1e301aea side-band-64k\n"), nil)
+			_, err := gitHandler.ReceivePullWants()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(gitHandler.SendProgress("foo\n")).ShouldNot(HaveOccurred())
+			Ω(encoder.data).Should(Equal([][]byte{[]byte("\002foo\n")}))
+		})
+
+		It("sends errors on channel 3", func() {
+			decoder.setData([]byte("want 30f79bec32243c31dd91a05c0ad7b80f1e301aea side-band-64k\n"), nil)
+			_, err := gitHandler.ReceivePullWants()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(gitHandler.SendError(errors.New("foo"))).ShouldNot(HaveOccurred())
+			Ω(encoder.data).Should(Equal([][]byte{[]byte("\003foo\n")}))
+		})
+
+		It("doesn't send progress with no-progress", func() {
+			decoder.setData([]byte("want 30f79bec32243c31dd91a05c0ad7b80f1e301aea side-band-64k no-progress\n"), nil)
+			_, err := gitHandler.ReceivePullWants()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(gitHandler.SendProgress("foo\n")).ShouldNot(HaveOccurred())
+			Ω(encoder.data).Should(BeEmpty())
+		})
+
+		It("doesn't send anything without side-band", func() {
+			decoder.setData([]byte("want 30f79bec32243c31dd91a05c0ad7b80f1e301aea\n"), nil)
+			_, err := gitHandler.ReceivePullWants()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(gitHandler.SendProgress("foo\n")).ShouldNot(HaveOccurred())
+			Ω(gitHandler.SendError(errors.New("foo"))).ShouldNot(HaveOccurred())
+			Ω(encoder.data).Should(BeEmpty())
+		})
+	})
+
 	Context("negotiating packfiles", func() {
 		It("handles full deltas", func() {
 			revisions := []repo.Revision{
@@ -267,7 +360,7 @@ var _ = Describe("git server", func() {
 		})
 
 		It("sends long packfiles", func() {
-			data := make([]byte, 65518+1)
+			data := make([]byte, 65515+1)
 			src := rand.NewSource(42)
 			for i := range data {
 				data[i] = byte(src.Int63())
@@ -276,10 +369,10 @@ var _ = Describe("git server", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 			Ω(encoder.data).Should(HaveLen(3))
 			Ω(encoder.data[0][0]).Should(Equal(byte(1)))
-			Ω(encoder.data[0][1:]).Should(HaveLen(65518))
-			Ω(bytes.Equal(encoder.data[0][1:], data[0:65518])).Should(BeTrue())
+			Ω(encoder.data[0][1:]).Should(HaveLen(65515))
+			Ω(bytes.Equal(encoder.data[0][1:], data[0:65515])).Should(BeTrue())
 			Ω(encoder.data[1][0]).Should(Equal(byte(1)))
-			Ω(encoder.data[1][1]).Should(Equal(data[65518]))
+			Ω(encoder.data[1][1]).Should(Equal(data[65515]))
 			Ω(encoder.data[2]).Should(BeNil())
 		})
 	})
@@ -329,4 +422,249 @@ var _ = Describe("git server", func() {
 			}}))
 		})
 	})
+
+	Context("checking ref updates", func() {
+		rev := repo.Revision{
+			"HEAD":              "f84b0d7375bcb16dd2742344e6af173aeebfcfd6",
+			"refs/heads/master": "f84b0d7375bcb16dd2742344e6af173aeebfcfd6",
+		}
+
+		It("accepts updates of the current state", func() {
+			updates := []handler.RefUpdate{
+				{Name: "refs/heads/master", OldID: "f84b0d7375bcb16dd2742344e6af173aeebfcfd6", NewID: "1a6d946069d483225913cf3b8ba8eae4c894c322"},
+				{Name: "refs/heads/foo", OldID: "", NewID: "1a6d946069d483225913cf3b8ba8eae4c894c322"},
+			}
+			accepted, rejected := gitHandler.CheckRefUpdates(rev, updates)
+			Ω(accepted).Should(Equal(updates))
+			Ω(rejected).Should(BeEmpty())
+		})
+
+		It("rejects updates with stale old IDs", func() {
+			updates := []handler.RefUpdate{
+				{Name: "refs/heads/master", OldID: "30f79bec32243c31dd91a05c0ad7b80f1e301aea", NewID: "1a6d946069d483225913cf3b8ba8eae4c894c322"},
+				{Name: "refs/heads/foo", OldID: "", NewID: "1a6d946069d483225913cf3b8ba8eae4c894c322"},
+			}
+			accepted, rejected := gitHandler.CheckRefUpdates(rev, updates)
+			Ω(accepted).Should(Equal(updates[1:]))
+			Ω(rejected).Should(Equal(updates[:1]))
+		})
+
+		It("rejects creating refs that already exist", func() {
+			updates := []handler.RefUpdate{
+				{Name: "refs/heads/master", OldID: "", NewID: "1a6d946069d483225913cf3b8ba8eae4c894c322"},
+			}
+			accepted, rejected := gitHandler.CheckRefUpdates(rev, updates)
+			Ω(accepted).Should(BeEmpty())
+			Ω(rejected).Should(Equal(updates))
+		})
+
+		It("rejects deleting refs that changed", func() {
+			updates := []handler.RefUpdate{
+				{Name: "refs/heads/master", OldID: "30f79bec32243c31dd91a05c0ad7b80f1e301aea", NewID: ""},
+			}
+			_, rejected := gitHandler.CheckRefUpdates(rev, updates)
+			Ω(rejected).Should(Equal(updates))
+		})
+	})
+
+	Context("reporting push status", func() {
+		const (
+			oldID = "f84b0d7375bcb16dd2742344e6af173aeebfcfd6"
+			newID = "1a6d946069d483225913cf3b8ba8eae4c894c322"
+		)
+
+		BeforeEach(func() {
+			fillRepo(fixtureRepo)
+		})
+
+		push := func(lines ...string) {
+			data := [][]byte{[]byte("git-receive-pack /foo\000")}
+			for _, l := range lines {
+				data = append(data, []byte(l))
+			}
+			decoder.setData(append(data, nil)...)
+		}
+
+		It("reports updated refs", func() {
+			push(oldID+" "+newID+" refs/heads/master\000report-status",
+				"0000000000000000000000000000000000000000 "+newID+" refs/heads/foo\n")
+			decoder.raw.Write(fixtureRepo.Packfiles[0])
+			Ω(gitHandler.ServeRequest()).ShouldNot(HaveOccurred())
+			Ω(fixtureRepo.Revisions).Should(HaveLen(2))
+			Ω(encoder.data[len(encoder.data)-4:]).Should(Equal([][]byte{
+				[]byte("unpack ok\n"),
+				[]byte("ok refs/heads/master\n"),
+				[]byte("ok refs/heads/foo\n"),
+				nil,
+			}))
+		})
+
+		It("reports deletes without reading a packfile", func() {
+			push(oldID + " 0000000000000000000000000000000000000000 refs/heads/master\000report-status-v2")
+			Ω(gitHandler.ServeRequest()).ShouldNot(HaveOccurred())
+			Ω(fixtureRepo.Revisions).Should(HaveLen(2))
+			Ω(encoder.data[len(encoder.data)-3:]).Should(Equal([][]byte{
+				[]byte("unpack ok\n"),
+				[]byte("ok refs/heads/master\n"),
+				nil,
+			}))
+		})
+
+		It("reports stale refs", func() {
+			push("30f79bec32243c31dd91a05c0ad7b80f1e301aea "+newID+" refs/heads/master\000report-status",
+				"0000000000000000000000000000000000000000 "+newID+" refs/heads/foo")
+			decoder.raw.Write(fixtureRepo.Packfiles[0])
+			Ω(gitHandler.ServeRequest()).ShouldNot(HaveOccurred())
+			Ω(fixtureRepo.Revisions).Should(HaveLen(2))
+			Ω(fixtureRepo.Revisions[1]).Should(HaveKeyWithValue("refs/heads/master", oldID))
+			Ω(encoder.data[len(encoder.data)-4:]).Should(Equal([][]byte{
+				[]byte("unpack ok\n"),
+				[]byte("ng refs/heads/master stale info\n"),
+				[]byte("ok refs/heads/foo\n"),
+				nil,
+			}))
+		})
+
+		It("reports failures of the repo", func() {
+			fixtureRepo.SaveError = errors.New("disk\nfull")
+			push(oldID + " " + newID + " refs/heads/master\000report-status")
+			decoder.raw.Write(fixtureRepo.Packfiles[0])
+			Ω(gitHandler.ServeRequest()).Should(Equal(fixtureRepo.SaveError))
+			Ω(encoder.data[len(encoder.data)-3:]).Should(Equal([][]byte{
+				[]byte("unpack ok\n"),
+				[]byte("ng refs/heads/master disk full\n"),
+				nil,
+			}))
+		})
+
+		It("reports invalid packfiles", func() {
+			push(oldID + " " + newID + " refs/heads/master\000report-status")
+			decoder.raw.WriteString("PACK garbage")
+			Ω(gitHandler.ServeRequest()).Should(HaveOccurred())
+			Ω(fixtureRepo.Revisions).Should(HaveLen(1))
+			Ω(encoder.data[len(encoder.data)-3]).Should(HavePrefix("unpack "))
+			Ω(encoder.data[len(encoder.data)-2:]).Should(Equal([][]byte{
+				[]byte("ng refs/heads/master unpacker error\n"),
+				nil,
+			}))
+		})
+
+		It("returns rejections without report-status", func() {
+			push("30f79bec32243c31dd91a05c0ad7b80f1e301aea " + newID + " refs/heads/master\000")
+			decoder.raw.Write(fixtureRepo.Packfiles[0])
+			err := gitHandler.ServeRequest()
+			Ω(err).Should(BeAssignableToTypeOf(&handler.RejectedRefsError{}))
+			Ω(encoder.data[len(encoder.data)-1]).Should(BeNil())
+		})
+	})
+
+	Context("protocol v2", func() {
+		const (
+			id1 = "f84b0d7375bcb16dd2742344e6af173aeebfcfd6"
+			id2 = "1a6d946069d483225913cf3b8ba8eae4c894c322"
+		)
+
+		It("receives commands", func() {
+			decoder.setData(
+				[]byte("command=ls-refs\n"),
+				[]byte("agent=git/2.39\n"),
+				[]byte{},
+				[]byte("peel\n"),
+				[]byte("ref-prefix HEAD\n"),
+				nil,
+			)
+			command, err := gitHandler.ReceiveV2Command()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command).Should(Equal(&handler.V2Command{
+				Name:         "ls-refs",
+				Capabilities: []string{"agent=git/2.39"},
+				Args:         []string{"peel", "ref-prefix HEAD"},
+			}))
+		})
+
+		It("rejects invalid commands", func() {
+			decoder.setData([]byte("foo\n"))
+			_, err := gitHandler.ReceiveV2Command()
+			Ω(err).Should(Equal(handler.ErrorInvalidCommand))
+		})
+
+		It("lists refs", func() {
+			refs := repo.Revision{"HEAD": id1, "refs/heads/master": id1, "refs/heads/foo": id2, "refs/tags/v1": id2}
+			Ω(gitHandler.LsRefs(refs, nil)).ShouldNot(HaveOccurred())
+			Ω(encoder.data).Should(Equal([][]byte{
+				[]byte(id1 + " HEAD\n"),
+				[]byte(id2 + " refs/heads/foo\n"),
+				[]byte(id1 + " refs/heads/master\n"),
+				[]byte(id2 + " refs/tags/v1\n"),
+				nil,
+			}))
+		})
+
+		It("filters refs by prefix", func() {
+			refs := repo.Revision{"HEAD": id1, "refs/heads/master": id1, "refs/heads/foo": id2, "refs/tags/v1": id2}
+			Ω(gitHandler.LsRefs(refs, []string{"symrefs", "ref-prefix HEAD", "ref-prefix refs/tags/"})).ShouldNot(HaveOccurred())
+			Ω(encoder.data).Should(Equal([][]byte{
+				[]byte(id1 + " HEAD\n"),
+				[]byte(id2 + " refs/tags/v1\n"),
+				nil,
+			}))
+		})
+
+		It("acknowledges common haves", func() {
+			fillRepo(fixtureRepo)
+			fixtureRepo.SaveNewRevisionB64(repo.Revision{"HEAD": id1, "refs/heads/master": id1, "refs/heads/foo": id2}, "UEFDSwAAAAIAAAAAAp0IgjvYqOq1EK1qx1yCPP0+0x4=")
+			Ω(gitHandler.Fetch(fixtureRepo.Revisions, []string{"want " + id2, "have " + id2, "have 30f79bec32243c31dd91a05c0ad7b80f1e301aea"})).ShouldNot(HaveOccurred())
+			Ω(encoder.data).Should(Equal([][]byte{
+				[]byte("acknowledgments\n"),
+				[]byte("ACK " + id2 + "\n"),
+				nil,
+			}))
+		})
+
+		It("sends NAK without common haves", func() {
+			fillRepo(fixtureRepo)
+			Ω(gitHandler.Fetch(fixtureRepo.Revisions, []string{"want " + id1, "have 30f79bec32243c31dd91a05c0ad7b80f1e301aea"})).ShouldNot(HaveOccurred())
+			Ω(encoder.data).Should(Equal([][]byte{
+				[]byte("acknowledgments\n"),
+				[]byte("NAK\n"),
+				nil,
+			}))
+		})
+
+		It("sends the packfile once a revision is complete", func() {
+			fillRepo(fixtureRepo)
+			fixtureRepo.SaveNewRevisionB64(repo.Revision{"HEAD": id1, "refs/heads/master": id1, "refs/heads/foo": id2}, "UEFDSwAAAAIAAAAAAp0IgjvYqOq1EK1qx1yCPP0+0x4=")
+			Ω(gitHandler.Fetch(fixtureRepo.Revisions, []string{"want " + id2, "have " + id1, "no-progress"})).ShouldNot(HaveOccurred())
+			Ω(encoder.data).Should(HaveLen(7))
+			Ω(encoder.data[:5]).Should(Equal([][]byte{
+				[]byte("acknowledgments\n"),
+				[]byte("ACK " + id1 + "\n"),
+				[]byte("ready\n"),
+				[]byte{},
+				[]byte("packfile\n"),
+			}))
+			Ω(encoder.data[5][0]).Should(Equal(byte(1)))
+			Ω(encoder.data[6]).Should(BeNil())
+		})
+
+		It("sends the packfile when the client is done", func() {
+			fillRepo(fixtureRepo)
+			Ω(gitHandler.Fetch(fixtureRepo.Revisions, []string{"want " + id1, "done"})).ShouldNot(HaveOccurred())
+			Ω(encoder.data[0]).Should(Equal([]byte("packfile\n")))
+			Ω(encoder.data[len(encoder.data)-2]).Should(Equal(append([]byte{1}, fixtureRepo.Packfiles[0]...)))
+			Ω(encoder.data[len(encoder.data)-1]).Should(BeNil())
+		})
+
+		It("ends responses of stateless connections", func() {
+			fillRepo(fixtureRepo)
+			decoder.setData([]byte("command=ls-refs\n"), []byte{}, []byte("ref-prefix refs/heads/\n"), nil)
+			Ω(gitHandler.ServeStatelessV2()).ShouldNot(HaveOccurred())
+			Ω(encoder.data[0]).Should(Equal([]byte("version 2\n")))
+			Ω(encoder.data[len(encoder.data)-2:]).Should(Equal([][]byte{nil, responseEnd}))
+		})
+
+		It("errors without wants", func() {
+			Ω(gitHandler.Fetch(fixtureRepo.Revisions, []string{"done"})).Should(Equal(handler.ErrorNoWants))
+		})
+	})
 })
@@ -1,6 +1,7 @@
 package handler_test
 
 import (
+	"crypto/rand"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,8 +11,8 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/bargez/pktline"
 	"github.com/lucas-clemente/git-cr/git/handler"
+	"github.com/lucas-clemente/git-cr/git/pktline"
 	"github.com/lucas-clemente/git-cr/git/repo"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -128,6 +129,37 @@ var _ = Describe("integration with git", func() {
 			)
 			runCommandInDir(tempDir, "git", "clone", "git://localhost:"+port+"/fixtureRepo", ".")
 		})
+
+		It("clones using protocol v0", func() {
+			fillRepo(fixtureRepo)
+			runCommandInDir(tempDir, "git", "-c", "protocol.version=0", "clone", "git://localhost:"+port+"/fixtureRepo", ".")
+			contents, err := ioutil.ReadFile(tempDir + "/foo")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal([]byte("bar\n")))
+		})
+
+		It("clones using protocol v2", func() {
+			fillRepo(fixtureRepo)
+			cmd := exec.Command("git", "-c", "protocol.version=2", "clone", "git://localhost:"+port+"/fixtureRepo", ".")
+			cmd.Dir = tempDir
+			cmd.Env = append(os.Environ(), "GIT_TRACE_PACKET=1")
+			out, err := cmd.CombinedOutput()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(out)).Should(ContainSubstring("< version 2"))
+			Ω(string(out)).Should(ContainSubstring("> command=ls-refs"))
+			contents, err := ioutil.ReadFile(tempDir + "/foo")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal([]byte("bar\n")))
+		})
+
+		It("shows progress", func() {
+			fillRepo(fixtureRepo)
+			cmd := exec.Command("git", "clone", "--progress", "git://localhost:"+port+"/fixtureRepo", ".")
+			cmd.Dir = tempDir
+			out, err := cmd.CombinedOutput()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(out)).Should(ContainSubstring("remote: Downloading revisions: 100% (1/1), done."))
+		})
 	})
 
 	Context("pulling", func() {
@@ -201,6 +233,25 @@ var _ = Describe("integration with git", func() {
 			}))
 		})
 
+		It("pushes packfiles larger than the handler's buffer", func() {
+			data := make([]byte, 200000)
+			_, err := rand.Read(data)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.WriteFile(tempDir+"/large", data, 0644)).Should(Succeed())
+			runCommandInDir(tempDir, "git", "add", "large")
+			configGit(tempDir)
+			runCommandInDir(tempDir, "git", "commit", "--message=msg")
+			runCommandInDir(tempDir, "git", "push")
+
+			tempDir2, err := ioutil.TempDir("", "io.clemente.git-cr.test")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(tempDir2)
+			runCommandInDir(tempDir2, "git", "clone", "git://localhost:"+port+"/fixtureRepo", ".")
+			contents, err := ioutil.ReadFile(tempDir2 + "/large")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal(data))
+		})
+
 		It("pushes new branches", func() {
 			// Push
 			runCommandInDir(tempDir, "git", "push", "origin", "master:foobar")
@@ -314,4 +365,103 @@ var _ = Describe("integration with git", func() {
 			Ω(contents).Should(Equal([]byte("foobar")))
 		})
 	})
+
+	Context("shallow clones", func() {
+		var cloneDir string
+
+		commitCount := func(dir string) string {
+			cmd := exec.Command("git", "rev-list", "--count", "HEAD")
+			cmd.Dir = dir
+			out, err := cmd.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+			return strings.TrimSpace(string(out))
+		}
+
+		BeforeEach(func() {
+			// Push three commits in separate revisions
+			runCommandInDir(tempDir, "git", "init")
+			configGit(tempDir)
+			runCommandInDir(tempDir, "git", "remote", "add", "origin", "git://localhost:"+port+"/fixtureRepo")
+			for i, date := range []string{"1400000000", "1500000000", "1600000000"} {
+				err := ioutil.WriteFile(tempDir+"/foo", []byte{byte('a' + i)}, 0644)
+				Ω(err).ShouldNot(HaveOccurred())
+				runCommandInDir(tempDir, "git", "add", "foo")
+				cmd := exec.Command("git", "commit", "-m", "msg")
+				cmd.Dir = tempDir
+				cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE="+date+" +0000", "GIT_AUTHOR_DATE="+date+" +0000")
+				Ω(cmd.Run()).ShouldNot(HaveOccurred())
+				runCommandInDir(tempDir, "git", "push", "origin", "master")
+				if i == 0 {
+					runCommandInDir(tempDir, "git", "tag", "first")
+					runCommandInDir(tempDir, "git", "push", "origin", "first")
+				}
+			}
+
+			var err error
+			cloneDir, err = ioutil.TempDir("", "io.clemente.git-cr.test")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(cloneDir)
+		})
+
+		for _, version := range []string{"0", "2"} {
+			version := version
+
+			It("clones with depth using protocol v"+version, func() {
+				runCommandInDir(cloneDir, "git", "-c", "protocol.version="+version, "clone", "--depth", "1", "git://localhost:"+port+"/fixtureRepo", ".")
+				Ω(commitCount(cloneDir)).Should(Equal("1"))
+				contents, err := ioutil.ReadFile(cloneDir + "/foo")
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(contents).Should(Equal([]byte("c")))
+
+				runCommandInDir(cloneDir, "git", "-c", "protocol.version="+version, "fetch", "--deepen", "1")
+				runCommandInDir(cloneDir, "git", "reset", "--hard", "origin/master")
+				Ω(commitCount(cloneDir)).Should(Equal("2"))
+
+				runCommandInDir(cloneDir, "git", "-c", "protocol.version="+version, "fetch", "--unshallow")
+				Ω(commitCount(cloneDir)).Should(Equal("3"))
+				_, err = os.Stat(cloneDir + "/.git/shallow")
+				Ω(os.IsNotExist(err)).Should(BeTrue())
+			})
+
+			It("clones with depth 1 from the tip pack using protocol v"+version, func() {
+				mutex.Lock()
+				Ω(fixtureRepo.TipPacks).Should(HaveKey(len(fixtureRepo.Revisions) - 1))
+				// Each push only read its own packfile
+				Ω(fixtureRepo.PackReads).Should(Equal(len(fixtureRepo.Revisions)))
+				fixtureRepo.PackReads = 0
+				mutex.Unlock()
+
+				runCommandInDir(cloneDir, "git", "-c", "protocol.version="+version, "clone", "--depth", "1", "git://localhost:"+port+"/fixtureRepo", ".")
+				Ω(commitCount(cloneDir)).Should(Equal("1"))
+				mutex.Lock()
+				Ω(fixtureRepo.PackReads).Should(BeZero())
+				mutex.Unlock()
+			})
+
+			It("clones with depth 1 from all packfiles without tip pack using protocol v"+version, func() {
+				mutex.Lock()
+				fixtureRepo.TipPacks = map[int][]byte{}
+				mutex.Unlock()
+
+				runCommandInDir(cloneDir, "git", "-c", "protocol.version="+version, "clone", "--depth", "1", "git://localhost:"+port+"/fixtureRepo", ".")
+				Ω(commitCount(cloneDir)).Should(Equal("1"))
+				contents, err := ioutil.ReadFile(cloneDir + "/foo")
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(contents).Should(Equal([]byte("c")))
+			})
+
+			It("clones since a date using protocol v"+version, func() {
+				runCommandInDir(cloneDir, "git", "-c", "protocol.version="+version, "clone", "--shallow-since", "1450000000", "git://localhost:"+port+"/fixtureRepo", ".")
+				Ω(commitCount(cloneDir)).Should(Equal("2"))
+			})
+
+			It("clones excluding refs using protocol v"+version, func() {
+				runCommandInDir(cloneDir, "git", "-c", "protocol.version="+version, "clone", "--shallow-exclude", "first", "git://localhost:"+port+"/fixtureRepo", ".")
+				Ω(commitCount(cloneDir)).Should(Equal("2"))
+			})
+		}
+	})
 })
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+// ErrorInvalidPackfile occurs if the client sends a malformed packfile
+var ErrorInvalidPackfile = errors.New("invalid packfile sent by client")
+
+const (
+	objectOfsDelta = 6
+	objectRefDelta = 7
+)
+
+// emptyPackfile is a packfile without any objects
+var emptyPackfile = []byte{'P', 'A', 'C', 'K', 0, 0, 0, 2, 0, 0, 0, 0, 0x02, 0x9d, 0x08, 0x82, 0x3b, 0xd8, 0xa8, 0xea, 0xb5, 0x10, 0xad, 0x6a, 0xc7, 0x5c, 0x82, 0x3c, 0xfd, 0x3e, 0xd3, 0x1e}
+
+// recordingBufferSize is how much of the packfile is buffered before it's
+// passed on
+const recordingBufferSize = 32 * 1024
+
+// recordingReader passes everything that was consumed from it on to out, and
+// hashes it
+type recordingReader struct {
+	r    *bufio.Reader
+	out  io.Writer
+	hash hash.Hash
+	buf  []byte
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if werr := r.record(p[:n]); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+func (r *recordingReader) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err != nil {
+		return c, err
+	}
+	return c, r.record([]byte{c})
+}
+
+func (r *recordingReader) record(p []byte) error {
+	r.hash.Write(p)
+	r.buf = append(r.buf, p...)
+	if len(r.buf) < recordingBufferSize {
+		return nil
+	}
+	return r.flush()
+}
+
+func (r *recordingReader) flush() error {
+	_, err := r.out.Write(r.buf)
+	r.buf = r.buf[:0]
+	return err
+}
+
+// readPackfile returns a reader for a single packfile from in. Since the
+// client waits for our status report afterwards, we can't read until EOF and
+// need to walk the objects to find the end of the packfile instead. The
+// objects are walked while the packfile is read, so it's never kept in memory
+// completely. If the packfile is invalid, Read fails before io.EOF. The
+// packfile has to be read until the end, even if it isn't needed.
+func readPackfile(in io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(walkPackfile(in, pw))
+	}()
+	return pr
+}
+
+// walkPackfile copies a single packfile from in to out
+func walkPackfile(in io.Reader, out io.Writer) error {
+	r := &recordingReader{r: bufio.NewReader(in), out: out, hash: sha1.New(), buf: make([]byte, 0, recordingBufferSize)}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[0:4], []byte("PACK")) || binary.BigEndian.Uint32(header[4:8]) != 2 {
+		return ErrorInvalidPackfile
+	}
+	count := binary.BigEndian.Uint32(header[8:12])
+
+	for i := uint32(0); i < count; i++ {
+		// Type and size, the size is not needed since the data is zlib-compressed
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		objectType := (c >> 4) & 7
+		for c&0x80 != 0 {
+			if c, err = r.ReadByte(); err != nil {
+				return err
+			}
+		}
+
+		switch objectType {
+		case objectOfsDelta:
+			for {
+				if c, err = r.ReadByte(); err != nil {
+					return err
+				}
+				if c&0x80 == 0 {
+					break
+				}
+			}
+		case objectRefDelta:
+			if _, err := io.ReadFull(r, make([]byte, sha1.Size)); err != nil {
+				return err
+			}
+		}
+
+		// zlib only reads as much as it needs from an io.ByteReader
+		z, err := zlib.NewReader(r)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, z); err != nil {
+			return err
+		}
+		if err := z.Close(); err != nil {
+			return err
+		}
+	}
+
+	expected := r.hash.Sum(nil)
+	checksum := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r.r, checksum); err != nil {
+		return err
+	}
+	if !bytes.Equal(expected, checksum) {
+		return ErrorInvalidPackfile
+	}
+	r.buf = append(r.buf, checksum...)
+	return r.flush()
+}
@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucas-clemente/git-cr/git/repo"
+	"github.com/lucas-clemente/git-cr/git/shallow"
+)
+
+var (
+	// ErrorInvalidShallowLine occurs if the client sends an invalid shallow or deepen line
+	ErrorInvalidShallowLine = errors.New("invalid `shallow` or `deepen` line sent by client")
+	// ErrorUnknownDeepenNot occurs if the client sends deepen-not for an unknown ref
+	ErrorUnknownDeepenNot = errors.New("unknown ref in `deepen-not` sent by client")
+)
+
+// receiveShallowLine records shallow and deepen lines sent along with the
+// wants. It returns false if the line is none of those.
+func (h *GitRequestHandler) receiveShallowLine(line string) (bool, error) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	if len(fields) == 1 {
+		fields = append(fields, "")
+	}
+
+	req := h.shallowRequest
+	if req == nil {
+		req = &shallow.Request{}
+	}
+	switch fields[0] {
+	case "deepen-relative":
+		req.Relative = true
+	case "shallow":
+		req.ClientShallows = append(req.ClientShallows, fields[1])
+	case "deepen":
+		depth, err := strconv.Atoi(fields[1])
+		if err != nil || depth <= 0 {
+			return false, ErrorInvalidShallowLine
+		}
+		req.Depth = depth
+	case "deepen-since":
+		since, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return false, ErrorInvalidShallowLine
+		}
+		req.Since = time.Unix(since, 0)
+	case "deepen-not":
+		req.Not = append(req.Not, fields[1])
+	default:
+		return false, nil
+	}
+	h.shallowRequest = req
+	return true, nil
+}
+
+// cutHistory calculates where the client's history ends. If the client only
+// wants the current tips, the newest revision's tip pack is enough. Otherwise
+// all packfiles are read into a temporary repo, since the packs are thin and
+// the newest trees still reference objects from the first revisions. Since
+// this happens before the packfile is sent, no progress can be shown.
+func (h *GitRequestHandler) cutHistory(revisions []repo.Revision, wants []string) (*shallow.Repo, *shallow.Cut, error) {
+	currentRev := repo.Revision{}
+	if len(revisions) > 0 {
+		currentRev = revisions[len(revisions)-1]
+	}
+
+	req := *h.shallowRequest
+	// Protocol v0 sends deepen-relative as capability
+	if h.clientCapabilities["deepen-relative"] {
+		req.Relative = true
+	}
+	req.Not = make([]string, len(h.shallowRequest.Not))
+	for i, name := range h.shallowRequest.Not {
+		id, ok := resolveRef(currentRev, name)
+		if !ok {
+			return nil, nil, ErrorUnknownDeepenNot
+		}
+		req.Not[i] = id
+	}
+
+	if tips, ok := h.repo.(repo.TipRepo); ok && req.OnlyTips() && isTip(currentRev, wants) {
+		// Revisions pushed by earlier versions have no tip pack
+		if r, cut, err := cutTips(tips, len(revisions)-1, wants); err == nil {
+			return r, cut, nil
+		}
+	}
+
+	packfile, err := h.readPackfiles(0, len(revisions)-1, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := shallow.NewRepo(packfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cut, err := r.Cut(wants, &req)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return r, cut, nil
+}
+
+// isTip returns whether all wants are refs of the revision
+func isTip(rev repo.Revision, wants []string) bool {
+	tips := map[string]bool{}
+	for _, id := range rev {
+		tips[id] = true
+	}
+	for _, w := range wants {
+		if !tips[w] {
+			return false
+		}
+	}
+	return len(wants) > 0
+}
+
+// cutTips cuts the history at the wants, using only a revision's tip pack
+func cutTips(tips repo.TipRepo, index int, wants []string) (*shallow.Repo, *shallow.Cut, error) {
+	rdr, err := tips.ReadTipPack(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	packfile, err := ioutil.ReadAll(rdr)
+	rdr.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := shallow.NewRepo(packfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cut, err := r.CutTips(wants)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return r, cut, nil
+}
+
+// saveTipPack stores the tip pack of a new revision. It's usually built from
+// the previous tip pack and the pushed packfile, whose delta bases git takes
+// from the previous tips. If that fails, e.g. for the first revision with a
+// tip pack, all packfiles are read.
+func (h *GitRequestHandler) saveTipPack(tips repo.TipRepo, index int, rev repo.Revision) error {
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, id := range rev {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return tips.SaveTipPack(index, bytes.NewReader(emptyPackfile))
+	}
+
+	packfile, err := h.tipPackFromPrevious(tips, index, ids)
+	if err != nil {
+		all, err := h.readPackfiles(0, index, false)
+		if err != nil {
+			return err
+		}
+		r, err := shallow.NewRepo(all)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if packfile, err = r.TipPack(ids); err != nil {
+			return err
+		}
+	}
+	return tips.SaveTipPack(index, bytes.NewReader(packfile))
+}
+
+// tipPackFromPrevious builds a tip pack from the previous tip pack and the
+// revision's packfile
+func (h *GitRequestHandler) tipPackFromPrevious(tips repo.TipRepo, index int, ids []string) ([]byte, error) {
+	if index == 0 {
+		return nil, repo.ErrNotFound
+	}
+	rdr, err := tips.ReadTipPack(index - 1)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := ioutil.ReadAll(rdr)
+	rdr.Close()
+	if err != nil {
+		return nil, err
+	}
+	packfile, err := h.readPackfiles(index, index, false)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := shallow.NewRepo(previous)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := r.AddPackfile(packfile); err != nil {
+		return nil, err
+	}
+	return r.TipPack(ids)
+}
+
+// serveShallowPull answers a protocol v0 request from a shallow client
+func (h *GitRequestHandler) serveShallowPull(revisions []repo.Revision, wants []string) error {
+	r, cut, err := h.cutHistory(revisions, wants)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if h.shallowRequest.Deepens() {
+		for _, s := range cut.Shallow {
+			if err := h.out.Encode([]byte("shallow " + s)); err != nil {
+				return err
+			}
+		}
+		for _, s := range cut.Unshallow {
+			if err := h.out.Encode([]byte("unshallow " + s)); err != nil {
+				return err
+			}
+		}
+		if err := h.out.Encode(nil); err != nil {
+			return err
+		}
+	}
+
+	if _, err := h.NegotiatePullPackfile(revisions); err != nil {
+		return err
+	}
+
+	packfile, err := r.Pack(wants, h.haves, cut)
+	if err != nil {
+		h.SendError(err)
+		return err
+	}
+	return h.SendPackfile(bytes.NewBuffer(packfile))
+}
+
+// resolveRef finds the commit for a ref name given by the user
+func resolveRef(rev repo.Revision, name string) (string, bool) {
+	for _, candidate := range []string{name, "refs/" + name, "refs/tags/" + name, "refs/heads/" + name} {
+		if id, ok := rev[candidate]; ok {
+			return id, true
+		}
+	}
+	if len(name) == 40 {
+		return name, true
+	}
+	return "", false
+}
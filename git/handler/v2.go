@@ -0,0 +1,318 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+// v2Capabilities are advertised to clients speaking protocol v2
+var v2Capabilities = []string{"version 2", "ls-refs", "fetch=shallow"}
+
+var (
+	// ErrorInvalidCommand occurs if the client sends an invalid or unknown protocol v2 command
+	ErrorInvalidCommand = errors.New("invalid protocol v2 command sent by client")
+	// ErrorNoWants occurs if the client sends a fetch command without wants
+	ErrorNoWants = errors.New("fetch command without wants sent by client")
+)
+
+// A V2Command is a protocol v2 command sent by the client
+type V2Command struct {
+	Name         string
+	Capabilities []string
+	Args         []string
+}
+
+// ServeStatelessV2 serves protocol v2 over stateless connections, like the
+// stateless-connect command of remote helpers. The client sends each request
+// on its own, so responses end with a response end packet.
+func (h *GitRequestHandler) ServeStatelessV2() error {
+	revisions, err := h.repo.GetRevisions()
+	if err != nil {
+		h.SendErrorLine(err)
+		return err
+	}
+	h.stateless = true
+	return h.serveV2(revisions)
+}
+
+// serveV2 advertises our capabilities and answers commands until the client
+// hangs up
+func (h *GitRequestHandler) serveV2(revisions []repo.Revision) error {
+	currentRev := repo.Revision{}
+	if len(revisions) > 0 {
+		currentRev = revisions[len(revisions)-1]
+	}
+
+	for _, c := range v2Capabilities {
+		if err := h.out.Encode([]byte(c + "\n")); err != nil {
+			return err
+		}
+	}
+	if err := h.out.Encode(nil); err != nil {
+		return err
+	}
+
+	for {
+		command, err := h.ReceiveV2Command()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch command.Name {
+		case "":
+			// A flush instead of a command ends the session
+			return nil
+		case "ls-refs":
+			err = h.LsRefs(currentRev, command.Args)
+		case "fetch":
+			err = h.Fetch(revisions, command.Args)
+		default:
+			return ErrorInvalidCommand
+		}
+		if err != nil {
+			return err
+		}
+		if h.stateless {
+			if err := h.out.EncodeResponseEnd(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ReceiveV2Command receives a single command from the client. An empty
+// command name means the client sent a flush instead.
+func (h *GitRequestHandler) ReceiveV2Command() (*V2Command, error) {
+	var line []byte
+	if err := h.in.Decode(&line); err != nil {
+		return nil, err
+	}
+	if line == nil {
+		return &V2Command{}, nil
+	}
+
+	name := strings.TrimSuffix(string(line), "\n")
+	if !strings.HasPrefix(name, "command=") {
+		return nil, ErrorInvalidCommand
+	}
+	command := &V2Command{Name: strings.TrimPrefix(name, "command=")}
+
+	// Capabilities, then a delim and the arguments
+	inArgs := false
+	for {
+		if err := h.in.Decode(&line); err != nil {
+			return nil, err
+		}
+		if line == nil {
+			return command, nil
+		}
+		if len(line) == 0 {
+			inArgs = true
+			continue
+		}
+		value := strings.TrimSuffix(string(line), "\n")
+		if inArgs {
+			command.Args = append(command.Args, value)
+		} else {
+			command.Capabilities = append(command.Capabilities, value)
+		}
+	}
+}
+
+// LsRefs sends the refs in the given revision, limited to the ref-prefix
+// arguments if the client sent any
+func (h *GitRequestHandler) LsRefs(refs repo.Revision, args []string) error {
+	prefixes := []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "ref-prefix ") {
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		}
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		if name != "HEAD" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := refs["HEAD"]; ok {
+		names = append([]string{"HEAD"}, names...)
+	}
+
+	for _, name := range names {
+		if !hasAnyPrefix(name, prefixes) {
+			continue
+		}
+		if err := h.out.Encode([]byte(refs[name] + " " + name + "\n")); err != nil {
+			return err
+		}
+	}
+	return h.out.Encode(nil)
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch answers a single fetch command. Unless the client is done or we
+// found a revision the client already has completely, only acknowledgments
+// are sent and the client continues with another fetch command.
+func (h *GitRequestHandler) Fetch(revisions []repo.Revision, args []string) error {
+	var wants, haves []string
+	done := false
+	h.clientCapabilities = map[string]bool{"side-band-64k": true}
+	h.shallowRequest = nil
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "want "):
+			wants = append(wants, strings.TrimPrefix(arg, "want "))
+		case strings.HasPrefix(arg, "have "):
+			haves = append(haves, strings.TrimPrefix(arg, "have "))
+		case arg == "done":
+			done = true
+		default:
+			if ok, err := h.receiveShallowLine(arg); err != nil {
+				return err
+			} else if !ok {
+				// thin-pack, ofs-delta, no-progress, ...
+				h.clientCapabilities[arg] = true
+			}
+		}
+	}
+	if len(wants) == 0 {
+		return ErrorNoWants
+	}
+
+	fromRev, ready, common := findCommonRevision(revisions, haves)
+
+	if !done {
+		if err := h.out.Encode([]byte("acknowledgments\n")); err != nil {
+			return err
+		}
+		if len(common) == 0 {
+			if err := h.out.Encode([]byte("NAK\n")); err != nil {
+				return err
+			}
+		}
+		for _, c := range common {
+			if err := h.out.Encode([]byte("ACK " + c + "\n")); err != nil {
+				return err
+			}
+		}
+		if !ready {
+			return h.out.Encode(nil)
+		}
+		if err := h.out.Encode([]byte("ready\n")); err != nil {
+			return err
+		}
+		// delim
+		if err := h.out.Encode([]byte{}); err != nil {
+			return err
+		}
+	}
+
+	if h.shallowRequest != nil {
+		return h.sendShallowPackfile(revisions, wants, haves)
+	}
+
+	if err := h.out.Encode([]byte("packfile\n")); err != nil {
+		return err
+	}
+	packfile, err := h.readPackfiles(fromRev, len(revisions)-1, true)
+	if err != nil {
+		h.SendError(err)
+		return err
+	}
+	return h.SendPackfile(bytes.NewBuffer(packfile))
+}
+
+// sendShallowPackfile sends the shallow-info and packfile sections for a
+// shallow client
+func (h *GitRequestHandler) sendShallowPackfile(revisions []repo.Revision, wants, haves []string) error {
+	r, cut, err := h.cutHistory(revisions, wants)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	lines := []string{"shallow-info"}
+	for _, s := range cut.Shallow {
+		lines = append(lines, "shallow "+s)
+	}
+	for _, s := range cut.Unshallow {
+		lines = append(lines, "unshallow "+s)
+	}
+	for _, l := range lines {
+		if err := h.out.Encode([]byte(l + "\n")); err != nil {
+			return err
+		}
+	}
+	// delim
+	if err := h.out.Encode([]byte{}); err != nil {
+		return err
+	}
+
+	if err := h.out.Encode([]byte("packfile\n")); err != nil {
+		return err
+	}
+	packfile, err := r.Pack(wants, haves, cut)
+	if err != nil {
+		h.SendError(err)
+		return err
+	}
+	return h.SendPackfile(bytes.NewBuffer(packfile))
+}
+
+// findCommonRevision returns the newest revision whose refs the client has
+// completely, which is where the packfiles for the client have to start.
+// It also returns all haves that we know about.
+func findCommonRevision(revisions []repo.Revision, haves []string) (int, bool, []string) {
+	known := map[string]bool{}
+	for _, r := range revisions {
+		for _, sha := range r {
+			known[sha] = true
+		}
+	}
+	has := map[string]bool{}
+	common := []string{}
+	for _, have := range haves {
+		has[have] = true
+		if known[have] {
+			common = append(common, have)
+		}
+	}
+
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if len(revisions[i]) == 0 {
+			continue
+		}
+		complete := true
+		for _, sha := range revisions[i] {
+			if !has[sha] {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			return i, true, common
+		}
+	}
+	return 0, false, common
+}
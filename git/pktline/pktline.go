@@ -0,0 +1,105 @@
+// Package pktline implements the pkt-line framing used by the git protocol
+package pktline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// MaxPayloadLen is the maximum length of the data in a single pkt-line
+const MaxPayloadLen = 65516
+
+var (
+	// ErrInvalidLength occurs if a pkt-line has an invalid length header
+	ErrInvalidLength = errors.New("pktline: invalid length")
+	// ErrTooLong occurs if a payload is too long for a single pkt-line
+	ErrTooLong = errors.New("pktline: payload too long")
+)
+
+var (
+	flushPkt       = []byte("0000")
+	delimPkt       = []byte("0001")
+	responseEndPkt = []byte("0002")
+)
+
+// An Encoder writes pkt-lines
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes a single pkt-line. A nil payload is written as flush packet,
+// an empty one as delim packet (as used by protocol v2).
+func (e *Encoder) Encode(payload []byte) error {
+	if payload == nil {
+		_, err := e.w.Write(flushPkt)
+		return err
+	}
+	if len(payload) == 0 {
+		_, err := e.w.Write(delimPkt)
+		return err
+	}
+	if len(payload) > MaxPayloadLen {
+		return ErrTooLong
+	}
+	_, err := e.w.Write(append([]byte(fmt.Sprintf("%04x", len(payload)+4)), payload...))
+	return err
+}
+
+// EncodeResponseEnd writes a response end packet, which ends the responses
+// of stateless protocol v2 connections
+func (e *Encoder) EncodeResponseEnd() error {
+	_, err := e.w.Write(responseEndPkt)
+	return err
+}
+
+// A Decoder reads pkt-lines. It never reads beyond the current pkt-line, so the
+// underlying reader can be used directly in between.
+type Decoder struct {
+	r io.Reader
+}
+
+// NewDecoder returns a decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads a single pkt-line. Flush packets are decoded as nil, delim
+// packets as empty (non-nil) payload.
+func (d *Decoder) Decode(payload *[]byte) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return err
+	}
+	length, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return ErrInvalidLength
+	}
+
+	switch {
+	case length == 0:
+		*payload = nil
+		return nil
+	case length == 1:
+		*payload = []byte{}
+		return nil
+	case length < 4:
+		return ErrInvalidLength
+	}
+
+	data := make([]byte, length-4)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	*payload = data
+	return nil
+}
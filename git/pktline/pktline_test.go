@@ -0,0 +1,66 @@
+package pktline_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lucas-clemente/git-cr/git/pktline"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestPktline(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Pktline Suite")
+}
+
+var _ = Describe("pkt-line", func() {
+	var buf *bytes.Buffer
+
+	BeforeEach(func() {
+		buf = &bytes.Buffer{}
+	})
+
+	It("encodes lines", func() {
+		encoder := pktline.NewEncoder(buf)
+		Ω(encoder.Encode([]byte("foo\n"))).ShouldNot(HaveOccurred())
+		Ω(encoder.Encode([]byte{})).ShouldNot(HaveOccurred())
+		Ω(encoder.Encode(nil)).ShouldNot(HaveOccurred())
+		Ω(encoder.EncodeResponseEnd()).ShouldNot(HaveOccurred())
+		Ω(buf.String()).Should(Equal("0008foo\n000100000002"))
+	})
+
+	It("refuses too long lines", func() {
+		encoder := pktline.NewEncoder(buf)
+		Ω(encoder.Encode(make([]byte, pktline.MaxPayloadLen+1))).Should(Equal(pktline.ErrTooLong))
+	})
+
+	It("decodes lines", func() {
+		buf.WriteString("0008foo\n00010000rest")
+		decoder := pktline.NewDecoder(buf)
+		var line []byte
+		Ω(decoder.Decode(&line)).ShouldNot(HaveOccurred())
+		Ω(line).Should(Equal([]byte("foo\n")))
+		Ω(decoder.Decode(&line)).ShouldNot(HaveOccurred())
+		Ω(line).ShouldNot(BeNil())
+		Ω(line).Should(BeEmpty())
+		Ω(decoder.Decode(&line)).ShouldNot(HaveOccurred())
+		Ω(line).Should(BeNil())
+		Ω(buf.String()).Should(Equal("rest"))
+	})
+
+	It("errors on invalid lengths", func() {
+		buf.WriteString("0003")
+		var line []byte
+		Ω(pktline.NewDecoder(buf).Decode(&line)).Should(Equal(pktline.ErrInvalidLength))
+		buf.WriteString("zzzz")
+		Ω(pktline.NewDecoder(buf).Decode(&line)).Should(Equal(pktline.ErrInvalidLength))
+	})
+
+	It("errors on truncated lines", func() {
+		buf.WriteString("0008fo")
+		var line []byte
+		Ω(pktline.NewDecoder(buf).Decode(&line)).Should(HaveOccurred())
+	})
+})
@@ -2,61 +2,347 @@ package repo
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"hash"
 	"io"
 	"strconv"
 )
 
+// logVersion is the version of the revisions.json format. Version 0 is a
+// plain list of revisions, without hashes.
+const logVersion = 1
+
+// revisionLog is stored in revisions.json
+type revisionLog struct {
+	Version int `json:"version"`
+	// Strict is set once all blobs are in the current format, see
+	// StrictBackend
+	Strict    bool       `json:"strict,omitempty"`
+	Revisions []logEntry `json:"revisions"`
+}
+
+// A logEntry commits to the previous entry and to the revision's pack, so
+// that the newest entry's hash, the head, authenticates the whole history.
+type logEntry struct {
+	Refs Revision `json:"refs"`
+	// Pack is the hex SHA-256 of the packfile, empty for revisions saved
+	// in version 0
+	Pack string `json:"pack"`
+	// Parent is the hash of the previous entry, empty for the first one
+	Parent string `json:"parent"`
+	// File is the name of the packfile, empty for "<index>.pack"
+	File string `json:"file,omitempty"`
+}
+
+// packName returns the name of the entry's packfile
+func (e *logEntry) packName(index int) string {
+	if e.File == "" {
+		return strconv.Itoa(index) + ".pack"
+	}
+	return e.File
+}
+
+// claimName is the name of the blob that claims a revision. It holds the
+// revision's log entry, until revisions.json includes it.
+func claimName(index int) string {
+	return strconv.Itoa(index) + ".rev"
+}
+
+// tipName is the name of a revision's tip pack, see TipRepo
+func tipName(index int) string {
+	return strconv.Itoa(index) + ".tip"
+}
+
+func (e *logEntry) hash() string {
+	data, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 type jsonRepo struct {
 	backend Backend
+	heads   HeadStore
+	strict  bool
+	// entries is the log as of the last call to GetRevisions
+	entries []logEntry
 }
 
+var _ TipRepo = &jsonRepo{}
+
 // NewJSONRepo returns a Repo implementation that stores revisions as json
 func NewJSONRepo(backend Backend) Repo {
 	return &jsonRepo{backend: backend}
 }
 
+// NewVerifiedJSONRepo returns a json Repo that remembers the newest head in
+// heads, and fails with ErrRollback if the remote later serves a log that
+// doesn't extend it.
+func NewVerifiedJSONRepo(backend Backend, heads HeadStore) Repo {
+	return &jsonRepo{backend: backend, heads: heads}
+}
+
 func (r *jsonRepo) GetRevisions() ([]Revision, error) {
+	entries, err := r.readVerifiedLog()
+	if err != nil {
+		return nil, err
+	}
+	r.entries = entries
+
+	revisions := make([]Revision, len(entries))
+	for i, e := range entries {
+		revisions[i] = e.Refs
+	}
+	return revisions, nil
+}
+
+// readLog reads and verifies the revision log, including revisions that were
+// claimed but not yet added to revisions.json
+func (r *jsonRepo) readLog() ([]logEntry, error) {
+	entries, strict, err := r.readLogBlob()
+	if err != nil {
+		return nil, err
+	}
+	if strict {
+		r.setStrict()
+	}
+	for {
+		rdr, err := r.backend.ReadBlob(claimName(len(entries)))
+		if err == ErrNotFound {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e logEntry
+		err = json.NewDecoder(rdr).Decode(&e)
+		rdr.Close()
+		if err != nil {
+			return nil, err
+		}
+		parent := ""
+		if len(entries) > 0 {
+			parent = entries[len(entries)-1].hash()
+		}
+		if e.Parent != parent {
+			return nil, ErrBrokenLog
+		}
+		entries = append(entries, e)
+	}
+}
+
+func (r *jsonRepo) readLogBlob() ([]logEntry, bool, error) {
 	rdr, err := r.backend.ReadBlob("revisions.json")
 	if err != nil {
 		if err == ErrNotFound {
-			return []Revision{}, nil
+			return []logEntry{}, false, nil
 		}
-		return nil, err
+		return nil, false, err
 	}
 	defer rdr.Close()
 
-	var revisions []Revision
-	if err := json.NewDecoder(rdr).Decode(&revisions); err != nil {
+	var raw json.RawMessage
+	if err := json.NewDecoder(rdr).Decode(&raw); err != nil {
+		return nil, false, err
+	}
+
+	// Logs of version 0 are lists, chain them now
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		var revisions []Revision
+		if err := json.Unmarshal(raw, &revisions); err != nil {
+			return nil, false, err
+		}
+		entries := make([]logEntry, len(revisions))
+		for i, rev := range revisions {
+			entries[i].Refs = rev
+			if i > 0 {
+				entries[i].Parent = entries[i-1].hash()
+			}
+		}
+		return entries, false, nil
+	}
+
+	var log revisionLog
+	if err := json.Unmarshal(raw, &log); err != nil {
+		return nil, false, err
+	}
+	if log.Version != logVersion {
+		return nil, false, ErrUnknownLogVersion
+	}
+	for i, e := range log.Revisions {
+		parent := ""
+		if i > 0 {
+			parent = log.Revisions[i-1].hash()
+		}
+		if e.Parent != parent {
+			return nil, false, ErrBrokenLog
+		}
+	}
+	return log.Revisions, log.Strict, nil
+}
+
+// readVerifiedLog reads the log and makes sure it extends the head seen
+// before, which is then updated
+func (r *jsonRepo) readVerifiedLog() ([]logEntry, error) {
+	if r.heads == nil {
+		return r.readLog()
+	}
+	head, err := r.heads.GetHead()
+	if err != nil {
 		return nil, err
 	}
-	return revisions, nil
+	// A rolled back log mustn't turn strict mode off again
+	if head.Strict {
+		r.setStrict()
+	}
+	entries, err := r.readLog()
+	if err != nil {
+		return nil, err
+	}
+	if head.Hash != "" && (head.Index >= len(entries) || entries[head.Index].hash() != head.Hash) {
+		return nil, ErrRollback
+	}
+	if len(entries) == 0 {
+		return entries, nil
+	}
+	newHead := Head{Index: len(entries) - 1, Hash: entries[len(entries)-1].hash(), Strict: r.strict}
+	if newHead == head {
+		return entries, nil
+	}
+	return entries, r.heads.SaveHead(newHead)
+}
+
+func (r *jsonRepo) setStrict() {
+	if !r.strict {
+		r.strict = true
+		SetStrict(r.backend)
+	}
 }
 
-func (r *jsonRepo) SaveNewRevision(rev Revision, packfile io.Reader) error {
-	revisions, err := r.GetRevisions()
+// writeLog writes revisions.json, with the strict flag if the repo is in
+// strict mode
+func (r *jsonRepo) writeLog(entries []logEntry) error {
+	data, err := json.Marshal(revisionLog{Version: logVersion, Strict: r.strict, Revisions: entries})
 	if err != nil {
 		return err
 	}
-	revisions = append(revisions, rev)
+	return r.backend.WriteBlob("revisions.json", bytes.NewBuffer(data))
+}
 
-	// Write revisions
-	revisionsJSON, err := json.Marshal(revisions)
+// SaveNewRevision writes the packfile under a random name first, and then
+// claims the revision number by creating its claim blob. Only one client can
+// create a given claim, so concurrent pushes can't both append to the log.
+// Once the claim exists, the revision is saved: if updating revisions.json
+// fails, readers still find it. New repos start in strict mode, as they hold
+// no blobs of earlier versions.
+func (r *jsonRepo) SaveNewRevision(index int, rev Revision, packfile io.Reader) error {
+	entries, err := r.readVerifiedLog()
 	if err != nil {
 		return err
 	}
-	if err := r.backend.WriteBlob("revisions.json", bytes.NewBuffer(revisionsJSON)); err != nil {
+	if len(entries) != index {
+		return ErrConflict
+	}
+	if index == 0 {
+		r.setStrict()
+	}
+
+	// Write pack. A push failing here only leaves an unused pack behind.
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := strconv.Itoa(index) + "-" + hex.EncodeToString(suffix) + ".pack"
+	digest := sha256.New()
+	if err := r.backend.CreateBlob(name, io.TeeReader(packfile, digest)); err != nil {
 		return err
 	}
 
-	// Write pack
-	if err := r.backend.WriteBlob(strconv.Itoa(len(revisions)-1)+".pack", packfile); err != nil {
+	// Claim the revision
+	entry := logEntry{Refs: rev, Pack: hex.EncodeToString(digest.Sum(nil)), File: name}
+	if index > 0 {
+		entry.Parent = entries[index-1].hash()
+	}
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := r.backend.CreateBlob(claimName(index), bytes.NewBuffer(entryJSON)); err != nil {
+		if err == ErrExists {
+			DeleteBlob(r.backend, name)
+			return ErrConflict
+		}
 		return err
 	}
 
+	// Write revisions
+	entries = append(entries, entry)
+	if err := r.writeLog(entries); err != nil {
+		return err
+	}
+	r.entries = entries
+	if r.heads != nil {
+		return r.heads.SaveHead(Head{Index: index, Hash: entry.hash(), Strict: r.strict})
+	}
 	return nil
 }
 
+// ReadPackfile checks the pack against the digest in the log. Since packs
+// are streamed, a substituted pack is only detected when it was read
+// completely, in which case Read returns ErrPackMismatch instead of io.EOF.
 func (r *jsonRepo) ReadPackfile(toRev int) (io.ReadCloser, error) {
-	return r.backend.ReadBlob(strconv.Itoa(toRev) + ".pack")
+	if r.entries == nil || toRev >= len(r.entries) {
+		if _, err := r.GetRevisions(); err != nil {
+			return nil, err
+		}
+	}
+	if toRev >= len(r.entries) {
+		return nil, ErrNotFound
+	}
+
+	rdr, err := r.backend.ReadBlob(r.entries[toRev].packName(toRev))
+	if err != nil {
+		return nil, err
+	}
+	expected := r.entries[toRev].Pack
+	if expected == "" {
+		return rdr, nil
+	}
+	return &verifyingReader{ReadCloser: rdr, digest: sha256.New(), expected: expected}, nil
+}
+
+type verifyingReader struct {
+	io.ReadCloser
+	digest   hash.Hash
+	expected string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.digest.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.digest.Sum(nil)) != v.expected {
+		return n, ErrPackMismatch
+	}
+	return n, err
+}
+
+// SaveTipPack replaces the tip pack of the previous revision, so only the
+// newest one is kept
+func (r *jsonRepo) SaveTipPack(index int, packfile io.Reader) error {
+	if err := r.backend.WriteBlob(tipName(index), packfile); err != nil {
+		return err
+	}
+	if index > 0 {
+		DeleteBlob(r.backend, tipName(index-1))
+	}
+	return nil
+}
+
+func (r *jsonRepo) ReadTipPack(index int) (io.ReadCloser, error) {
+	return r.backend.ReadBlob(tipName(index))
 }
@@ -0,0 +1,224 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+)
+
+// ErrRekeyVerificationFailed is returned by Rekey if a re-written blob can't
+// be read back. The old copy is kept in this case.
+var ErrRekeyVerificationFailed = errors.New("a re-encrypted blob could not be verified")
+
+// rekeyProbeName is written through the new backend to detect whether both
+// backends use the same underlying blob names
+const rekeyProbeName = "rekey-probe"
+
+// rekeyTmpSuffix is appended to the names of blobs while they are replaced in
+// place
+const rekeyTmpSuffix = ".rekey"
+
+// Rekey re-writes all blobs of a JSON repo read through from with to, e.g. to
+// change the encryption of a remote. Both backends usually wrap the same
+// storage. Each blob is read back through to before the old copy is deleted
+// or, in place, replaced, and blobs that were re-written already are skipped,
+// so an interrupted rekey can simply be restarted. Rekeying in place with the
+// same settings re-writes all blobs in the current format. The revisions are
+// re-written last, and then marked as strict, so readers refuse blobs of
+// earlier versions from then on. Nobody may push while a repo is rekeyed.
+//
+// progress is called after every blob and may be nil.
+func Rekey(from, to Backend, progress func(done, total int)) error {
+	inPlace, err := SharesBlobNames(from, to)
+	if err != nil {
+		return err
+	}
+
+	// revisions.json is re-written last, so it can be read with the old
+	// settings until everything else was done. Afterwards, it's either gone
+	// or, in place, can't be read with them anymore.
+	entries, err := (&jsonRepo{backend: from}).readLog()
+	if err != nil && !IsAuthError(err) {
+		return err
+	}
+	if err != nil || len(entries) == 0 {
+		rekeyed, toErr := (&jsonRepo{backend: to}).readLog()
+		if toErr != nil {
+			if err != nil {
+				return err
+			}
+			return toErr
+		}
+		entries = rekeyed
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, 2*len(entries)+2)
+	for i, e := range entries {
+		names = append(names, e.packName(i))
+		if e.File != "" {
+			names = append(names, claimName(i))
+		}
+	}
+	// Only the newest tip pack is kept, if there is one at all
+	tip := tipName(len(entries) - 1)
+	names = append(names, tip, "revisions.json")
+
+	for i, name := range names {
+		if err := rekeyBlob(from, to, name, inPlace); err != nil && !(name == tip && err == ErrNotFound) {
+			return err
+		}
+		if progress != nil {
+			progress(i+1, len(names))
+		}
+	}
+	return (&jsonRepo{backend: to}).markStrict()
+}
+
+// markStrict re-writes revisions.json in strict mode
+func (r *jsonRepo) markStrict() error {
+	entries, err := r.readLog()
+	if err != nil {
+		return err
+	}
+	if r.strict {
+		return nil
+	}
+	r.setStrict()
+	return r.writeLog(entries)
+}
+
+// SharesBlobNames checks if from reads what to writes, i.e. if both store
+// blobs under the same name. In that case blobs are replaced in place.
+func SharesBlobNames(from, to Backend) (bool, error) {
+	if err := to.WriteBlob(rekeyProbeName, bytes.NewBufferString(rekeyProbeName)); err != nil {
+		return false, err
+	}
+	_, readErr := hashBlob(from, rekeyProbeName)
+	if err := DeleteBlob(to, rekeyProbeName); err != nil && err != ErrDeleteUnsupported {
+		return false, err
+	}
+	return readErr != ErrNotFound, nil
+}
+
+func rekeyBlob(from, to Backend, name string, inPlace bool) error {
+	if inPlace {
+		return rekeyBlobInPlace(from, to, name)
+	}
+
+	// Blobs re-written by an earlier run only need their old copy removed
+	_, err := hashBlob(to, name)
+	if err == nil {
+		return deleteOldCopy(from, name)
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	if err := copyBlob(from, name, to, name); err != nil {
+		return unwrapSourceError(err)
+	}
+	return deleteOldCopy(from, name)
+}
+
+// rekeyBlobInPlace writes the new copy under a temporary name and verifies it
+// before replacing the old one, so that a verified copy remains if replacing
+// fails. The temporary copy is deleted once the replacement was verified.
+func rekeyBlobInPlace(from, to Backend, name string) error {
+	tmpName := name + rekeyTmpSuffix
+	err := copyBlob(from, name, to, tmpName)
+	if srcErr, ok := err.(sourceError); ok {
+		// Blobs replaced by an earlier run can't be read with the old settings
+		// anymore. If that run was interrupted, the temporary copy is left.
+		if _, toErr := hashBlob(to, name); toErr == nil {
+			return deleteOldCopy(to, tmpName)
+		}
+		if _, tmpErr := hashBlob(to, tmpName); tmpErr != nil {
+			return srcErr.error
+		}
+	} else if err != nil {
+		return err
+	}
+	if err := copyBlob(to, tmpName, to, name); err != nil {
+		return unwrapSourceError(err)
+	}
+	return deleteOldCopy(to, tmpName)
+}
+
+// copyBlob streams a blob from one backend to another and verifies the copy
+// by comparing hashes. Errors reading the source are returned as sourceError.
+func copyBlob(from Backend, fromName string, to Backend, toName string) error {
+	rdr, err := from.ReadBlob(fromName)
+	if err != nil {
+		return sourceError{err}
+	}
+	defer rdr.Close()
+	src := &sourceReader{Reader: rdr, hash: sha256.New()}
+	if err := to.WriteBlob(toName, src); err != nil {
+		if src.err != nil {
+			return sourceError{src.err}
+		}
+		return err
+	}
+	if src.err != nil {
+		return sourceError{src.err}
+	}
+
+	written, err := hashBlob(to, toName)
+	if err != nil || !bytes.Equal(written, src.hash.Sum(nil)) {
+		return ErrRekeyVerificationFailed
+	}
+	return nil
+}
+
+// sourceError is an error reading the blob that is copied
+type sourceError struct {
+	error
+}
+
+func unwrapSourceError(err error) error {
+	if e, ok := err.(sourceError); ok {
+		return e.error
+	}
+	return err
+}
+
+// sourceReader hashes the data that is copied and remembers read errors
+type sourceReader struct {
+	io.Reader
+	hash hash.Hash
+	err  error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.hash.Write(p[:n])
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func deleteOldCopy(from Backend, name string) error {
+	if err := DeleteBlob(from, name); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// hashBlob reads a blob completely and returns its SHA-256
+func hashBlob(backend Backend, name string) ([]byte, error) {
+	rdr, err := backend.ReadBlob(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rdr); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
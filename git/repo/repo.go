@@ -13,16 +13,133 @@ type Repo interface {
 	// GetRevisions should return all revisions in chronological order
 	GetRevisions() ([]Revision, error)
 
-	SaveNewRevision(rev Revision, packfile io.Reader) error
+	// SaveNewRevision saves a revision with the given index, i.e. the number of
+	// revisions the new one is based on. If another revision was saved in the
+	// meantime, ErrConflict is returned.
+	SaveNewRevision(index int, rev Revision, packfile io.Reader) error
 
 	ReadPackfile(toRev int) (io.ReadCloser, error)
 }
 
+// A TipRepo also stores a tip pack for the newest revision: the objects of its
+// refs, without their history. Shallow fetches of a depth of 1 only need the
+// tip pack. Since git objects are addressed by their hashes, tip packs need
+// no digest in the revision log.
+type TipRepo interface {
+	Repo
+
+	// SaveTipPack stores the tip pack of a saved revision. The tip packs of
+	// earlier revisions may be deleted.
+	SaveTipPack(index int, packfile io.Reader) error
+
+	// ReadTipPack returns ErrNotFound if the revision has no tip pack
+	ReadTipPack(index int) (io.ReadCloser, error)
+}
+
+// An authError occurs if an encrypting Backend can't decrypt or verify a
+// blob with its keys, e.g. because it was written with other ones.
+type authError struct {
+	msg string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+// NewAuthError returns an error for blobs that can't be decrypted or verified
+// with a backend's keys, see IsAuthError
+func NewAuthError(msg string) error {
+	return &authError{msg: msg}
+}
+
+// IsAuthError returns whether err was created by NewAuthError
+func IsAuthError(err error) bool {
+	_, ok := err.(*authError)
+	return ok
+}
+
 // ErrNotFound should be returned by Backend.ReadBlob if a blob was not found.
 var ErrNotFound = errors.New("not found")
 
+// ErrExists should be returned by Backend.CreateBlob if a blob already exists.
+var ErrExists = errors.New("already exists")
+
+// ErrConflict is returned by Repo.SaveNewRevision if another client pushed concurrently.
+var ErrConflict = errors.New("the remote was changed by another push, fetch and try again")
+
+// ErrRollback is returned if the remote's revision log doesn't extend the
+// head a client saw before, i.e. it was rolled back or rewritten.
+var ErrRollback = errors.New("the remote's revisions are older than or differ from the ones seen before, it might have been rolled back")
+
+// ErrBrokenLog is returned if the entries of the revision log are not chained correctly.
+var ErrBrokenLog = errors.New("the remote's revision log is not a valid hash chain")
+
+// ErrUnknownLogVersion is returned for revision logs written by newer versions.
+var ErrUnknownLogVersion = errors.New("the remote's revision log has an unknown version, try updating git-cr")
+
+// ErrPackMismatch is returned when reading a packfile that doesn't match the digest in the revision log.
+var ErrPackMismatch = errors.New("a packfile doesn't match the revision log, it might have been substituted")
+
+// A Head is the newest revision a client has seen of a repo.
+type Head struct {
+	Index int
+	// Hash is the hash of the revision's log entry, empty if no revision was
+	// seen yet
+	Hash string
+	// Strict is set once the repo was seen in strict mode, see StrictBackend
+	Strict bool
+}
+
+// A HeadStore remembers the newest revision a client has seen of a repo.
+type HeadStore interface {
+	GetHead() (Head, error)
+	SaveHead(head Head) error
+}
+
 // A Backend for a crypto repo
 type Backend interface {
 	ReadBlob(name string) (io.ReadCloser, error)
+
+	// WriteBlob creates or replaces a blob. Writes have to be atomic: if a write
+	// fails or the process crashes, readers must see either the old or the
+	// complete new blob, never a partially written one.
 	WriteBlob(name string, r io.Reader) error
+
+	// CreateBlob is like WriteBlob, but fails with ErrExists if the blob already
+	// exists. Checking and creating has to be atomic, as concurrent clients
+	// use it to claim revision numbers.
+	CreateBlob(name string, r io.Reader) error
+}
+
+// ErrDeleteUnsupported is returned by DeleteBlob if a backend can't delete blobs.
+var ErrDeleteUnsupported = errors.New("the backend doesn't support deleting blobs")
+
+// A Deleter is a Backend that can delete blobs. DeleteBlob should return
+// ErrNotFound if the blob doesn't exist.
+type Deleter interface {
+	DeleteBlob(name string) error
+}
+
+// DeleteBlob deletes a blob if the backend supports it
+func DeleteBlob(backend Backend, name string) error {
+	d, ok := backend.(Deleter)
+	if !ok {
+		return ErrDeleteUnsupported
+	}
+	return d.DeleteBlob(name)
+}
+
+// A StrictBackend is a Backend that can stop reading blobs in formats of
+// earlier versions, e.g. ones that aren't bound to their names. JSON repos
+// switch to strict mode once all blobs were written in the current format,
+// i.e. for new repos and after a rekey.
+type StrictBackend interface {
+	SetStrict()
+}
+
+// SetStrict switches a backend to strict mode if it supports it
+func SetStrict(backend Backend) {
+	if s, ok := backend.(StrictBackend); ok {
+		s.SetStrict()
+	}
 }
@@ -2,6 +2,8 @@ package repo_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"testing"
@@ -20,7 +22,11 @@ func TestLocalRepo(t *testing.T) {
 type fixtureBackend map[string][]byte
 
 func (f fixtureBackend) ReadBlob(name string) (io.ReadCloser, error) {
-	return ioutil.NopCloser(bytes.NewBuffer(f[name])), nil
+	data, ok := f[name]
+	if !ok {
+		return nil, repo.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
 }
 
 func (f fixtureBackend) WriteBlob(name string, r io.Reader) error {
@@ -32,6 +38,181 @@ func (f fixtureBackend) WriteBlob(name string, r io.Reader) error {
 	return nil
 }
 
+func (f fixtureBackend) CreateBlob(name string, r io.Reader) error {
+	if _, ok := f[name]; ok {
+		return repo.ErrExists
+	}
+	return f.WriteBlob(name, r)
+}
+
+func (f fixtureBackend) DeleteBlob(name string) error {
+	if _, ok := f[name]; !ok {
+		return repo.ErrNotFound
+	}
+	delete(f, name)
+	return nil
+}
+
+// hookBackend calls before ahead of every write, e.g. to simulate concurrent
+// clients or crashes
+type hookBackend struct {
+	fixtureBackend
+	before func(name string) error
+}
+
+func (h *hookBackend) WriteBlob(name string, r io.Reader) error {
+	if err := h.before(name); err != nil {
+		return err
+	}
+	return h.fixtureBackend.WriteBlob(name, r)
+}
+
+func (h *hookBackend) CreateBlob(name string, r io.Reader) error {
+	if err := h.before(name); err != nil {
+		return err
+	}
+	return h.fixtureBackend.CreateBlob(name, r)
+}
+
+// failingBackend fails to read the blob with the given name
+type failingBackend struct {
+	fixtureBackend
+	name string
+}
+
+func (f *failingBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	if name == f.name {
+		return nil, errCrash
+	}
+	return f.fixtureBackend.ReadBlob(name)
+}
+
+var (
+	errCrash    = errors.New("crash")
+	errWrongKey = repo.NewAuthError("wrong key")
+)
+
+type logJSON struct {
+	Version   int
+	Strict    bool
+	Revisions []struct {
+		Refs               repo.Revision
+		Pack, Parent, File string
+	}
+}
+
+// packFile returns the name of a revision's packfile
+func packFile(backend fixtureBackend, index int) string {
+	var log logJSON
+	Ω(json.Unmarshal(backend["revisions.json"], &log)).Should(Succeed())
+	return log.Revisions[index].File
+}
+
+type fixtureHeads struct {
+	repo.Head
+}
+
+func (h *fixtureHeads) GetHead() (repo.Head, error) {
+	return h.Head, nil
+}
+
+func (h *fixtureHeads) SaveHead(head repo.Head) error {
+	h.Head = head
+	return nil
+}
+
+// strictBackend remembers whether it was switched to strict mode
+type strictBackend struct {
+	fixtureBackend
+	strict bool
+}
+
+func (s *strictBackend) SetStrict() {
+	s.strict = true
+}
+
+// readLog returns the parsed revisions.json
+func readLog(backend repo.Backend) logJSON {
+	var log logJSON
+	Ω(json.Unmarshal(readBlob(backend, "revisions.json"), &log)).Should(Succeed())
+	return log
+}
+
+// xorBackend is a toy encryption wrapper. Blobs start with the key, so reading
+// with another key fails.
+type xorBackend struct {
+	backend repo.Backend
+	suffix  string
+	key     byte
+}
+
+func (x *xorBackend) ReadBlob(name string) (io.ReadCloser, error) {
+	rdr, err := x.backend.ReadBlob(name + x.suffix)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || data[0] != x.key {
+		return nil, errWrongKey
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(x.xor(data[1:]))), nil
+}
+
+func (x *xorBackend) WriteBlob(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return x.backend.WriteBlob(name+x.suffix, bytes.NewBuffer(append([]byte{x.key}, x.xor(data)...)))
+}
+
+func (x *xorBackend) CreateBlob(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return x.backend.CreateBlob(name+x.suffix, bytes.NewBuffer(append([]byte{x.key}, x.xor(data)...)))
+}
+
+func (x *xorBackend) DeleteBlob(name string) error {
+	return repo.DeleteBlob(x.backend, name+x.suffix)
+}
+
+func (x *xorBackend) xor(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ x.key
+	}
+	return out
+}
+
+// brokenBackend corrupts everything but the probe written by Rekey
+type brokenBackend struct {
+	*xorBackend
+}
+
+func (b *brokenBackend) WriteBlob(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if name != "rekey-probe" {
+		data = append(data, '!')
+	}
+	return b.xorBackend.WriteBlob(name, bytes.NewBuffer(data))
+}
+
+func readBlob(b repo.Backend, name string) []byte {
+	rdr, err := b.ReadBlob(name)
+	Ω(err).ShouldNot(HaveOccurred())
+	data, err := ioutil.ReadAll(rdr)
+	Ω(err).ShouldNot(HaveOccurred())
+	return data
+}
+
 var _ = Describe("JSON Repo", func() {
 	var (
 		backend  fixtureBackend
@@ -44,8 +225,9 @@ var _ = Describe("JSON Repo", func() {
 	})
 
 	It("reads packfiles", func() {
-		backend["42.pack"] = []byte("foo")
-		r, err := jsonRepo.ReadPackfile(42)
+		backend["revisions.json"] = []byte(`[{"refs/heads/master":"foobar"}]`)
+		backend["0.pack"] = []byte("foo")
+		r, err := jsonRepo.ReadPackfile(0)
 		Ω(err).ShouldNot(HaveOccurred())
 		data, err := ioutil.ReadAll(r)
 		Ω(err).ShouldNot(HaveOccurred())
@@ -61,9 +243,316 @@ var _ = Describe("JSON Repo", func() {
 
 	It("saves new revisions", func() {
 		backend["revisions.json"] = []byte(`[{"refs/heads/master":"foobar"}]`)
-		err := jsonRepo.SaveNewRevision(repo.Revision{"refs/heads/master": "foobaz"}, bytes.NewBufferString("bar"))
+		err := jsonRepo.SaveNewRevision(1, repo.Revision{"refs/heads/master": "foobaz"}, bytes.NewBufferString("bar"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var log logJSON
+		Ω(json.Unmarshal(backend["revisions.json"], &log)).Should(Succeed())
+		Ω(log.Revisions[1].File).Should(MatchRegexp(`^1-[0-9a-f]{16}\.pack$`))
+		Ω(backend[log.Revisions[1].File]).Should(Equal([]byte("bar")))
+		Ω(backend).Should(HaveKey("1.rev"))
+		Ω(log.Version).Should(Equal(1))
+		Ω(log.Revisions).Should(HaveLen(2))
+		Ω(log.Revisions[1].Refs).Should(Equal(repo.Revision{"refs/heads/master": "foobaz"}))
+		Ω(log.Revisions[1].Pack).Should(Equal("fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9"))
+		Ω(log.Revisions[1].Parent).ShouldNot(BeEmpty())
+
+		refs, err := repo.NewJSONRepo(backend).GetRevisions()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(refs).Should(Equal([]repo.Revision{{"refs/heads/master": "foobar"}, {"refs/heads/master": "foobaz"}}))
+	})
+
+	It("keeps only the newest tip pack", func() {
+		tips := jsonRepo.(repo.TipRepo)
+		Ω(tips.SaveTipPack(0, bytes.NewBufferString("foo"))).Should(Succeed())
+		Ω(tips.SaveTipPack(1, bytes.NewBufferString("bar"))).Should(Succeed())
+		Ω(backend).ShouldNot(HaveKey("0.tip"))
+		rdr, err := tips.ReadTipPack(1)
 		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadAll(rdr)).Should(Equal([]byte("bar")))
+		_, err = tips.ReadTipPack(0)
+		Ω(err).Should(Equal(repo.ErrNotFound))
+	})
+
+	It("rejects revisions based on outdated state", func() {
+		backend["revisions.json"] = []byte(`[{"refs/heads/master":"foobar"},{"refs/heads/master":"foobaz"}]`)
+		err := jsonRepo.SaveNewRevision(1, repo.Revision{"refs/heads/master": "fooqux"}, bytes.NewBufferString("bar"))
+		Ω(err).Should(Equal(repo.ErrConflict))
 		Ω(backend["revisions.json"]).Should(Equal([]byte(`[{"refs/heads/master":"foobar"},{"refs/heads/master":"foobaz"}]`)))
-		Ω(backend["1.pack"]).Should(Equal([]byte("bar")))
+	})
+
+	It("rejects revisions concurrently claimed by other clients", func() {
+		backend["revisions.json"] = []byte(`[{"refs/heads/master":"foobar"}]`)
+		racing := &hookBackend{fixtureBackend: backend, before: func(name string) error {
+			if name == "1.rev" && backend["1.rev"] == nil {
+				err := repo.NewJSONRepo(backend).SaveNewRevision(1, repo.Revision{"refs/heads/master": "fooqux"}, bytes.NewBufferString("foo"))
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+			return nil
+		}}
+		err := repo.NewJSONRepo(racing).SaveNewRevision(1, repo.Revision{"refs/heads/master": "foobaz"}, bytes.NewBufferString("bar"))
+		Ω(err).Should(Equal(repo.ErrConflict))
+		Ω(backend).Should(HaveLen(3))
+		refs, err := jsonRepo.GetRevisions()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(refs[1]).Should(Equal(repo.Revision{"refs/heads/master": "fooqux"}))
+	})
+
+	It("isn't blocked by pushes that failed before claiming their revision", func() {
+		backend["revisions.json"] = []byte(`[{"refs/heads/master":"foobar"}]`)
+		crashing := &hookBackend{fixtureBackend: backend, before: func(name string) error {
+			if name == "1.rev" {
+				return errCrash
+			}
+			return nil
+		}}
+		err := repo.NewJSONRepo(crashing).SaveNewRevision(1, repo.Revision{"refs/heads/master": "foobaz"}, bytes.NewBufferString("bar"))
+		Ω(err).Should(Equal(errCrash))
+
+		err = jsonRepo.SaveNewRevision(1, repo.Revision{"refs/heads/master": "fooqux"}, bytes.NewBufferString("baz"))
+		Ω(err).ShouldNot(HaveOccurred())
+		rdr, err := jsonRepo.ReadPackfile(1)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadAll(rdr)).Should(Equal([]byte("baz")))
+	})
+
+	It("keeps claimed revisions if revisions.json couldn't be written", func() {
+		backend["revisions.json"] = []byte(`[{"refs/heads/master":"foobar"}]`)
+		crashing := &hookBackend{fixtureBackend: backend, before: func(name string) error {
+			if name == "revisions.json" {
+				return errCrash
+			}
+			return nil
+		}}
+		err := repo.NewJSONRepo(crashing).SaveNewRevision(1, repo.Revision{"refs/heads/master": "foobaz"}, bytes.NewBufferString("bar"))
+		Ω(err).Should(Equal(errCrash))
+
+		refs, err := jsonRepo.GetRevisions()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(refs).Should(Equal([]repo.Revision{{"refs/heads/master": "foobar"}, {"refs/heads/master": "foobaz"}}))
+		err = jsonRepo.SaveNewRevision(2, repo.Revision{"refs/heads/master": "fooqux"}, bytes.NewBufferString("baz"))
+		Ω(err).ShouldNot(HaveOccurred())
+		rdr, err := jsonRepo.ReadPackfile(1)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadAll(rdr)).Should(Equal([]byte("bar")))
+	})
+
+	Context("verifying the revision log", func() {
+		var heads *fixtureHeads
+
+		push := func(r repo.Repo, ref, pack string) {
+			revisions, err := r.GetRevisions()
+			Ω(err).ShouldNot(HaveOccurred())
+			err = r.SaveNewRevision(len(revisions), repo.Revision{"refs/heads/master": ref}, bytes.NewBufferString(pack))
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			heads = &fixtureHeads{}
+			jsonRepo = repo.NewVerifiedJSONRepo(backend, heads)
+			push(jsonRepo, "foo", "pack0")
+			push(jsonRepo, "bar", "pack1")
+		})
+
+		It("remembers the head", func() {
+			Ω(heads.Index).Should(Equal(1))
+			Ω(heads.Hash).ShouldNot(BeEmpty())
+			_, err := repo.NewVerifiedJSONRepo(backend, heads).GetRevisions()
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("starts new repos in strict mode", func() {
+			Ω(readLog(backend).Strict).Should(BeTrue())
+			Ω(heads.Strict).Should(BeTrue())
+			strict := &strictBackend{fixtureBackend: backend}
+			_, err := repo.NewJSONRepo(strict).GetRevisions()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(strict.strict).Should(BeTrue())
+		})
+
+		It("stays in strict mode if the flag is removed from the log", func() {
+			backend["revisions.json"] = bytes.Replace(backend["revisions.json"], []byte(`"strict":true,`), nil, 1)
+			strict := &strictBackend{fixtureBackend: backend}
+			_, err := repo.NewJSONRepo(strict).GetRevisions()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(strict.strict).Should(BeFalse())
+			_, err = repo.NewVerifiedJSONRepo(strict, heads).GetRevisions()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(strict.strict).Should(BeTrue())
+		})
+
+		It("accepts revisions pushed by others", func() {
+			push(repo.NewJSONRepo(backend), "baz", "pack2")
+			revisions, err := jsonRepo.GetRevisions()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(revisions).Should(HaveLen(3))
+			Ω(heads.Index).Should(Equal(2))
+		})
+
+		It("detects rollbacks", func() {
+			old := append([]byte{}, backend["revisions.json"]...)
+			push(jsonRepo, "baz", "pack2")
+			backend["revisions.json"] = old
+			delete(backend, "2.rev")
+			_, err := jsonRepo.GetRevisions()
+			Ω(err).Should(Equal(repo.ErrRollback))
+			err = jsonRepo.SaveNewRevision(2, repo.Revision{}, bytes.NewBufferString("pack"))
+			Ω(err).Should(Equal(repo.ErrRollback))
+		})
+
+		It("detects rewritten logs", func() {
+			other := fixtureBackend{}
+			otherRepo := repo.NewJSONRepo(other)
+			push(otherRepo, "foo", "pack0")
+			push(otherRepo, "evil", "pack1")
+			backend["revisions.json"] = other["revisions.json"]
+			_, err := jsonRepo.GetRevisions()
+			Ω(err).Should(Equal(repo.ErrRollback))
+		})
+
+		It("detects broken chains", func() {
+			backend["revisions.json"] = bytes.Replace(backend["revisions.json"], []byte(`"foo"`), []byte(`"fox"`), 1)
+			_, err := repo.NewJSONRepo(backend).GetRevisions()
+			Ω(err).Should(Equal(repo.ErrBrokenLog))
+		})
+
+		It("detects substituted packs", func() {
+			backend[packFile(backend, 1)] = backend[packFile(backend, 0)]
+			_, err := jsonRepo.GetRevisions()
+			Ω(err).ShouldNot(HaveOccurred())
+			rdr, err := jsonRepo.ReadPackfile(1)
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = ioutil.ReadAll(rdr)
+			Ω(err).Should(Equal(repo.ErrPackMismatch))
+
+			rdr, err = jsonRepo.ReadPackfile(0)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(rdr)).Should(Equal([]byte("pack0")))
+		})
+	})
+
+	Context("rekeying", func() {
+		var from, to *xorBackend
+
+		BeforeEach(func() {
+			from = &xorBackend{backend: backend, suffix: ".old", key: 1}
+			to = &xorBackend{backend: backend, suffix: ".new", key: 2}
+			Ω(from.WriteBlob("revisions.json", bytes.NewBufferString(`[{"refs/heads/master":"foobar"},{"refs/heads/master":"foobaz"}]`))).Should(Succeed())
+			Ω(from.WriteBlob("0.pack", bytes.NewBufferString("foo"))).Should(Succeed())
+			Ω(from.WriteBlob("1.pack", bytes.NewBufferString("bar"))).Should(Succeed())
+		})
+
+		It("re-writes all blobs and deletes the old ones", func() {
+			var done []int
+			err := repo.Rekey(from, to, func(d, total int) {
+				Ω(total).Should(Equal(4))
+				done = append(done, d)
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(done).Should(Equal([]int{1, 2, 3, 4}))
+			Ω(backend).Should(HaveLen(3))
+			Ω(readBlob(to, "0.pack")).Should(Equal([]byte("foo")))
+			Ω(readBlob(to, "1.pack")).Should(Equal([]byte("bar")))
+			revisions, err := repo.NewJSONRepo(to).GetRevisions()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(revisions).Should(HaveLen(2))
+		})
+
+		It("switches the repo to strict mode", func() {
+			Ω(repo.NewJSONRepo(from).SaveNewRevision(2, repo.Revision{"refs/heads/master": "fooqux"}, bytes.NewBufferString("baz"))).Should(Succeed())
+			Ω(readLog(from).Strict).Should(BeFalse())
+			Ω(repo.Rekey(from, to, nil)).Should(Succeed())
+			log := readLog(to)
+			Ω(log.Strict).Should(BeTrue())
+			Ω(log.Revisions).Should(HaveLen(3))
+		})
+
+		It("re-writes the packs and claims of new revisions", func() {
+			err := repo.NewJSONRepo(from).SaveNewRevision(2, repo.Revision{"refs/heads/master": "fooqux"}, bytes.NewBufferString("baz"))
+			Ω(err).ShouldNot(HaveOccurred())
+			err = repo.Rekey(from, to, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(backend).Should(HaveLen(5))
+			Ω(backend).Should(HaveKey("2.rev.new"))
+
+			r := repo.NewJSONRepo(to)
+			revisions, err := r.GetRevisions()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(revisions).Should(HaveLen(3))
+			rdr, err := r.ReadPackfile(2)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(rdr)).Should(Equal([]byte("baz")))
+		})
+
+		It("re-writes the newest tip pack", func() {
+			Ω(from.WriteBlob("1.tip", bytes.NewBufferString("tip"))).Should(Succeed())
+			Ω(repo.Rekey(from, to, nil)).Should(Succeed())
+			Ω(backend).Should(HaveLen(4))
+			rdr, err := repo.NewJSONRepo(to).(repo.TipRepo).ReadTipPack(1)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(rdr)).Should(Equal([]byte("tip")))
+		})
+
+		It("resumes interrupted runs", func() {
+			// The first pack was re-written, but not yet deleted
+			Ω(to.WriteBlob("0.pack", bytes.NewBufferString("foo"))).Should(Succeed())
+			err := repo.Rekey(from, to, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(backend).Should(HaveLen(3))
+			Ω(readBlob(to, "0.pack")).Should(Equal([]byte("foo")))
+			Ω(readBlob(to, "revisions.json")).Should(ContainSubstring("foobaz"))
+		})
+
+		It("rekeys in place if both backends use the same names", func() {
+			to.suffix = ".old"
+			err := repo.Rekey(from, to, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(backend).Should(HaveLen(3))
+			Ω(backend["0.pack.old"][0]).Should(Equal(byte(2)))
+			Ω(readBlob(to, "1.pack")).Should(Equal([]byte("bar")))
+
+			// Running again doesn't change anything
+			err = repo.Rekey(from, to, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(readBlob(to, "1.pack")).Should(Equal([]byte("bar")))
+		})
+
+		It("keeps the old blobs in place if the new ones can't be read", func() {
+			to.suffix = ".old"
+			err := repo.Rekey(from, &brokenBackend{to}, nil)
+			Ω(err).Should(Equal(repo.ErrRekeyVerificationFailed))
+			Ω(readBlob(from, "0.pack")).Should(Equal([]byte("foo")))
+		})
+
+		It("restores blobs from their temporary copy if replacing them failed", func() {
+			to.suffix = ".old"
+			Ω(to.WriteBlob("0.pack.rekey", bytes.NewBufferString("foo"))).Should(Succeed())
+			backend["0.pack.old"] = []byte{3, 'x'}
+			err := repo.Rekey(from, to, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(readBlob(to, "0.pack")).Should(Equal([]byte("foo")))
+			Ω(backend).Should(HaveLen(3))
+		})
+
+		It("resumes runs that re-wrote the revisions in place already", func() {
+			to.suffix = ".old"
+			Ω(repo.Rekey(from, to, nil)).Should(Succeed())
+			Ω(repo.Rekey(from, to, nil)).Should(Succeed())
+			Ω(readBlob(to, "1.pack")).Should(Equal([]byte("bar")))
+		})
+
+		It("returns errors other than authentication failures", func() {
+			failing := &xorBackend{backend: &failingBackend{fixtureBackend: backend, name: "revisions.json.old"}, suffix: ".old", key: 1}
+			err := repo.Rekey(failing, to, nil)
+			Ω(err).Should(Equal(errCrash))
+			Ω(backend).Should(HaveLen(3))
+		})
+
+		It("keeps the old blobs if the new ones can't be read", func() {
+			broken := &xorBackend{backend: fixtureBackend{}, suffix: ".new", key: 2}
+			err := repo.Rekey(from, &brokenBackend{broken}, nil)
+			Ω(err).Should(Equal(repo.ErrRekeyVerificationFailed))
+			Ω(readBlob(from, "0.pack")).Should(Equal([]byte("foo")))
+		})
 	})
 })
@@ -0,0 +1,274 @@
+// Package shallow builds packfiles for shallow clients.
+//
+// Since packfiles pushed by git are thin, the objects needed for a shallow
+// history can't be taken from single packfiles. Instead all packfiles are
+// indexed into a temporary repo, and git is used to cut the history and pack
+// the objects the client needs. For a depth of 1, a tip pack, which holds
+// the objects of a revision's refs without their history, is enough.
+package shallow
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ErrorDeepenConflict occurs if a client asks for a depth together with deepen-since or deepen-not
+var ErrorDeepenConflict = errors.New("deepen and deepen-since (or deepen-not) cannot be used together")
+
+// A Request describes how the client wants its history to be cut
+type Request struct {
+	// Depth is the number of commits to send from each want
+	Depth int
+	// Relative makes Depth count from the client's shallow commits
+	Relative bool
+	// Since excludes commits older than the given time if non-zero
+	Since time.Time
+	// Not excludes commits reachable from the given commits
+	Not []string
+	// ClientShallows are the commits the client already has as shallow
+	ClientShallows []string
+}
+
+// Deepens returns whether the client wants to change its shallow commits
+func (r *Request) Deepens() bool {
+	return r.Depth > 0 || !r.Since.IsZero() || len(r.Not) > 0
+}
+
+// OnlyTips returns whether the client wants its wants without any history,
+// which CutTips can answer
+func (r *Request) OnlyTips() bool {
+	return r.Depth == 1 && !r.Relative && r.Since.IsZero() && len(r.Not) == 0 && len(r.ClientShallows) == 0
+}
+
+// A Cut is where the history sent to a client ends
+type Cut struct {
+	// Shallow are new shallow commits the client has to know about
+	Shallow []string
+	// Unshallow are shallow commits of the client whose parents will be sent
+	Unshallow []string
+
+	// grafts are all commits treated as having no parents
+	grafts []string
+	// unshallowParents have to be sent in addition to the wants
+	unshallowParents []string
+}
+
+// A Repo is a temporary bare repo holding all objects
+type Repo struct {
+	dir string
+}
+
+// NewRepo indexes the given (complete) packfile into a new temporary repo
+func NewRepo(packfile []byte) (*Repo, error) {
+	dir, err := ioutil.TempDir("", "git-cr-shallow")
+	if err != nil {
+		return nil, err
+	}
+	r := &Repo{dir: dir}
+	if _, err := r.git(nil, "init", "--quiet", "--bare"); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if _, err := r.git(bytes.NewReader(packfile), "index-pack", "--stdin"); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// AddPackfile indexes a thin packfile whose delta bases are in the repo
+func (r *Repo) AddPackfile(packfile []byte) error {
+	_, err := r.git(bytes.NewReader(packfile), "index-pack", "--stdin", "--fix-thin")
+	return err
+}
+
+// TipPack packs the given commits with their trees, but without their
+// parents. It fails if the repo doesn't have all of these objects.
+func (r *Repo) TipPack(tips []string) ([]byte, error) {
+	objects, err := r.git(nil, append([]string{"rev-list", "--objects", "--no-walk"}, tips...)...)
+	if err != nil {
+		return nil, err
+	}
+	return r.git(bytes.NewReader(objects), "pack-objects", "--stdout", "--quiet")
+}
+
+// Close deletes the temporary repo
+func (r *Repo) Close() error {
+	return os.RemoveAll(r.dir)
+}
+
+// Cut calculates the shallow commits for the given wants
+func (r *Repo) Cut(wants []string, req *Request) (*Cut, error) {
+	if req.Depth > 0 && (!req.Since.IsZero() || len(req.Not) > 0) {
+		return nil, ErrorDeepenConflict
+	}
+
+	clientShallows := map[string]bool{}
+	for _, s := range req.ClientShallows {
+		clientShallows[s] = true
+	}
+
+	if !req.Deepens() {
+		return &Cut{grafts: req.ClientShallows}, nil
+	}
+
+	args := []string{"rev-list", "--parents"}
+	if !req.Since.IsZero() {
+		args = append(args, fmt.Sprintf("--max-age=%d", req.Since.Unix()))
+	}
+	args = append(args, wants...)
+	if len(req.Not) > 0 {
+		args = append(args, "--not")
+		args = append(args, req.Not...)
+	}
+	out, err := r.git(nil, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	parents := map[string][]string{}
+	included := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		parents[fields[0]] = fields[1:]
+		included[fields[0]] = true
+	}
+
+	if req.Depth > 0 {
+		included = map[string]bool{}
+		level, depth := wants, req.Depth
+		if req.Relative {
+			level = []string{}
+			for _, s := range req.ClientShallows {
+				if _, ok := parents[s]; ok {
+					level = append(level, s)
+				}
+			}
+			depth++
+		}
+		for i := 0; i < depth && len(level) > 0; i++ {
+			next := []string{}
+			for _, c := range level {
+				if included[c] {
+					continue
+				}
+				included[c] = true
+				next = append(next, parents[c]...)
+			}
+			level = next
+		}
+	}
+
+	cut := &Cut{}
+	for c := range included {
+		for _, p := range parents[c] {
+			if !included[p] {
+				cut.grafts = append(cut.grafts, c)
+				if !clientShallows[c] {
+					cut.Shallow = append(cut.Shallow, c)
+				}
+				break
+			}
+		}
+	}
+	isGraft := map[string]bool{}
+	for _, c := range cut.grafts {
+		isGraft[c] = true
+	}
+	for _, s := range req.ClientShallows {
+		if included[s] && !isGraft[s] {
+			cut.Unshallow = append(cut.Unshallow, s)
+			cut.unshallowParents = append(cut.unshallowParents, parents[s]...)
+		}
+		// Traversing the client's haves must stop where the client's history does
+		if !isGraft[s] {
+			cut.grafts = append(cut.grafts, s)
+		}
+	}
+	return cut, nil
+}
+
+// CutTips is Cut for a request where OnlyTips is true. Other than Cut, it
+// doesn't need the parents of the wants, so it works in a repo indexed from
+// a tip pack.
+func (r *Repo) CutTips(wants []string) (*Cut, error) {
+	out, err := r.git(nil, append([]string{"rev-list", "--parents", "--no-walk"}, wants...)...)
+	if err != nil {
+		return nil, err
+	}
+	cut := &Cut{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 {
+			cut.Shallow = append(cut.Shallow, fields[0])
+			cut.grafts = append(cut.grafts, fields[0])
+		}
+	}
+	return cut, nil
+}
+
+// Pack creates a packfile with the objects for the wants that the client
+// doesn't have yet, cut at the given shallow commits
+func (r *Repo) Pack(wants, haves []string, cut *Cut) ([]byte, error) {
+	haves, err := r.existing(haves)
+	if err != nil {
+		return nil, err
+	}
+
+	var revs bytes.Buffer
+	for _, g := range cut.grafts {
+		revs.WriteString("--shallow " + g + "\n")
+	}
+	for _, w := range append(wants, cut.unshallowParents...) {
+		revs.WriteString(w + "\n")
+	}
+	revs.WriteString("--not\n")
+	for _, h := range append(haves, cut.Unshallow...) {
+		revs.WriteString(h + "\n")
+	}
+
+	return r.git(&revs, "pack-objects", "--revs", "--stdout", "--quiet")
+}
+
+// existing filters out objects that are not in the repo
+func (r *Repo) existing(ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	out, err := r.git(strings.NewReader(strings.Join(ids, "\n")+"\n"), "cat-file", "--batch-check")
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 {
+			result = append(result, fields[0])
+		}
+	}
+	return result, scanner.Err()
+}
+
+func (r *Repo) git(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir=" + r.dir}, args...)...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %v\n%s", args[0], err, stderr.String())
+	}
+	return out, nil
+}
@@ -0,0 +1,176 @@
+package shallow_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/git-cr/git/shallow"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestShallow(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Shallow Suite")
+}
+
+func git(dir string, args ...string) string {
+	return gitWithEnv(dir, nil, args...)
+}
+
+func gitWithEnv(dir string, env []string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	cmd.Env = append(cmd.Env, env...)
+	out, err := cmd.Output()
+	Ω(err).ShouldNot(HaveOccurred())
+	return strings.TrimSpace(string(out))
+}
+
+func objectCount(packfile []byte) uint32 {
+	return binary.BigEndian.Uint32(packfile[8:12])
+}
+
+var _ = Describe("Shallow", func() {
+	var (
+		tempDir string
+		commits []string
+		r       *shallow.Repo
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "io.clemente.git-cr.test")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// Three commits, one file each
+		git(tempDir, "init", "--quiet")
+		commits = nil
+		for i, date := range []string{"1400000000", "1500000000", "1600000000"} {
+			err = ioutil.WriteFile(tempDir+"/foo", []byte{byte('a' + i)}, 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			git(tempDir, "add", "foo")
+			gitWithEnv(tempDir, []string{"GIT_AUTHOR_DATE=" + date + " +0000", "GIT_COMMITTER_DATE=" + date + " +0000"}, "commit", "--quiet", "-m", "msg")
+			commits = append(commits, git(tempDir, "rev-parse", "HEAD"))
+		}
+
+		cmd := exec.Command("git", "pack-objects", "--revs", "--all", "--stdout", "--quiet")
+		cmd.Dir = tempDir
+		packfile, err := cmd.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		r, err = shallow.NewRepo(packfile)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		r.Close()
+		os.RemoveAll(tempDir)
+	})
+
+	It("cuts at a depth", func() {
+		cut, err := r.Cut(commits[2:], &shallow.Request{Depth: 1})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cut.Shallow).Should(Equal([]string{commits[2]}))
+		Ω(cut.Unshallow).Should(BeEmpty())
+
+		packfile, err := r.Pack(commits[2:], nil, cut)
+		Ω(err).ShouldNot(HaveOccurred())
+		// commit, tree and blob
+		Ω(objectCount(packfile)).Should(Equal(uint32(3)))
+	})
+
+	It("deepens relative to the client's shallow commits", func() {
+		cut, err := r.Cut(commits[2:], &shallow.Request{Depth: 1, Relative: true, ClientShallows: commits[2:]})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cut.Shallow).Should(Equal([]string{commits[1]}))
+		Ω(cut.Unshallow).Should(Equal([]string{commits[2]}))
+
+		packfile, err := r.Pack(commits[2:], commits[2:], cut)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(objectCount(packfile)).Should(Equal(uint32(3)))
+	})
+
+	It("cuts at a date", func() {
+		cut, err := r.Cut(commits[2:], &shallow.Request{Since: time.Unix(1450000000, 0)})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cut.Shallow).Should(Equal([]string{commits[1]}))
+	})
+
+	It("cuts at excluded commits", func() {
+		cut, err := r.Cut(commits[2:], &shallow.Request{Not: commits[:1]})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cut.Shallow).Should(Equal([]string{commits[1]}))
+	})
+
+	It("doesn't change clients without deepen", func() {
+		cut, err := r.Cut(commits[2:], &shallow.Request{ClientShallows: commits[1:2]})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cut.Shallow).Should(BeEmpty())
+		Ω(cut.Unshallow).Should(BeEmpty())
+
+		packfile, err := r.Pack(commits[2:], commits[1:2], cut)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(objectCount(packfile)).Should(Equal(uint32(3)))
+	})
+
+	It("ignores unknown haves", func() {
+		cut, err := r.Cut(commits[2:], &shallow.Request{Depth: 1})
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = r.Pack(commits[2:], []string{"30f79bec32243c31dd91a05c0ad7b80f1e301aea"}, cut)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("refuses depth together with deepen-since", func() {
+		_, err := r.Cut(commits[2:], &shallow.Request{Depth: 1, Since: time.Unix(1450000000, 0)})
+		Ω(err).Should(Equal(shallow.ErrorDeepenConflict))
+	})
+
+	It("cuts tip packs", func() {
+		tipPack, err := r.TipPack(commits[2:])
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(objectCount(tipPack)).Should(Equal(uint32(3)))
+
+		tips, err := shallow.NewRepo(tipPack)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer tips.Close()
+		Ω((&shallow.Request{Depth: 1}).OnlyTips()).Should(BeTrue())
+		cut, err := tips.CutTips(commits[2:])
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cut.Shallow).Should(Equal([]string{commits[2]}))
+
+		packfile, err := tips.Pack(commits[2:], nil, cut)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(objectCount(packfile)).Should(Equal(uint32(3)))
+	})
+
+	It("adds thin packfiles", func() {
+		tipPack, err := r.TipPack(commits[1:2])
+		Ω(err).ShouldNot(HaveOccurred())
+		tips, err := shallow.NewRepo(tipPack)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer tips.Close()
+
+		cmd := exec.Command("git", "pack-objects", "--revs", "--thin", "--stdout", "--quiet")
+		cmd.Dir = tempDir
+		cmd.Stdin = strings.NewReader(commits[2] + "\n^" + commits[1] + "\n")
+		thin, err := cmd.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(tips.AddPackfile(thin)).Should(Succeed())
+
+		_, err = tips.TipPack(commits[2:])
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = tips.TipPack(commits[:1])
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -1,22 +1,29 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"io"
-	"net/url"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
-	"github.com/bargez/pktline"
+	libage "filippo.io/age"
 	"github.com/codegangsta/cli"
-	"github.com/lucas-clemente/git-cr/backends/local"
-	"github.com/lucas-clemente/git-cr/crypto/nacl"
+	"github.com/lucas-clemente/git-cr/crypto/box"
+	"github.com/lucas-clemente/git-cr/crypto/padding"
 	"github.com/lucas-clemente/git-cr/git/repo"
-	"github.com/lucas-clemente/git-cr/git/handler"
+	"github.com/lucas-clemente/git-cr/remote"
 )
 
+var paddingFlag = cli.StringFlag{
+	Name:  "padding",
+	Value: "none",
+	Usage: "pad pushed files to hide their size: none, padme or pow2",
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "git cr"
@@ -27,16 +34,53 @@ func main() {
 			Name:   "add",
 			Usage:  "Setup a crypto remote in the current repo",
 			Action: add,
+			Flags:  []cli.Flag{paddingFlag},
 		},
 		{
 			Name:   "run",
-			Usage:  "Run the git server (should not be called manually)",
+			Usage:  "Run the git server for ext:: remotes (should not be called manually)",
 			Action: run,
 		},
 		{
 			Name:   "clone",
 			Usage:  "Clone from a crypto remote",
 			Action: clone,
+			Flags:  []cli.Flag{paddingFlag},
+		},
+		{
+			Name:   "keygen",
+			Usage:  "Generate a new key in the key store",
+			Action: keygen,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "box",
+					Usage: "generate a key pair for box: encryption",
+				},
+				cli.BoolFlag{
+					Name:  "age",
+					Usage: "generate an identity for age: encryption",
+				},
+			},
+		},
+		{
+			Name:   "recipients",
+			Usage:  "List the recipients of a box: encrypted remote",
+			Action: recipients,
+		},
+		{
+			Name:   "add-recipient",
+			Usage:  "Give a recipient access to a box: encrypted remote",
+			Action: addRecipient,
+		},
+		{
+			Name:   "remove-recipient",
+			Usage:  "Remove a recipient from a box: encrypted remote",
+			Action: removeRecipient,
+		},
+		{
+			Name:   "rekey",
+			Usage:  "Re-encrypt a crypto remote with new encryption settings",
+			Action: rekey,
 		},
 	}
 	app.Run(os.Args)
@@ -44,94 +88,211 @@ func main() {
 
 func add(c *cli.Context) {
 	if len(c.Args()) != 3 {
-		fmt.Println("usage: git cr add <remote name> <url> <encryption settings>")
+		fmt.Println("usage: git cr add [--padding <scheme>] <remote name> <url> <encryption settings>")
 		os.Exit(1)
 	}
 	remoteName := c.Args()[0]
 	remoteURL := c.Args()[1]
 	encryptionSettings := c.Args()[2]
-	cmd := exec.Command("git", "remote", "add", remoteName, buildRemote(remoteURL, encryptionSettings))
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("git errored: %v\n%s", err, out)
-		os.Exit(1)
-	}
-}
-
-type pktlineDecoderWrapper struct {
-	*pktline.Decoder
-	io.Reader
+	paddingScheme := parsePadding(c)
+	runGit("remote", "add", remoteName, buildRemote(remoteURL))
+	setRemoteConfig(".", remoteName, encryptionSettings, paddingScheme)
 }
 
+// run serves remotes added by earlier versions as
+// ext::git cr %G run <url> <encryption settings>
 func run(c *cli.Context) {
 	if len(c.Args()) != 2 {
 		fmt.Println("don't run this manually, checkout git cr help :)")
 		os.Exit(1)
 	}
 
-	repoURLString := c.Args()[0]
-	encryptionSettings := c.Args()[1]
-
-	repoURL, err := url.Parse(repoURLString)
+	repo, err := remote.Open(c.Args()[0], c.Args()[1])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "an error occured while parsing the URL:\n%v\n", err)
+		fmt.Fprintf(os.Stderr, "an error occured while initing the repo:\n%v\n", err)
 		os.Exit(1)
 	}
 
-	// Load repo
+	if err := remote.Serve(os.Stdin, os.Stdout, repo, os.Getenv("GIT_PROTOCOL")); err != nil {
+		fmt.Fprintf(os.Stderr, "an error occured while serving git:\n%v\n", err)
+		os.Exit(1)
+	}
+}
 
-	backend, err := local.NewLocalBackend(repoURL.Path)
+func clone(c *cli.Context) {
+	if len(c.Args()) < 2 || len(c.Args()) > 3 {
+		fmt.Println("usage: git cr clone [--padding <scheme>] <url> <encryption settings> [destination]")
+		os.Exit(1)
+	}
+	remoteURL := c.Args()[0]
+	encryptionSettings := c.Args()[1]
+	paddingScheme := parsePadding(c)
+	dir := cloneDir(remoteURL)
+	if len(c.Args()) == 3 {
+		dir = c.Args()[2]
+	}
+	if dir == "" {
+		fmt.Println("could not derive a destination from the url, please specify one")
+		os.Exit(1)
+	}
+	if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) > 0 {
+		fmt.Printf("destination path '%s' already exists and is not an empty directory\n", dir)
+		os.Exit(1)
+	}
+
+	// git clone would only take the settings as arguments
+	runGit("init", "--quiet", dir)
+	runGit("-C", dir, "remote", "add", "origin", buildRemote(remoteURL))
+	setRemoteConfig(dir, "origin", encryptionSettings, paddingScheme)
+	runGit("-C", dir, "fetch", "--quiet", "origin")
+
+	// Empty remotes have no HEAD to check out
+	if exec.Command("git", "-C", dir, "remote", "set-head", "origin", "--auto").Run() != nil {
+		return
+	}
+	head, err := exec.Command("git", "-C", dir, "symbolic-ref", "--short", "refs/remotes/origin/HEAD").Output()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "an error occured while initing the repo:\n%v\n", err)
+		fmt.Printf("git errored: %v\n", err)
 		os.Exit(1)
 	}
+	runGit("-C", dir, "checkout", "--quiet", strings.TrimPrefix(strings.TrimSpace(string(head)), "origin/"))
+}
+
+// cloneDir derives the destination of a clone from the url like git does,
+// e.g. repo for s3://bucket/path/repo?region=eu-west-1
+func cloneDir(remoteURL string) string {
+	name := remoteURL
+	if i := strings.IndexAny(name, "?#"); i != -1 {
+		name = name[:i]
+	}
+	name = strings.TrimSuffix(strings.TrimRight(name, "/"), ".git")
+	if i := strings.LastIndexAny(name, "/:"); i != -1 {
+		name = name[i+1:]
+	}
+	return name
+}
 
-	// Wrap in encryption
+func keygen(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Println("usage: git cr keygen [--box|--age] <key name>")
+		os.Exit(1)
+	}
+	name := c.Args()[0]
 
-	if encryptionSettings == "none" {
-		// Do nothing
-	} else if strings.HasPrefix(encryptionSettings, "nacl:") {
-		secretB64 := strings.TrimPrefix(encryptionSettings, "nacl:")
-		secret, err := base64.StdEncoding.DecodeString(secretB64)
-		if err != nil || len(secret) != 32 {
-			fmt.Fprintf(os.Stderr, "the nacl secret should be 32 bytes in base64")
+	var settings, recipient string
+	if c.Bool("age") {
+		identity, err := libage.GenerateX25519Identity()
+		if err != nil {
+			fmt.Printf("could not generate key: %v\n", err)
 			os.Exit(1)
 		}
-
-		secretArray := [32]byte{}
-		copy(secretArray[:], secret)
-		backend = nacl.NewNaClBackend(backend, secretArray)
+		settings = "age:" + identity.String()
+		recipient = identity.Recipient().String()
+	} else if c.Bool("box") {
+		identity, r, err := box.GenerateKey()
+		if err != nil {
+			fmt.Printf("could not generate key: %v\n", err)
+			os.Exit(1)
+		}
+		settings = "box:" + identity
+		recipient = r
 	} else {
-		fmt.Fprintf(os.Stderr, "the encryption settings are invalid")
-		os.Exit(1)
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			fmt.Printf("could not generate key: %v\n", err)
+			os.Exit(1)
+		}
+		settings = "nacl:" + base64.StdEncoding.EncodeToString(secret)
 	}
 
-	// Setup repo
+	if err := remote.StoreKey(name, settings); err != nil {
+		fmt.Printf("could not store key: %v\n", err)
+		os.Exit(1)
+	}
+	path, _ := remote.KeyStorePath()
+	fmt.Printf("stored new key in %s, use key:%s as encryption settings\n", path, name)
+	if recipient != "" {
+		fmt.Printf("your public key is %s\n", recipient)
+	}
+}
 
-	repo := repo.NewJSONRepo(backend)
+// openBoxBackend returns the unencrypted backend and the box: identity for
+// the recipient commands
+func openBoxBackend(c *cli.Context, usage string) (repo.Backend, string) {
+	if len(c.Args()) != 3 {
+		fmt.Println("usage: " + usage)
+		os.Exit(1)
+	}
+	settings, err := remote.ResolveSettings(c.Args()[1])
+	if err != nil {
+		fmt.Printf("invalid encryption settings: %v\n", err)
+		os.Exit(1)
+	}
+	if !strings.HasPrefix(settings, "box:") {
+		fmt.Println("recipients are only supported for box: encryption")
+		os.Exit(1)
+	}
+	backend, err := remote.OpenBackend(c.Args()[0])
+	if err != nil {
+		fmt.Printf("an error occured while initing the repo:\n%v\n", err)
+		os.Exit(1)
+	}
+	return backend, strings.TrimPrefix(settings, "box:")
+}
 
-	// Handle request
+func recipients(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Println("usage: git cr recipients <url>")
+		os.Exit(1)
+	}
+	backend, err := remote.OpenBackend(c.Args()[0])
+	if err != nil {
+		fmt.Printf("an error occured while initing the repo:\n%v\n", err)
+		os.Exit(1)
+	}
+	rs, err := box.Recipients(backend)
+	if err != nil {
+		fmt.Printf("could not read recipients: %v\n", err)
+		os.Exit(1)
+	}
+	for _, r := range rs {
+		fmt.Println(r)
+	}
+}
 
-	encoder := pktline.NewEncoder(os.Stdout)
-	decoder := &pktlineDecoderWrapper{Decoder: pktline.NewDecoder(os.Stdin), Reader: os.Stdin}
+func addRecipient(c *cli.Context) {
+	backend, identity := openBoxBackend(c, "git cr add-recipient <url> <encryption settings> <recipient>")
+	if err := box.AddRecipient(backend, identity, c.Args()[2]); err != nil {
+		fmt.Printf("could not add recipient: %v\n", err)
+		os.Exit(1)
+	}
+}
 
-	server := handler.NewGitRequestHandler(encoder, decoder, repo)
-	if err := server.ServeRequest(); err != nil {
-		fmt.Fprintf(os.Stderr, "an error occured while serving git:\n%v\n", err)
+func removeRecipient(c *cli.Context) {
+	backend, identity := openBoxBackend(c, "git cr remove-recipient <url> <encryption settings> <recipient>")
+	if err := box.RemoveRecipient(backend, identity, c.Args()[2]); err != nil {
+		fmt.Printf("could not remove recipient: %v\n", err)
+		os.Exit(1)
 	}
 }
 
-func clone(c *cli.Context) {
-	if len(c.Args()) < 2 {
-		fmt.Println("usage: git cr clone <url> <encryption settings> [destination]")
+func rekey(c *cli.Context) {
+	if len(c.Args()) != 3 {
+		fmt.Println("usage: git cr rekey <url> <old encryption settings> <new encryption settings>")
 		os.Exit(1)
 	}
-	remoteURL := c.Args()[0]
-	encryptionSettings := c.Args()[1]
+	err := remote.Rekey(c.Args()[0], c.Args()[1], c.Args()[2], func(done, total int) {
+		fmt.Printf("\rRekeying blobs: %d/%d", done, total)
+	})
+	if err != nil {
+		fmt.Printf("\ncould not rekey: %v\nthe remote can't be used until the rekey is finished, run the same command again to continue\n", err)
+		os.Exit(1)
+	}
+	fmt.Println()
+}
 
-	cloneArgs := []string{"clone", buildRemote(remoteURL, encryptionSettings)}
-	cloneArgs = append(cloneArgs, c.Args()[2:]...)
-	cmd := exec.Command("git", cloneArgs...)
+func runGit(args ...string) {
+	cmd := exec.Command("git", args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		fmt.Printf("git errored: %v\n%s", err, out)
@@ -139,6 +300,57 @@ func clone(c *cli.Context) {
 	}
 }
 
-func buildRemote(url, encryptionSettings string) string {
-	return "ext::git cr %G run " + url + " " + encryptionSettings
+// setRemoteConfig appends the encryption settings and padding scheme of a
+// remote to the config of the repo in dir. Other users can see the arguments
+// of git config in the process list, so the file is written directly.
+func setRemoteConfig(dir, remoteName, encryptionSettings, paddingScheme string) {
+	if strings.ContainsAny(encryptionSettings, "\r\n") {
+		fmt.Println(remote.ErrInvalidEncryptionSettings)
+		os.Exit(1)
+	}
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--git-path", "config").Output()
+	if err != nil {
+		fmt.Printf("git errored: %v\n", err)
+		os.Exit(1)
+	}
+	path := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	entries := fmt.Sprintf("[remote %s]\n\tcrEncryption = %s\n", quoteConfig(remoteName), quoteConfig(encryptionSettings))
+	if paddingScheme != "none" {
+		entries += fmt.Sprintf("\tcrPadding = %s\n", paddingScheme)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		_, err = f.WriteString(entries)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Printf("could not write the git config: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// quoteConfig quotes a value or subsection name for a git config file
+func quoteConfig(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// buildRemote returns a URL that makes git start git-remote-cr
+func buildRemote(url string) string {
+	return "cr::" + url
+}
+
+// parsePadding returns the --padding flag, exiting if it is invalid
+func parsePadding(c *cli.Context) string {
+	paddingScheme := c.String("padding")
+	if _, err := padding.ParseScheme(paddingScheme); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return paddingScheme
 }
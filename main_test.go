@@ -6,6 +6,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+
+	"github.com/lucas-clemente/git-cr/crypto/padding"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -38,6 +41,7 @@ var _ = Describe("Main", func() {
 		pathToGitCR        string
 		folderOfGitCR      string
 		encryptionSettings string
+		paddingScheme      string
 	)
 
 	BeforeSuite(func() {
@@ -45,6 +49,10 @@ var _ = Describe("Main", func() {
 		pathToGitCR, err = gexec.Build("github.com/lucas-clemente/git-cr")
 		Ω(err).ShouldNot(HaveOccurred())
 		folderOfGitCR = filepath.Dir(pathToGitCR)
+		pathToHelper, err := gexec.Build("github.com/lucas-clemente/git-cr/cmd/git-remote-cr")
+		Ω(err).ShouldNot(HaveOccurred())
+		// git-remote-cr needs to be in the PATH to be discovered by git
+		os.Setenv("PATH", filepath.Dir(pathToHelper)+":"+folderOfGitCR+":"+os.Getenv("PATH"))
 	})
 
 	AfterSuite(func() {
@@ -57,11 +65,23 @@ var _ = Describe("Main", func() {
 		Ω(err).ShouldNot(HaveOccurred())
 		remoteDir, err = ioutil.TempDir("", "io.clemente.git-cr.test")
 		Ω(err).ShouldNot(HaveOccurred())
-
+		paddingScheme = ""
 	})
 
 	remoteURL := func() string {
-		return "ext::" + pathToGitCR + " %G run " + "file://" + remoteDir + " " + encryptionSettings
+		return "cr::file://" + remoteDir
+	}
+
+	addRemote := func() {
+		runCommandInDir(workingDir, "git", "remote", "add", "origin", remoteURL())
+		runCommandInDir(workingDir, "git", "config", "remote.origin.crEncryption", encryptionSettings)
+		if paddingScheme != "" {
+			runCommandInDir(workingDir, "git", "config", "remote.origin.crPadding", paddingScheme)
+		}
+	}
+
+	cloneRemote := func(dir string) error {
+		return exec.Command("git", "clone", "-c", "remote.origin.crEncryption="+encryptionSettings, "-c", "remote.origin.crPadding="+paddingScheme, remoteURL(), dir).Run()
 	}
 
 	AfterEach(func() {
@@ -81,14 +101,23 @@ var _ = Describe("Main", func() {
 			cmd.Dir = workingDir
 			output, err := cmd.CombinedOutput()
 			Ω(err).ShouldNot(HaveOccurred())
-			Ω(output).Should(ContainSubstring("origin\text::git cr %G run " + remoteDir + " " + encryptionSettings))
+			Ω(output).Should(ContainSubstring("origin\tcr::" + remoteDir))
+			if encryptionSettings != "none" {
+				Ω(output).ShouldNot(ContainSubstring(encryptionSettings))
+			}
+
+			cmd = exec.Command("git", "config", "remote.origin.crEncryption")
+			cmd.Dir = workingDir
+			output, err = cmd.CombinedOutput()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(output)).Should(Equal(encryptionSettings + "\n"))
 		})
 
 		It("pushes updates", func() {
 			runCommandInDir(workingDir, "git", "init")
 			configGit(workingDir)
 
-			runCommandInDir(workingDir, "git", "remote", "add", "origin", remoteURL())
+			addRemote()
 
 			err := ioutil.WriteFile(workingDir+"/foo", []byte("foobar"), 0644)
 			Ω(err).ShouldNot(HaveOccurred())
@@ -102,7 +131,7 @@ var _ = Describe("Main", func() {
 			runCommandInDir(workingDir, "git", "init")
 			configGit(workingDir)
 
-			runCommandInDir(workingDir, "git", "remote", "add", "origin", remoteURL())
+			addRemote()
 
 			err := ioutil.WriteFile(workingDir+"/foo", []byte("foobar"), 0644)
 			Ω(err).ShouldNot(HaveOccurred())
@@ -126,7 +155,7 @@ var _ = Describe("Main", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 			runCommandInDir(workingDir, "git", "add", "bar")
 			runCommandInDir(workingDir, "git", "commit", "-m", "test2")
-			runCommandInDir(workingDir, "git", "remote", "add", "origin", remoteURL())
+			addRemote()
 			runCommandInDir(workingDir, "git", "push", "origin", "master")
 			runCommandInDir(workingDir, "git", "reset", "--hard", "HEAD^")
 			runCommandInDir(workingDir, "git", "push", "-f", "origin", "master")
@@ -137,8 +166,7 @@ var _ = Describe("Main", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 			defer os.RemoveAll(workingDir2)
 
-			cmd := exec.Command("git", "clone", remoteURL(), workingDir2)
-			err = cmd.Run()
+			err = cloneRemote(workingDir2)
 			Ω(err).ShouldNot(HaveOccurred())
 
 			contents, err := ioutil.ReadFile(workingDir2 + "/foo")
@@ -156,7 +184,7 @@ var _ = Describe("Main", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 			runCommandInDir(workingDir, "git", "add", "foo")
 			runCommandInDir(workingDir, "git", "commit", "-m", "test")
-			runCommandInDir(workingDir, "git", "remote", "add", "origin", remoteURL())
+			addRemote()
 			runCommandInDir(workingDir, "git", "push", "origin", "master")
 
 			err = ioutil.WriteFile(workingDir+"/bar", []byte("foobaz"), 0644)
@@ -171,8 +199,7 @@ var _ = Describe("Main", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 			defer os.RemoveAll(workingDir2)
 
-			cmd := exec.Command("git", "clone", remoteURL(), workingDir2)
-			err = cmd.Run()
+			err = cloneRemote(workingDir2)
 			Ω(err).ShouldNot(HaveOccurred())
 
 			contents, err := ioutil.ReadFile(workingDir2 + "/foo")
@@ -182,6 +209,91 @@ var _ = Describe("Main", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 			Ω(contents).Should(Equal([]byte("foobaz")))
 		})
+
+		It("fetches with protocol v2", func() {
+			runCommandInDir(workingDir, "git", "init")
+			configGit(workingDir)
+			err := ioutil.WriteFile(workingDir+"/foo", []byte("foobar"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			runCommandInDir(workingDir, "git", "add", "foo")
+			runCommandInDir(workingDir, "git", "commit", "-m", "test")
+			addRemote()
+			runCommandInDir(workingDir, "git", "push", "origin", "master")
+
+			workingDir2, err := ioutil.TempDir("", "io.clemente.git-cr.test")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(workingDir2)
+			runCommandInDir(workingDir2, "git", "init")
+			runCommandInDir(workingDir2, "git", "remote", "add", "origin", remoteURL())
+			runCommandInDir(workingDir2, "git", "config", "remote.origin.crEncryption", encryptionSettings)
+			runCommandInDir(workingDir2, "git", "config", "remote.origin.crPadding", paddingScheme)
+
+			cmd := exec.Command("git", "-c", "protocol.version=2", "fetch", "origin", "master")
+			cmd.Dir = workingDir2
+			cmd.Env = append(os.Environ(), "GIT_TRACE_PACKET=1")
+			output, err := cmd.CombinedOutput()
+			Ω(err).ShouldNot(HaveOccurred(), string(output))
+			Ω(string(output)).Should(ContainSubstring("command=ls-refs"))
+			Ω(string(output)).Should(ContainSubstring("ref-prefix refs/heads/master"))
+			Ω(string(output)).Should(ContainSubstring("command=fetch"))
+			runCommandInDir(workingDir2, "git", "cat-file", "-e", "FETCH_HEAD:foo")
+		})
+
+		It("fetches with protocol v0", func() {
+			runCommandInDir(workingDir, "git", "init")
+			configGit(workingDir)
+			err := ioutil.WriteFile(workingDir+"/foo", []byte("foobar"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			runCommandInDir(workingDir, "git", "add", "foo")
+			runCommandInDir(workingDir, "git", "commit", "-m", "test")
+			addRemote()
+			runCommandInDir(workingDir, "git", "push", "origin", "master")
+
+			workingDir2, err := ioutil.TempDir("", "io.clemente.git-cr.test")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(workingDir2)
+			err = exec.Command("git", "-c", "protocol.version=0", "clone", "-c", "remote.origin.crEncryption="+encryptionSettings, "-c", "remote.origin.crPadding="+paddingScheme, remoteURL(), workingDir2).Run()
+			Ω(err).ShouldNot(HaveOccurred())
+			contents, err := ioutil.ReadFile(workingDir2 + "/foo")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal([]byte("foobar")))
+
+			err = ioutil.WriteFile(workingDir+"/bar", []byte("foobaz"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			runCommandInDir(workingDir, "git", "add", "bar")
+			runCommandInDir(workingDir, "git", "commit", "-m", "test2")
+			runCommandInDir(workingDir, "git", "push", "origin", "master")
+			runCommandInDir(workingDir2, "git", "-c", "protocol.version=0", "pull", "origin", "master")
+			contents, err = ioutil.ReadFile(workingDir2 + "/bar")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal([]byte("foobaz")))
+		})
+
+		It("still serves ext:: remotes", func() {
+			runCommandInDir(workingDir, "git", "init")
+			configGit(workingDir)
+
+			err := ioutil.WriteFile(workingDir+"/foo", []byte("foobar"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			runCommandInDir(workingDir, "git", "add", "foo")
+			runCommandInDir(workingDir, "git", "commit", "-m", "test")
+			addRemote()
+			runCommandInDir(workingDir, "git", "push", "origin", "master")
+
+			workingDir2, err := ioutil.TempDir("", "io.clemente.git-cr.test")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(workingDir2)
+
+			// "% " is a literal space in ext:: URLs
+			extURL := "ext::" + pathToGitCR + " %G run " + "file://" + remoteDir + " " + strings.Replace(encryptionSettings, " ", "% ", -1)
+			cmd := exec.Command("git", "-c", "protocol.ext.allow=always", "clone", extURL, workingDir2)
+			err = cmd.Run()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			contents, err := ioutil.ReadFile(workingDir2 + "/foo")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal([]byte("foobar")))
+		})
 	}
 
 	Context("without encryption", func() {
@@ -201,8 +313,7 @@ var _ = Describe("Main", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 
 			cmd := exec.Command(pathToGitCR, "clone", remoteDir, encryptionSettings, workingDir)
-			// git-cr needs to be in the PATH to be discovered by the ext:: remote
-			cmd.Env = []string{"PATH=" + folderOfGitCR + ":" + os.Getenv("PATH")}
+			cmd.Env = []string{"PATH=" + os.Getenv("PATH")}
 			err = cmd.Run()
 			Ω(err).ShouldNot(HaveOccurred())
 
@@ -218,5 +329,273 @@ var _ = Describe("Main", func() {
 		})
 
 		sharedTests()
+
+		It("hides blob names", func() {
+			runCommandInDir(workingDir, "git", "init")
+			configGit(workingDir)
+			err := ioutil.WriteFile(workingDir+"/foo", []byte("foobar"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			runCommandInDir(workingDir, "git", "add", "foo")
+			runCommandInDir(workingDir, "git", "commit", "-m", "test")
+			addRemote()
+			runCommandInDir(workingDir, "git", "push", "origin", "master")
+
+			files, err := ioutil.ReadDir(remoteDir)
+			Ω(err).ShouldNot(HaveOccurred())
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name())
+			}
+			Ω(names).Should(ContainElement("names.key.nacl"))
+			Ω(names).ShouldNot(ContainElement("revisions.json.nacl"))
+			Ω(names).ShouldNot(ContainElement("0.pack.nacl"))
+			Ω(names).Should(HaveLen(5))
+		})
+
+		It("detects rollbacks", func() {
+			runCommandInDir(workingDir, "git", "init")
+			configGit(workingDir)
+			err := ioutil.WriteFile(workingDir+"/foo", []byte("foobar"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			runCommandInDir(workingDir, "git", "add", "foo")
+			runCommandInDir(workingDir, "git", "commit", "-m", "test")
+			addRemote()
+			runCommandInDir(workingDir, "git", "push", "origin", "master")
+
+			snapshot := map[string][]byte{}
+			files, err := ioutil.ReadDir(remoteDir)
+			Ω(err).ShouldNot(HaveOccurred())
+			for _, f := range files {
+				snapshot[f.Name()], err = ioutil.ReadFile(remoteDir + "/" + f.Name())
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+
+			err = ioutil.WriteFile(workingDir+"/bar", []byte("foobaz"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			runCommandInDir(workingDir, "git", "add", "bar")
+			runCommandInDir(workingDir, "git", "commit", "-m", "test2")
+			runCommandInDir(workingDir, "git", "push", "origin", "master")
+
+			// The storage serves the old revisions again
+			files, err = ioutil.ReadDir(remoteDir)
+			Ω(err).ShouldNot(HaveOccurred())
+			for _, f := range files {
+				if _, ok := snapshot[f.Name()]; !ok {
+					Ω(os.Remove(remoteDir + "/" + f.Name())).Should(Succeed())
+				}
+			}
+			for name, data := range snapshot {
+				Ω(ioutil.WriteFile(remoteDir+"/"+name, data, 0644)).Should(Succeed())
+			}
+			cmd := exec.Command("git", "fetch", "origin")
+			cmd.Dir = workingDir
+			output, err := cmd.CombinedOutput()
+			Ω(err).Should(HaveOccurred())
+			Ω(string(output)).Should(ContainSubstring("remote error: the remote's revisions are older"))
+		})
+	})
+
+	Context("with padding", func() {
+		BeforeEach(func() {
+			encryptionSettings = "nacl:" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+			paddingScheme = "padme"
+		})
+
+		sharedTests()
+
+		It("pads pushed files", func() {
+			runCommandInDir(workingDir, "git", "init")
+			configGit(workingDir)
+			err := ioutil.WriteFile(workingDir+"/foo", []byte("foobar"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			runCommandInDir(workingDir, "git", "add", "foo")
+			runCommandInDir(workingDir, "git", "commit", "-m", "test")
+			runCommandInDir(workingDir, pathToGitCR, "add", "--padding", "padme", "origin", "file://"+remoteDir, encryptionSettings)
+			runCommandInDir(workingDir, "git", "push", "origin", "master")
+
+			files, err := ioutil.ReadDir(remoteDir)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(files).Should(HaveLen(5))
+			for _, f := range files {
+				if f.Name() == "names.key.nacl" {
+					continue
+				}
+				// Subtract the header, the nonce prefix and the overhead of the
+				// only chunk
+				size := f.Size() - 49
+				Ω(padding.Padme(size)).Should(Equal(size))
+			}
+		})
+
+		It("clones with padding", func() {
+			runCommandInDir(workingDir, "git", "init")
+			runCommandInDir(workingDir, pathToGitCR, "clone", "--padding", "pow2", "file://"+remoteDir, encryptionSettings, "clone")
+
+			cmd := exec.Command("git", "config", "remote.origin.crPadding")
+			cmd.Dir = workingDir + "/clone"
+			output, err := cmd.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(output)).Should(Equal("pow2\n"))
+		})
+	})
+
+	Context("with a passphrase", func() {
+		BeforeEach(func() {
+			encryptionSettings = "nacl-pass:correct horse battery staple"
+		})
+
+		sharedTests()
+
+		It("clones with settings that need quoting", func() {
+			encryptionSettings = `nacl-pass:correct "horse" \battery; staple`
+			runCommandInDir(workingDir, "git", "init")
+			configGit(workingDir)
+			Ω(ioutil.WriteFile(workingDir+"/foo", []byte("foobar"), 0644)).Should(Succeed())
+			runCommandInDir(workingDir, "git", "add", "foo")
+			runCommandInDir(workingDir, "git", "commit", "-m", "test")
+			runCommandInDir(workingDir, pathToGitCR, "add", "origin", "file://"+remoteDir, encryptionSettings)
+			runCommandInDir(workingDir, "git", "push", "origin", "master")
+
+			runCommandInDir(workingDir, pathToGitCR, "clone", "file://"+remoteDir, encryptionSettings, "clone")
+			data, err := ioutil.ReadFile(workingDir + "/clone/foo")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(data).Should(Equal([]byte("foobar")))
+			cmd := exec.Command("git", "config", "remote.origin.crEncryption")
+			cmd.Dir = workingDir + "/clone"
+			output, err := cmd.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(output)).Should(Equal(encryptionSettings + "\n"))
+		})
+	})
+
+	Context("with a key from the key store", func() {
+		var configDir string
+
+		BeforeEach(func() {
+			var err error
+			configDir, err = ioutil.TempDir("", "io.clemente.git-cr.test")
+			Ω(err).ShouldNot(HaveOccurred())
+			os.Setenv("XDG_CONFIG_HOME", configDir)
+			runCommandInDir(workingDir, pathToGitCR, "keygen", "test")
+			encryptionSettings = "key:test"
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("XDG_CONFIG_HOME")
+			os.RemoveAll(configDir)
+		})
+
+		sharedTests()
+
+		It("restricts access to the key store", func() {
+			info, err := os.Stat(configDir + "/git-cr/keys")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Mode().Perm()).Should(Equal(os.FileMode(0600)))
+		})
+	})
+
+	Context("with age encryption", func() {
+		var configDir string
+
+		BeforeEach(func() {
+			var err error
+			configDir, err = ioutil.TempDir("", "io.clemente.git-cr.test")
+			Ω(err).ShouldNot(HaveOccurred())
+			os.Setenv("XDG_CONFIG_HOME", configDir)
+			runCommandInDir(workingDir, pathToGitCR, "keygen", "--age", "test")
+			encryptionSettings = "key:test"
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("XDG_CONFIG_HOME")
+			os.RemoveAll(configDir)
+		})
+
+		sharedTests()
+
+		It("rekeys remotes", func() {
+			runCommandInDir(workingDir, "git", "init")
+			configGit(workingDir)
+			err := ioutil.WriteFile(workingDir+"/foo", []byte("foobar"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			runCommandInDir(workingDir, "git", "add", "foo")
+			runCommandInDir(workingDir, "git", "commit", "-m", "test")
+			addRemote()
+			runCommandInDir(workingDir, "git", "push", "origin", "master")
+
+			runCommandInDir(workingDir, pathToGitCR, "keygen", "--age", "new")
+			runCommandInDir(workingDir, pathToGitCR, "rekey", "file://"+remoteDir, "key:test", "key:new")
+
+			workingDir2, err := ioutil.TempDir("", "io.clemente.git-cr.test")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(workingDir2)
+			err = cloneRemote(workingDir2)
+			Ω(err).Should(HaveOccurred())
+
+			encryptionSettings = "key:new"
+			err = cloneRemote(workingDir2)
+			Ω(err).ShouldNot(HaveOccurred())
+			contents, err := ioutil.ReadFile(workingDir2 + "/foo")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal([]byte("foobar")))
+		})
+	})
+
+	Context("with box encryption", func() {
+		var configDir string
+
+		BeforeEach(func() {
+			var err error
+			configDir, err = ioutil.TempDir("", "io.clemente.git-cr.test")
+			Ω(err).ShouldNot(HaveOccurred())
+			os.Setenv("XDG_CONFIG_HOME", configDir)
+			runCommandInDir(workingDir, pathToGitCR, "keygen", "--box", "test")
+			encryptionSettings = "key:test"
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("XDG_CONFIG_HOME")
+			os.RemoveAll(configDir)
+		})
+
+		sharedTests()
+
+		It("manages recipients", func() {
+			runCommandInDir(workingDir, "git", "init")
+			configGit(workingDir)
+			err := ioutil.WriteFile(workingDir+"/foo", []byte("foobar"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			runCommandInDir(workingDir, "git", "add", "foo")
+			runCommandInDir(workingDir, "git", "commit", "-m", "test")
+			addRemote()
+			runCommandInDir(workingDir, "git", "push", "origin", "master")
+
+			output, err := exec.Command(pathToGitCR, "keygen", "--box", "bob").Output()
+			Ω(err).ShouldNot(HaveOccurred())
+			lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+			bob := strings.TrimPrefix(lines[len(lines)-1], "your public key is ")
+
+			runCommandInDir(workingDir, pathToGitCR, "add-recipient", "file://"+remoteDir, "key:test", bob)
+			output, err = exec.Command(pathToGitCR, "recipients", "file://"+remoteDir).Output()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(output)).Should(ContainSubstring(bob))
+
+			workingDir2, err := ioutil.TempDir("", "io.clemente.git-cr.test")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(workingDir2)
+			encryptionSettings = "key:bob"
+			err = cloneRemote(workingDir2)
+			Ω(err).ShouldNot(HaveOccurred())
+			contents, err := ioutil.ReadFile(workingDir2 + "/foo")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(contents).Should(Equal([]byte("foobar")))
+
+			runCommandInDir(workingDir, pathToGitCR, "remove-recipient", "file://"+remoteDir, "key:test", bob)
+			workingDir3, err := ioutil.TempDir("", "io.clemente.git-cr.test")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(workingDir3)
+			err = cloneRemote(workingDir3)
+			Ω(err).Should(HaveOccurred())
+		})
 	})
 })
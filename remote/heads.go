@@ -0,0 +1,84 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+// ErrInvalidHeadFile occurs if a head file can't be parsed
+var ErrInvalidHeadFile = errors.New("invalid head file")
+
+type fileHeadStore struct {
+	path string
+}
+
+// NewFileHeadStore returns a repo.HeadStore that keeps the head in a file as
+// "<index> <hash>", followed by " strict" for repos in strict mode
+func NewFileHeadStore(path string) repo.HeadStore {
+	return &fileHeadStore{path: path}
+}
+
+// HeadStorePath returns where the head of the remote repo is remembered for a
+// local git dir
+func HeadStorePath(gitDir, repoURL string) string {
+	sum := sha256.Sum256([]byte(repoURL))
+	return filepath.Join(gitDir, "cr", "heads", hex.EncodeToString(sum[:]))
+}
+
+func (s *fileHeadStore) GetHead() (repo.Head, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return repo.Head{}, nil
+	}
+	if err != nil {
+		return repo.Head{}, err
+	}
+	var head repo.Head
+	fields := strings.Fields(string(data))
+	if len(fields) == 3 && fields[2] == "strict" {
+		head.Strict = true
+		fields = fields[:2]
+	}
+	if len(fields) != 2 {
+		return repo.Head{}, ErrInvalidHeadFile
+	}
+	head.Index, err = strconv.Atoi(fields[0])
+	if err != nil || head.Index < 0 {
+		return repo.Head{}, ErrInvalidHeadFile
+	}
+	head.Hash = fields[1]
+	return head, nil
+}
+
+func (s *fileHeadStore) SaveHead(head repo.Head) error {
+	line := fmt.Sprintf("%d %s", head.Index, head.Hash)
+	if head.Strict {
+		line += " strict"
+	}
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".head")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
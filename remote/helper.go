@@ -0,0 +1,144 @@
+package remote
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+// ErrUnknownService occurs if git wants to connect to a service other than
+// git-upload-pack
+var ErrUnknownService = errors.New("unknown service requested by git")
+
+// helperCapabilities are sent in answer to the capabilities command
+const helperCapabilities = "stateless-connect\nfetch\npush\n"
+
+// A Helper speaks the git remote helper protocol (see gitremote-helpers(1)).
+// git uses stateless-connect for fetches with protocol v2, the default since
+// git 2.26, and the fetch command for older protocol versions. Pushes always
+// use the push command. git doesn't tell connect helpers which protocol
+// version it speaks, so the helper doesn't offer connect.
+type Helper struct {
+	in   *bufio.Reader
+	out  io.Writer
+	repo repo.Repo
+}
+
+// NewHelper makes a remote helper reading commands from in
+func NewHelper(in io.Reader, out io.Writer, r repo.Repo) *Helper {
+	return &Helper{
+		in:   bufio.NewReader(in),
+		out:  out,
+		repo: r,
+	}
+}
+
+// Run answers commands until git hangs up or a connection was served
+func (h *Helper) Run() error {
+	for {
+		line, err := h.in.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		command := strings.TrimSuffix(line, "\n")
+
+		switch {
+		case command == "":
+			// A blank line ends the session
+			return nil
+		case command == "capabilities":
+			err = h.write(helperCapabilities + "\n")
+		case command == "list" || command == "list for-push":
+			err = h.List()
+		case strings.HasPrefix(command, "stateless-connect "):
+			return h.StatelessConnect(strings.TrimPrefix(command, "stateless-connect "))
+		case strings.HasPrefix(command, "fetch "):
+			var batch []string
+			if batch, err = h.readBatch(command, "fetch "); err == nil {
+				err = h.Fetch(batch)
+			}
+		case strings.HasPrefix(command, "push "):
+			var batch []string
+			if batch, err = h.readBatch(command, "push "); err == nil {
+				err = h.Push(batch)
+			}
+		default:
+			return fmt.Errorf("unsupported remote helper command %q", command)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readBatch reads the commands git sends after the first one of a batch, up
+// to the blank line that ends it, and returns their arguments
+func (h *Helper) readBatch(first, prefix string) ([]string, error) {
+	batch := []string{strings.TrimPrefix(first, prefix)}
+	for {
+		line, err := h.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return batch, nil
+		}
+		if !strings.HasPrefix(line, prefix) {
+			return nil, fmt.Errorf("unexpected remote helper command %q in batch", line)
+		}
+		batch = append(batch, strings.TrimPrefix(line, prefix))
+	}
+}
+
+// List sends the refs of the current revision
+func (h *Helper) List() error {
+	revisions, err := h.repo.GetRevisions()
+	if err != nil {
+		return err
+	}
+	refs := repo.Revision{}
+	if len(revisions) > 0 {
+		refs = revisions[len(revisions)-1]
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := h.write(refs[name] + " " + name + "\n"); err != nil {
+			return err
+		}
+	}
+	return h.write("\n")
+}
+
+// StatelessConnect serves protocol v2 for git-upload-pack over the helper's
+// stdin and stdout
+func (h *Helper) StatelessConnect(service string) error {
+	if service != "git-upload-pack" {
+		return ErrUnknownService
+	}
+
+	// An empty line tells git that the connection is established
+	if err := h.write("\n"); err != nil {
+		return err
+	}
+	return newHandler(h.in, h.out, h.repo, "version=2").ServeStatelessV2()
+}
+
+func (h *Helper) write(s string) error {
+	_, err := io.WriteString(h.out, s)
+	return err
+}
@@ -0,0 +1,182 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrKeyNotFound occurs if a key reference can't be resolved
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrInvalidKeyName occurs if a key name contains anything but letters, digits, '.', '_' and '-'
+	ErrInvalidKeyName = errors.New("invalid key name")
+	// ErrKeyExists occurs if a key with the same name is already in the key store
+	ErrKeyExists = errors.New("key already exists in the key store")
+)
+
+var keyNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// A KeyStorePermissionsError occurs if the key store is accessible by other users
+type KeyStorePermissionsError struct {
+	Path string
+	Mode os.FileMode
+}
+
+func (e *KeyStorePermissionsError) Error() string {
+	return fmt.Sprintf("permissions %#o for %s are too open, the key store must only be accessible by its owner", e.Mode, e.Path)
+}
+
+// ConfigDir returns the directory of the per-user git-cr configuration,
+// $XDG_CONFIG_HOME/git-cr or ~/.config/git-cr
+func ConfigDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "git-cr"), nil
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return "", errors.New("neither XDG_CONFIG_HOME nor HOME are set")
+	}
+	return filepath.Join(home, ".config", "git-cr"), nil
+}
+
+// KeyStorePath returns the path of the per-user key store in the ConfigDir
+func KeyStorePath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "keys"), nil
+}
+
+// ResolveKey returns the encryption settings for the key reference key:<name>.
+// The environment variable named by KeyEnvVar takes precedence, then the git
+// config entry cr.<name>.key and finally the key store are searched.
+func ResolveKey(name string) (string, error) {
+	if !keyNameRegexp.MatchString(name) {
+		return "", ErrInvalidKeyName
+	}
+
+	if settings := os.Getenv(KeyEnvVar(name)); settings != "" {
+		return settings, nil
+	}
+
+	if out, err := exec.Command("git", "config", "--get", "cr."+name+".key").Output(); err == nil {
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	path, err := KeyStorePath()
+	if err != nil {
+		return "", err
+	}
+	keys, err := readKeyStore(path)
+	if os.IsNotExist(err) {
+		return "", ErrKeyNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	settings, ok := keys[name]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return settings, nil
+}
+
+// KeyEnvVar returns the environment variable that can hold the key with the
+// given name, GIT_CR_KEY_<NAME>. Lower case letters are turned into upper
+// case, digits are kept and every other byte is written as '_' followed by
+// its hex code, so different names never share a variable: my-key.2 becomes
+// GIT_CR_KEY_MY_2DKEY_2E2.
+func KeyEnvVar(name string) string {
+	var buf bytes.Buffer
+	buf.WriteString("GIT_CR_KEY_")
+	for _, c := range []byte(name) {
+		switch {
+		case c >= 'a' && c <= 'z':
+			buf.WriteByte(c - 'a' + 'A')
+		case c >= '0' && c <= '9':
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "_%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// StoreKey adds encryption settings to the key store under the given name,
+// creating the key store if necessary
+func StoreKey(name, settings string) error {
+	if !keyNameRegexp.MatchString(name) {
+		return ErrInvalidKeyName
+	}
+	if settings == "" || strings.ContainsAny(settings, "\r\n") {
+		return ErrInvalidEncryptionSettings
+	}
+
+	path, err := KeyStorePath()
+	if err != nil {
+		return err
+	}
+	keys, err := readKeyStore(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, ok := keys[name]; ok {
+		return ErrKeyExists
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", name, settings); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readKeyStore parses the key store at path. Each line holds a key name and
+// its encryption settings separated by whitespace, lines starting with '#'
+// are ignored. The settings extend to the end of the line, since passphrases
+// may contain spaces.
+func readKeyStore(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, &KeyStorePermissionsError{Path: path, Mode: info.Mode().Perm()}
+	}
+
+	keys := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid line in key store %s: %q", path, line)
+		}
+		keys[line[:i]] = strings.TrimSpace(line[i:])
+	}
+	return keys, scanner.Err()
+}
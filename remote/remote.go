@@ -0,0 +1,330 @@
+// Package remote opens encrypted repos and serves them to git, either via
+// ext:: remotes or as a git remote helper.
+package remote
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lucas-clemente/git-cr/backends"
+	// Backends register themselves for their URL schemes
+	_ "github.com/lucas-clemente/git-cr/backends/gitstore"
+	_ "github.com/lucas-clemente/git-cr/backends/local"
+	_ "github.com/lucas-clemente/git-cr/backends/s3"
+	_ "github.com/lucas-clemente/git-cr/backends/sftp"
+	_ "github.com/lucas-clemente/git-cr/backends/webdav"
+	"github.com/lucas-clemente/git-cr/crypto/age"
+	"github.com/lucas-clemente/git-cr/crypto/box"
+	"github.com/lucas-clemente/git-cr/crypto/nacl"
+	"github.com/lucas-clemente/git-cr/crypto/naming"
+	"github.com/lucas-clemente/git-cr/crypto/padding"
+	"github.com/lucas-clemente/git-cr/crypto/pgp"
+	"github.com/lucas-clemente/git-cr/git/handler"
+	"github.com/lucas-clemente/git-cr/git/pktline"
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+var (
+	// ErrInvalidEncryptionSettings occurs if the encryption settings can't be parsed
+	ErrInvalidEncryptionSettings = errors.New("the encryption settings are invalid")
+	// ErrInvalidNaClSecret occurs if a nacl secret is not 32 bytes in base64
+	ErrInvalidNaClSecret = errors.New("the nacl secret should be 32 bytes in base64")
+)
+
+// Open creates the repo for the given URL, encrypted according to the
+// encryption settings, see WrapEncryption
+func Open(repoURL string, encryptionSettings string) (repo.Repo, error) {
+	return OpenWithOptions(repoURL, encryptionSettings, Options{})
+}
+
+// Options for opening repos
+type Options struct {
+	// Padding is the padding scheme for new blobs, "none", "padme" or "pow2"
+	Padding string
+	// Heads remembers the newest revision, to detect rollbacks. May be nil.
+	Heads repo.HeadStore
+}
+
+// OpenWithOptions is like Open, but with the given options
+func OpenWithOptions(repoURL, encryptionSettings string, options Options) (repo.Repo, error) {
+	scheme, err := padding.ParseScheme(options.Padding)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := OpenBackend(repoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err = WrapEncryption(backend, encryptionSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := isEncrypted(encryptionSettings)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		if backend, err = naming.Open(backend); err != nil {
+			return nil, err
+		}
+	}
+
+	// Padding goes inside the encryption
+	backend = padding.NewPaddingBackend(backend, scheme)
+
+	if options.Heads != nil {
+		return repo.NewVerifiedJSONRepo(backend, options.Heads), nil
+	}
+	return repo.NewJSONRepo(backend), nil
+}
+
+// OpenBackend creates the unencrypted backend for the given URL
+func OpenBackend(repoURL string) (repo.Backend, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	return backends.NewBackend(u)
+}
+
+// Rekey re-encrypts the repo at the URL from the old to the new encryption
+// settings, see repo.Rekey
+func Rekey(repoURL, oldSettings, newSettings string, progress func(done, total int)) error {
+	backend, err := OpenBackend(repoURL)
+	if err != nil {
+		return err
+	}
+	from, err := WrapEncryption(backend, oldSettings)
+	if err != nil {
+		return err
+	}
+	// Only new repos get a KDF header automatically
+	resolved, err := ResolveSettings(newSettings)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(resolved, "nacl-pass:") {
+		if err := nacl.CreateKDFHeader(backend); err != nil {
+			return err
+		}
+	}
+	to, err := WrapEncryption(backend, newSettings)
+	if err != nil {
+		return err
+	}
+
+	fromEncrypted, err := isEncrypted(oldSettings)
+	if err != nil {
+		return err
+	}
+	toEncrypted, err := isEncrypted(newSettings)
+	if err != nil {
+		return err
+	}
+	shared, err := repo.SharesBlobNames(from, to)
+	if err != nil {
+		return err
+	}
+	fromNamed, toNamed, err := rekeyNames(from, to, fromEncrypted, toEncrypted)
+	if err != nil {
+		return err
+	}
+
+	if err := repo.Rekey(fromNamed, toNamed, progress); err != nil {
+		return err
+	}
+	// Remove the old copy of the naming key
+	if !shared && fromEncrypted {
+		if err := repo.DeleteBlob(from, naming.KeyName); err != nil && err != repo.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekeyNames wraps the old and new backends in the naming layer if they are
+// encrypted. The new settings keep the naming key, so that the pseudonyms
+// don't change, and repos without naming key get one. The key is stored with
+// the new settings first, so that it can be read from there if the rekey is
+// interrupted. It is written again even if it didn't change, to store it in
+// the current format.
+func rekeyNames(from, to repo.Backend, fromEncrypted, toEncrypted bool) (repo.Backend, repo.Backend, error) {
+	var key []byte
+	fromHasKey := false
+	if fromEncrypted {
+		var err error
+		key, err = naming.ReadKey(from)
+		fromHasKey = err == nil
+		if err != nil && toEncrypted {
+			toKey, toErr := naming.ReadKey(to)
+			if toErr == nil {
+				key = toKey
+				// An earlier run replaced the old key in place
+				fromHasKey = err != repo.ErrNotFound
+			} else if toErr != repo.ErrNotFound {
+				return nil, nil, toErr
+			}
+		}
+		if err != nil && err != repo.ErrNotFound && !fromHasKey {
+			return nil, nil, err
+		}
+	}
+
+	if fromHasKey {
+		from = naming.NewNamingBackend(from, key)
+	}
+	if !toEncrypted {
+		return from, to, nil
+	}
+
+	if key == nil {
+		var err error
+		if key, err = naming.CreateKey(to); err != nil {
+			return nil, nil, err
+		}
+	} else if err := naming.WriteKey(to, key); err != nil {
+		return nil, nil, err
+	}
+	return from, naming.NewNamingBackend(to, key), nil
+}
+
+// isEncrypted reports whether the settings encrypt the repo
+func isEncrypted(encryptionSettings string) (bool, error) {
+	resolved, err := ResolveSettings(encryptionSettings)
+	if err != nil {
+		return false, err
+	}
+	return resolved != "none", nil
+}
+
+// ResolveSettings replaces a key reference "key:<name>" with the encryption
+// settings it points to, see ResolveKey. Other settings are returned as is.
+func ResolveSettings(encryptionSettings string) (string, error) {
+	if !strings.HasPrefix(encryptionSettings, "key:") {
+		return encryptionSettings, nil
+	}
+	resolved, err := ResolveKey(strings.TrimPrefix(encryptionSettings, "key:"))
+	if err != nil {
+		return "", err
+	}
+	// Key references can't point to other key references
+	if strings.HasPrefix(resolved, "key:") {
+		return "", ErrInvalidEncryptionSettings
+	}
+	return resolved, nil
+}
+
+// WrapEncryption wraps the backend in the encryption given by the settings.
+// These are either "none", "nacl:<base64 secret>", "nacl-pass:<passphrase>",
+// "box:<identity>", "age:<identity>[,<recipient>...]", "age-pass:<passphrase>",
+// "pgp:<public keyring>[,<secret keyring>]" or a reference "key:<name>" to
+// settings kept outside the repo.
+func WrapEncryption(backend repo.Backend, encryptionSettings string) (repo.Backend, error) {
+	encryptionSettings, err := ResolveSettings(encryptionSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	if encryptionSettings == "none" {
+		return backend, nil
+	}
+
+	if strings.HasPrefix(encryptionSettings, "nacl:") {
+		// The first secret encrypts, older ones are only used for reading
+		var secrets [][32]byte
+		for _, secretB64 := range strings.Split(strings.TrimPrefix(encryptionSettings, "nacl:"), ",") {
+			secret, err := base64.StdEncoding.DecodeString(secretB64)
+			if err != nil || len(secret) != 32 {
+				return nil, ErrInvalidNaClSecret
+			}
+
+			secretArray := [32]byte{}
+			copy(secretArray[:], secret)
+			secrets = append(secrets, secretArray)
+		}
+		return nacl.NewNaClBackend(backend, secrets[0], secrets[1:]...), nil
+	}
+
+	if strings.HasPrefix(encryptionSettings, "nacl-pass:") {
+		passphrase := strings.TrimPrefix(encryptionSettings, "nacl-pass:")
+		if passphrase == "" {
+			return nil, ErrInvalidEncryptionSettings
+		}
+		return nacl.NewPassphraseBackend(backend, passphrase)
+	}
+
+	if strings.HasPrefix(encryptionSettings, "box:") {
+		return box.NewBoxBackend(backend, strings.TrimPrefix(encryptionSettings, "box:"))
+	}
+
+	if strings.HasPrefix(encryptionSettings, "pgp:") {
+		return wrapPGP(backend, strings.TrimPrefix(encryptionSettings, "pgp:"))
+	}
+
+	if strings.HasPrefix(encryptionSettings, "age:") {
+		return age.NewX25519Backend(backend, strings.TrimPrefix(encryptionSettings, "age:"))
+	}
+
+	if strings.HasPrefix(encryptionSettings, "age-pass:") {
+		passphrase := strings.TrimPrefix(encryptionSettings, "age-pass:")
+		if passphrase == "" {
+			return nil, ErrInvalidEncryptionSettings
+		}
+		return age.NewPassphraseBackend(backend, passphrase)
+	}
+
+	return nil, ErrInvalidEncryptionSettings
+}
+
+// wrapPGP parses "<public keyring>[,<secret keyring>]". Relative paths are
+// relative to the ConfigDir, the secret keyring defaults to secring.asc.
+func wrapPGP(backend repo.Backend, settings string) (repo.Backend, error) {
+	parts := strings.Split(settings, ",")
+	if len(parts) > 2 || parts[0] == "" {
+		return nil, ErrInvalidEncryptionSettings
+	}
+	if len(parts) == 1 {
+		parts = append(parts, "secring.asc")
+	}
+
+	dir, err := ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range parts {
+		if !filepath.IsAbs(p) {
+			parts[i] = filepath.Join(dir, p)
+		}
+	}
+	return pgp.NewKeyRingBackend(backend, parts[0], parts[1], os.Getenv("GIT_CR_PGP_PASSPHRASE"))
+}
+
+type pktlineDecoderWrapper struct {
+	*pktline.Decoder
+	io.Reader
+}
+
+// newHandler makes a git request handler talking pkt-line over in and out.
+// gitProtocol is the content of the GIT_PROTOCOL environment variable.
+func newHandler(in io.Reader, out io.Writer, r repo.Repo, gitProtocol string) *handler.GitRequestHandler {
+	encoder := pktline.NewEncoder(out)
+	decoder := &pktlineDecoderWrapper{Decoder: pktline.NewDecoder(in), Reader: in}
+
+	server := handler.NewGitRequestHandler(encoder, decoder, r)
+	server.SetGitProtocol(gitProtocol)
+	return server
+}
+
+// Serve handles a single git request, starting with the handshake sent by
+// ext:: remotes
+func Serve(in io.Reader, out io.Writer, r repo.Repo, gitProtocol string) error {
+	return newHandler(in, out, r, gitProtocol).ServeRequest()
+}
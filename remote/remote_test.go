@@ -0,0 +1,398 @@
+package remote_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/lucas-clemente/git-cr/crypto/nacl"
+	"github.com/lucas-clemente/git-cr/git/repo"
+	"github.com/lucas-clemente/git-cr/remote"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRemote(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Remote Suite")
+}
+
+var _ = Describe("Remote", func() {
+	var (
+		tmpDir string
+		r      repo.Repo
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "io.clemente.git-cr.test")
+		Ω(err).ShouldNot(HaveOccurred())
+		r, err = remote.Open("file://"+tmpDir, "none")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	Context("opening repos", func() {
+		It("opens nacl encrypted repos", func() {
+			_, err := remote.Open("file://"+tmpDir, "nacl:MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTI=")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("opens passphrase encrypted repos", func() {
+			_, err := remote.Open("file://"+tmpDir, "nacl-pass:correct horse battery staple")
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = os.Stat(tmpDir + "/kdf.json")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("rejects empty passphrases", func() {
+			_, err := remote.Open("file://"+tmpDir, "nacl-pass:")
+			Ω(err).Should(Equal(remote.ErrInvalidEncryptionSettings))
+		})
+
+		It("rejects short nacl secrets", func() {
+			_, err := remote.Open("file://"+tmpDir, "nacl:MTIzNA==")
+			Ω(err).Should(Equal(remote.ErrInvalidNaClSecret))
+		})
+
+		It("rejects pgp settings without keyring", func() {
+			_, err := remote.Open("file://"+tmpDir, "pgp:")
+			Ω(err).Should(Equal(remote.ErrInvalidEncryptionSettings))
+		})
+
+		It("looks for pgp keyrings in the config dir", func() {
+			os.Setenv("XDG_CONFIG_HOME", tmpDir)
+			defer os.Unsetenv("XDG_CONFIG_HOME")
+			_, err := remote.Open("file://"+tmpDir, "pgp:team.asc")
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring(tmpDir + "/git-cr/team.asc"))
+		})
+
+		It("rejects unknown encryption settings", func() {
+			_, err := remote.Open("file://"+tmpDir, "rot13")
+			Ω(err).Should(Equal(remote.ErrInvalidEncryptionSettings))
+		})
+
+		It("rejects unknown backends", func() {
+			_, err := remote.Open("foo://bar", "none")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("resolving keys", func() {
+		const secret = "nacl:MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTI="
+
+		envKeys := []string{"XDG_CONFIG_HOME", "GIT_CR_KEY_FOO", "GIT_CR_KEY_MY_2DKEY_2E2", "GIT_CONFIG_COUNT", "GIT_CONFIG_KEY_0", "GIT_CONFIG_VALUE_0"}
+		var savedEnv map[string]string
+
+		BeforeEach(func() {
+			savedEnv = map[string]string{}
+			for _, k := range envKeys {
+				if v, ok := os.LookupEnv(k); ok {
+					savedEnv[k] = v
+				}
+				os.Unsetenv(k)
+			}
+			os.Setenv("XDG_CONFIG_HOME", tmpDir)
+		})
+
+		AfterEach(func() {
+			for _, k := range envKeys {
+				if v, ok := savedEnv[k]; ok {
+					os.Setenv(k, v)
+				} else {
+					os.Unsetenv(k)
+				}
+			}
+		})
+
+		It("reads keys from the key store", func() {
+			err := remote.StoreKey("foo", secret)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(remote.ResolveKey("foo")).Should(Equal(secret))
+			_, err = remote.Open("file://"+tmpDir, "key:foo")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("creates the key store with restricted permissions", func() {
+			err := remote.StoreKey("foo", secret)
+			Ω(err).ShouldNot(HaveOccurred())
+			info, err := os.Stat(tmpDir + "/git-cr/keys")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Mode().Perm()).Should(Equal(os.FileMode(0600)))
+		})
+
+		It("refuses key stores readable by others", func() {
+			err := remote.StoreKey("foo", secret)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = os.Chmod(tmpDir+"/git-cr/keys", 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = remote.ResolveKey("foo")
+			Ω(err).Should(BeAssignableToTypeOf(&remote.KeyStorePermissionsError{}))
+		})
+
+		It("reads passphrases with spaces from the key store", func() {
+			err := remote.StoreKey("foo", "nacl-pass:correct horse battery staple")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(remote.ResolveKey("foo")).Should(Equal("nacl-pass:correct horse battery staple"))
+		})
+
+		It("doesn't overwrite keys", func() {
+			err := remote.StoreKey("foo", secret)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = remote.StoreKey("foo", "none")
+			Ω(err).Should(Equal(remote.ErrKeyExists))
+		})
+
+		It("reads keys from GIT_CR_KEY_<NAME>", func() {
+			os.Setenv("GIT_CR_KEY_FOO", secret)
+			Ω(remote.ResolveKey("foo")).Should(Equal(secret))
+			_, err := remote.ResolveKey("bar")
+			Ω(err).Should(Equal(remote.ErrKeyNotFound))
+
+			os.Setenv("GIT_CR_KEY_MY_2DKEY_2E2", secret)
+			Ω(remote.ResolveKey("my-key.2")).Should(Equal(secret))
+		})
+
+		It("reads keys from the git config", func() {
+			os.Setenv("GIT_CONFIG_COUNT", "1")
+			os.Setenv("GIT_CONFIG_KEY_0", "cr.foo.key")
+			os.Setenv("GIT_CONFIG_VALUE_0", secret)
+			Ω(remote.ResolveKey("foo")).Should(Equal(secret))
+		})
+
+		It("errors for unknown keys", func() {
+			_, err := remote.ResolveKey("foo")
+			Ω(err).Should(Equal(remote.ErrKeyNotFound))
+			_, err = remote.Open("file://"+tmpDir, "key:foo")
+			Ω(err).Should(Equal(remote.ErrKeyNotFound))
+		})
+
+		It("rejects invalid key names", func() {
+			_, err := remote.ResolveKey("../foo")
+			Ω(err).Should(Equal(remote.ErrInvalidKeyName))
+		})
+
+		It("rejects key references to key references", func() {
+			os.Setenv("GIT_CR_KEY_FOO", "key:bar")
+			_, err := remote.Open("file://"+tmpDir, "key:foo")
+			Ω(err).Should(Equal(remote.ErrInvalidEncryptionSettings))
+		})
+	})
+
+	Context("as remote helper", func() {
+		run := func(commands string) (string, error) {
+			var out bytes.Buffer
+			err := remote.NewHelper(strings.NewReader(commands), &out, r).Run()
+			return out.String(), err
+		}
+
+		It("sends its capabilities", func() {
+			out, err := run("capabilities\n\n")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out).Should(Equal("stateless-connect\nfetch\npush\n\n"))
+		})
+
+		It("lists refs", func() {
+			err := ioutil.WriteFile(tmpDir+"/revisions.json", []byte(`[{"HEAD":"f84b0d7375bcb16dd2742344e6af173aeebfcfd6","refs/heads/master":"f84b0d7375bcb16dd2742344e6af173aeebfcfd6"}]`), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			out, err := run("list\n")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out).Should(Equal("f84b0d7375bcb16dd2742344e6af173aeebfcfd6 HEAD\nf84b0d7375bcb16dd2742344e6af173aeebfcfd6 refs/heads/master\n\n"))
+		})
+
+		It("lists empty repos", func() {
+			out, err := run("list for-push\n")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out).Should(Equal("\n"))
+		})
+
+		It("serves protocol v2 over stateless connections", func() {
+			err := ioutil.WriteFile(tmpDir+"/revisions.json", []byte(`[{"HEAD":"f84b0d7375bcb16dd2742344e6af173aeebfcfd6","refs/heads/master":"f84b0d7375bcb16dd2742344e6af173aeebfcfd6"}]`), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			out, err := run("capabilities\nstateless-connect git-upload-pack\n0014command=ls-refs\n0000")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out).Should(HavePrefix("stateless-connect\nfetch\npush\n\n\n000eversion 2\n"))
+			Ω(out).Should(ContainSubstring("f84b0d7375bcb16dd2742344e6af173aeebfcfd6 refs/heads/master\n"))
+			Ω(out).Should(HaveSuffix("00000002"))
+		})
+
+		It("refuses unknown services", func() {
+			_, err := run("stateless-connect git-receive-pack\n")
+			Ω(err).Should(Equal(remote.ErrUnknownService))
+		})
+
+		It("refuses the commands of capabilities it doesn't have", func() {
+			for _, command := range []string{
+				"connect git-upload-pack\n",
+				"export\n",
+			} {
+				_, err := run(command)
+				Ω(err).Should(HaveOccurred())
+			}
+		})
+	})
+
+	Context("rekeying", func() {
+		const (
+			key1 = "nacl:MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTI="
+			key2 = "nacl:QUJDREVGR0hJSktMTU5PUFFSU1RVVldYWVowMTIzNDU="
+		)
+
+		push := func(settings string) {
+			r, err := remote.Open("file://"+tmpDir, settings)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = r.SaveNewRevision(0, repo.Revision{"refs/heads/master": "foobar"}, bytes.NewBufferString("pack"))
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+
+		expectReadable := func(settings string) {
+			r, err := remote.Open("file://"+tmpDir, settings)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(r.GetRevisions()).Should(Equal([]repo.Revision{{"refs/heads/master": "foobar"}}))
+			rdr, err := r.ReadPackfile(0)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(rdr)).Should(Equal([]byte("pack")))
+		}
+
+		files := func() []string {
+			infos, err := ioutil.ReadDir(tmpDir)
+			Ω(err).ShouldNot(HaveOccurred())
+			var names []string
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+			return names
+		}
+
+		It("keeps the blob names", func() {
+			push(key1)
+			before := files()
+			err := remote.Rekey("file://"+tmpDir, key1, key2, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(files()).Should(Equal(before))
+			expectReadable(key2)
+		})
+
+		It("rekeys to a passphrase", func() {
+			push(key1)
+			err := remote.Rekey("file://"+tmpDir, key1, "nacl-pass:correct horse battery staple", nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(files()).Should(ContainElement("kdf.json"))
+			expectReadable("nacl-pass:correct horse battery staple")
+		})
+
+		It("reads blobs of old keys without rekeying", func() {
+			push(key1)
+			expectReadable(key2 + "," + strings.TrimPrefix(key1, "nacl:"))
+		})
+
+		It("hides the names of old repos", func() {
+			// Repos without naming key use plain names
+			err := ioutil.WriteFile(tmpDir+"/revisions.json", []byte(`[{"refs/heads/master":"foobar"}]`), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = ioutil.WriteFile(tmpDir+"/0.pack", []byte("pack"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = remote.Rekey("file://"+tmpDir, "none", key1, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(files()).Should(ContainElement("names.key.nacl"))
+			Ω(files()).ShouldNot(ContainElement("revisions.json.nacl"))
+			Ω(files()).Should(HaveLen(3))
+			expectReadable(key1)
+		})
+
+		It("removes the old naming key", func() {
+			push(key1)
+			err := remote.Rekey("file://"+tmpDir, key1, "age-pass:correct horse battery staple", nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(files()).Should(ContainElement("names.key.age"))
+			Ω(files()).ShouldNot(ContainElement("names.key.nacl"))
+			Ω(files()).Should(HaveLen(4))
+			expectReadable("age-pass:correct horse battery staple")
+		})
+
+		It("migrates blobs written without header", func() {
+			push(key1)
+			var key [32]byte
+			copy(key[:], "12345678901234567890123456789012")
+			var pack string
+			var legacyPack []byte
+			for _, name := range files() {
+				f, err := os.Open(tmpDir + "/" + name)
+				Ω(err).ShouldNot(HaveOccurred())
+				data, err := ioutil.ReadAll(nacl.OpenBlob(f, &key, strings.TrimSuffix(name, ".nacl")))
+				f.Close()
+				Ω(err).ShouldNot(HaveOccurred())
+				// Earlier versions didn't know strict mode
+				data = bytes.Replace(data, []byte(`"strict":true,`), nil, 1)
+				legacy := nacl.Seal(data, &key)
+				Ω(ioutil.WriteFile(tmpDir+"/"+name, legacy, 0644)).Should(Succeed())
+				if string(data) == "pack" {
+					pack, legacyPack = name, legacy
+				}
+			}
+
+			err := remote.Rekey("file://"+tmpDir, key1, key1, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(files()).Should(HaveLen(4))
+			for _, name := range files() {
+				data, err := ioutil.ReadFile(tmpDir + "/" + name)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(data)).Should(HavePrefix("git-cr\x00"))
+			}
+			expectReadable(key1)
+
+			// Blobs without header are rejected from now on
+			Ω(ioutil.WriteFile(tmpDir+"/"+pack, legacyPack, 0644)).Should(Succeed())
+			r, err := remote.Open("file://"+tmpDir, key1)
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = r.GetRevisions()
+			Ω(err).ShouldNot(HaveOccurred())
+			rdr, err := r.ReadPackfile(0)
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = ioutil.ReadAll(rdr)
+			Ω(err).Should(Equal(nacl.ErrMissingHeader))
+		})
+	})
+
+	Context("remembering heads", func() {
+		It("stores heads in files", func() {
+			heads := remote.NewFileHeadStore(remote.HeadStorePath(tmpDir+"/.git", "file:///foo"))
+			head, err := heads.GetHead()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(head.Hash).Should(BeEmpty())
+
+			Ω(heads.SaveHead(repo.Head{Index: 42, Hash: "abc"})).Should(Succeed())
+			head, err = heads.GetHead()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(head).Should(Equal(repo.Head{Index: 42, Hash: "abc"}))
+
+			Ω(heads.SaveHead(repo.Head{Index: 43, Hash: "def", Strict: true})).Should(Succeed())
+			head, err = heads.GetHead()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(head).Should(Equal(repo.Head{Index: 43, Hash: "def", Strict: true}))
+		})
+
+		It("detects rollbacks", func() {
+			const settings = "nacl:MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTI="
+			heads := remote.NewFileHeadStore(tmpDir + "/head")
+			r, err := remote.OpenWithOptions("file://"+tmpDir, settings, remote.Options{Heads: heads})
+			Ω(err).ShouldNot(HaveOccurred())
+			err = r.SaveNewRevision(0, repo.Revision{"refs/heads/master": "foo"}, bytes.NewBufferString("pack"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			// Another client with a forked history
+			Ω(heads.SaveHead(repo.Head{Index: 1, Hash: "abc"})).Should(Succeed())
+			_, err = r.GetRevisions()
+			Ω(err).Should(Equal(repo.ErrRollback))
+		})
+	})
+})
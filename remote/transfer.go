@@ -0,0 +1,298 @@
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/lucas-clemente/git-cr/git/handler"
+	"github.com/lucas-clemente/git-cr/git/pktline"
+	"github.com/lucas-clemente/git-cr/git/repo"
+)
+
+// ErrInvalidPushSpec occurs if git sends a push command that isn't src:dst
+var ErrInvalidPushSpec = errors.New("invalid push command sent by git")
+
+const nullID = "0000000000000000000000000000000000000000"
+
+// Push answers a batch of push commands. Like git send-pack, it sends the ref
+// updates and a pack made by git pack-objects to a GitRequestHandler, and
+// reports the status of each ref to git. Fast-forward checks were done by git
+// against the refs from list.
+func (h *Helper) Push(specs []string) error {
+	current, _, err := h.currentRefs()
+	if err != nil {
+		return err
+	}
+
+	var request bytes.Buffer
+	encoder := pktline.NewEncoder(&request)
+	names := make([]string, len(specs))
+	var newIDs []string
+	for i, spec := range specs {
+		parts := strings.SplitN(strings.TrimPrefix(spec, "+"), ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return ErrInvalidPushSpec
+		}
+		names[i] = parts[1]
+
+		newID := nullID
+		if parts[0] != "" {
+			out, err := exec.Command("git", "rev-parse", "--verify", parts[0]).Output()
+			if err != nil {
+				return err
+			}
+			newID = strings.TrimSpace(string(out))
+			newIDs = append(newIDs, newID)
+		}
+		oldID, ok := current[names[i]]
+		if !ok {
+			oldID = nullID
+		}
+		line := oldID + " " + newID + " " + names[i]
+		if i == 0 {
+			line += "\000report-status"
+		}
+		if err := encoder.Encode([]byte(line)); err != nil {
+			return err
+		}
+	}
+	if err := encoder.Encode(nil); err != nil {
+		return err
+	}
+
+	// git doesn't send a packfile if all updates are deletes
+	in := io.Reader(&request)
+	var packObjects *exec.Cmd
+	var pack io.ReadCloser
+	if len(newIDs) != 0 {
+		haves, err := localObjects(refIDs(current))
+		if err != nil {
+			return err
+		}
+		revs := newIDs
+		for _, id := range haves {
+			revs = append(revs, "^"+id)
+		}
+		packObjects = exec.Command("git", "pack-objects", "--stdout", "--revs", "--thin", "--delta-base-offset", "-q")
+		packObjects.Stdin = strings.NewReader(strings.Join(revs, "\n") + "\n")
+		packObjects.Stderr = os.Stderr
+		if pack, err = packObjects.StdoutPipe(); err != nil {
+			return err
+		}
+		if err := packObjects.Start(); err != nil {
+			return err
+		}
+		in = io.MultiReader(&request, pack)
+	}
+
+	var response bytes.Buffer
+	err = newHandler(in, &response, h.repo, "").ServeOperation(handler.GitPush)
+	if packObjects != nil {
+		// Stops git pack-objects if the handler failed before reading the pack
+		pack.Close()
+		if waitErr := packObjects.Wait(); err == nil {
+			err = waitErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	reasons, err := readReportStatus(&response)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		status := "ok " + name
+		if reason, ok := reasons[name]; ok {
+			status = "error " + name + " " + reason
+		}
+		if err := h.write(status + "\n"); err != nil {
+			return err
+		}
+	}
+	return h.write("\n")
+}
+
+// readReportStatus skips the ref advertisement and returns the reasons for
+// all refs the report-status rejects
+func readReportStatus(response io.Reader) (map[string]string, error) {
+	decoder := pktline.NewDecoder(response)
+	var line []byte
+	for {
+		if err := decoder.Decode(&line); err != nil {
+			return nil, err
+		}
+		if line == nil {
+			break
+		}
+	}
+
+	reasons := map[string]string{}
+	for {
+		if err := decoder.Decode(&line); err != nil {
+			return nil, err
+		}
+		if line == nil {
+			return reasons, nil
+		}
+		status := strings.TrimSuffix(string(line), "\n")
+		if strings.HasPrefix(status, "ng ") {
+			parts := strings.SplitN(strings.TrimPrefix(status, "ng "), " ", 2)
+			if len(parts) != 2 {
+				return nil, handler.ErrorInvalidPushRefsLine
+			}
+			reasons[parts[0]] = parts[1]
+		}
+	}
+}
+
+// Fetch answers a batch of fetch commands, which git sends for protocol v0
+// and v1. Like git fetch-pack, it requests the objects from a
+// GitRequestHandler, with the refs of all revisions git has as haves, and
+// stores the pack using git index-pack.
+func (h *Helper) Fetch(refs []string) error {
+	_, revisions, err := h.currentRefs()
+	if err != nil {
+		return err
+	}
+	var known []string
+	for _, rev := range revisions {
+		known = append(known, refIDs(rev)...)
+	}
+	haves, err := localObjects(known)
+	if err != nil {
+		return err
+	}
+
+	var request bytes.Buffer
+	encoder := pktline.NewEncoder(&request)
+	for i, ref := range refs {
+		line := "want " + strings.SplitN(ref, " ", 2)[0]
+		if i == 0 {
+			line += " side-band-64k ofs-delta thin-pack no-progress"
+		}
+		if err := encoder.Encode([]byte(line + "\n")); err != nil {
+			return err
+		}
+	}
+	if err := encoder.Encode(nil); err != nil {
+		return err
+	}
+	for _, id := range haves {
+		if err := encoder.Encode([]byte("have " + id + "\n")); err != nil {
+			return err
+		}
+	}
+	if err := encoder.Encode([]byte("done\n")); err != nil {
+		return err
+	}
+
+	response, responseWriter := io.Pipe()
+	go func() {
+		responseWriter.CloseWithError(newHandler(&request, responseWriter, h.repo, "").ServeOperation(handler.GitPull))
+	}()
+	defer response.Close()
+
+	indexPack := exec.Command("git", "index-pack", "--stdin", "--fix-thin")
+	indexPack.Stderr = os.Stderr
+	pack, err := indexPack.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := indexPack.Start(); err != nil {
+		return err
+	}
+	err = readSideBand(response, pack)
+	pack.Close()
+	if waitErr := indexPack.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return err
+	}
+	return h.write("\n")
+}
+
+// readSideBand skips the ref advertisement and acknowledgments, and copies
+// the packfile sent on side-band channel 1 to pack
+func readSideBand(response io.Reader, pack io.Writer) error {
+	decoder := pktline.NewDecoder(response)
+	var line []byte
+	for {
+		if err := decoder.Decode(&line); err != nil {
+			return err
+		}
+		if line == nil {
+			break
+		}
+	}
+
+	for {
+		if err := decoder.Decode(&line); err != nil {
+			return err
+		}
+		switch {
+		case line == nil:
+			return nil
+		case len(line) == 0:
+			return handler.ErrorInvalidCommand
+		case bytes.HasPrefix(line, []byte("NAK")) || bytes.HasPrefix(line, []byte("ACK ")):
+		case line[0] == 1:
+			if _, err := pack.Write(line[1:]); err != nil {
+				return err
+			}
+		case line[0] == 3:
+			return errors.New(strings.TrimSpace(string(line[1:])))
+		}
+	}
+}
+
+// currentRefs returns the refs of the newest revision, and all revisions
+func (h *Helper) currentRefs() (repo.Revision, []repo.Revision, error) {
+	revisions, err := h.repo.GetRevisions()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(revisions) == 0 {
+		return repo.Revision{}, revisions, nil
+	}
+	return revisions[len(revisions)-1], revisions, nil
+}
+
+func refIDs(rev repo.Revision) []string {
+	ids := make([]string, 0, len(rev))
+	for _, id := range rev {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// localObjects returns the ids of the objects the local repo has. git sets
+// GIT_DIR for remote helpers.
+func localObjects(ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	cmd := exec.Command("git", "cat-file", "--batch-check")
+	cmd.Stdin = strings.NewReader(strings.Join(ids, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var local []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// Missing objects are reported as "<id> missing"
+		fields := strings.Fields(line)
+		if len(fields) == 3 && !seen[fields[0]] {
+			seen[fields[0]] = true
+			local = append(local, fields[0])
+		}
+	}
+	return local, nil
+}